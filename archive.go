@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// historyFile is the name of the file in the data directory which holds the
+// chat history.
+const historyFile = "history.jsonl"
+
+// maxHistoryLine is the longest line read back from the history file.
+const maxHistoryLine = 1 << 20
+
+// historyConfig is the history section of the configuration file.
+type historyConfig struct {
+	// Off stops saving the history, and reading back what was saved before.
+	Off bool `json:"off"`
+
+	// MaxFileKB is how large the history file grows before it is moved
+	// aside to history.jsonl.1, replacing the one there, so at most twice
+	// this much is kept.
+	MaxFileKB int `json:"max-file-kb"`
+
+	// MaxMessages is how many messages are kept in memory, for search and
+	// for replies, edits and reactions to refer to.
+	MaxMessages int `json:"max-messages"`
+}
+
+// defaultHistoryConfig is used for any limit the configuration file does not
+// set.
+var defaultHistoryConfig = historyConfig{
+	MaxFileKB:   4096,
+	MaxMessages: 10000,
+}
+
+// withDefaults fills in the limits which are not set.
+func (c historyConfig) withDefaults() historyConfig {
+	if c.MaxFileKB <= 0 {
+		c.MaxFileKB = defaultHistoryConfig.MaxFileKB
+	}
+	if c.MaxMessages <= 0 {
+		c.MaxMessages = defaultHistoryConfig.MaxMessages
+	}
+	return c
+}
+
+// historyRecord is one line of the history file: a message as it arrived, or
+// an edit or delete of one. Edits and deletes are kept as they arrived, and
+// resolved when the file is read, in the same way as in the messages view.
+type historyRecord struct {
+	Kind     string      `json:"kind"`
+	ID       string      `json:"id"`
+	From     NodeAddress `json:"from"`
+	Sender   string      `json:"sender,omitempty"`
+	Channel  string      `json:"channel,omitempty"`
+	To       NodeAddress `json:"to,omitempty"`
+	Body     string      `json:"body,omitempty"`
+	ReplyTo  string      `json:"reply-to,omitempty"`
+	Time     time.Time   `json:"time"`
+	Revision int         `json:"revision,omitempty"`
+}
+
+// historyLog appends the chat history to a file, which is rotated like the
+// log file once it grows past its limit. A nil *historyLog does nothing, so
+// history is only kept when main opened one.
+type historyLog struct {
+	path string
+	file *rotatingFile
+}
+
+// openHistoryLog opens the history file in dir for appending, creating it if
+// needed. It holds direct messages, so only we may read it. Without a dir, it
+// returns nil and nothing is saved.
+func openHistoryLog(dir string, maxSize int64) (*historyLog, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, historyFile)
+	file, err := openRotatingFile(path, maxSize, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &historyLog{path: path, file: file}, nil
+}
+
+// Append writes rec to the end of the history file.
+func (l *historyLog) Append(rec historyRecord) {
+	if l == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logError("Failed to encode the history", "err", err)
+		return
+	}
+
+	l.file.WriteLine(string(data))
+}
+
+// messageRecord returns the history record of a stored message.
+func messageRecord(msg chatMessage) historyRecord {
+	return historyRecord{
+		Kind:     "message",
+		ID:       msg.ID,
+		From:     msg.From,
+		Sender:   msg.Sender,
+		Channel:  msg.Channel,
+		To:       msg.To,
+		Body:     msg.Body,
+		ReplyTo:  msg.ReplyTo,
+		Time:     msg.Time,
+		Revision: msg.Revision,
+	}
+}
+
+// changeRecord returns the history record of an edit or delete of the
+// message with the given ID.
+func changeRecord(id string, change messageChange, now time.Time) historyRecord {
+	rec := historyRecord{Kind: "edit", ID: id, From: change.from, Time: now}
+	if change.delete {
+		rec.Kind = "delete"
+	} else {
+		rec.Body = change.body
+		rec.Revision = change.revision
+	}
+	return rec
+}
+
+// readHistory reads the history file at path into a new messageStore, with
+// edits and deletes applied.
+func readHistory(path string) (*messageStore, error) {
+	store := &messageStore{}
+	if err := store.Replay(path); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Replay adds the messages, edits and deletes in the history file at path to
+// s, after those in the older file it was rotated to, if there is one. They
+// are not saved again, so it should be called before s.log is set.
+func (s *messageStore) Replay(path string) error {
+	if _, err := os.Stat(path + ".1"); err == nil {
+		if err := s.replayFile(path + ".1"); err != nil {
+			return err
+		}
+	}
+	return s.replayFile(path)
+}
+
+// replayFile adds the messages, edits and deletes in one history file to s.
+func (s *messageStore) replayFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxHistoryLine)
+	for line := 1; scanner.Scan(); line++ {
+		var rec historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A line cut short by a crash should not hide the rest.
+			logWarn("Skipping a line of the history", "path", path, "line", line, "err", err)
+			continue
+		}
+
+		switch rec.Kind {
+		case "message":
+			s.Add(chatMessage{
+				ID:       rec.ID,
+				From:     rec.From,
+				Sender:   rec.Sender,
+				Label:    rec.Sender,
+				Channel:  rec.Channel,
+				To:       rec.To,
+				Body:     rec.Body,
+				ReplyTo:  rec.ReplyTo,
+				Time:     rec.Time,
+				Revision: rec.Revision,
+				Edited:   rec.Revision > 0,
+			})
+		case "edit", "delete":
+			s.Change(rec.ID, messageChange{
+				from:     rec.From,
+				body:     rec.Body,
+				revision: rec.Revision,
+				delete:   rec.Kind == "delete",
+			})
+		default:
+			logWarn("Skipping a line of the history", "path", path, "line", line, "kind", rec.Kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read %s: %s", path, err)
+	}
+	return nil
+}
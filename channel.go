@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/jroimartin/gocui"
+)
+
+// channel is where the messages we type are sent: the room, or direct
+// messages with one client.
+type channel struct {
+	// name is roomChannel, or "@name" for direct messages with peer.
+	name string
+	peer NodeAddress
+}
+
+// activeChannel is the channel messages typed without a command are sent to.
+// It is only touched from the GUI goroutine.
+var activeChannel = channel{name: roomChannel}
+
+// openChannels lists the room followed by a channel for each client we have
+// exchanged direct messages with in msgs, in the order they first appear.
+// name gives the channel name of direct messages with a client.
+func openChannels(msgs []chatMessage, name func(NodeAddress) string) []channel {
+	channels := []channel{{name: roomChannel}}
+	seen := make(map[NodeAddress]bool)
+	for _, msg := range msgs {
+		if msg.To == "" {
+			continue
+		}
+		peer := msg.To
+		if peer == localAddress {
+			peer = msg.From
+		}
+		if peer == localAddress || seen[peer] {
+			continue
+		}
+		seen[peer] = true
+		channels = append(channels, channel{name: name(peer), peer: peer})
+	}
+	return channels
+}
+
+// nextChannelAfter returns the channel after current in channels, going back
+// to the first after the last. A channel which is no longer open is followed
+// by the first.
+func nextChannelAfter(channels []channel, current channel) channel {
+	for i, c := range channels {
+		if c.peer == current.peer {
+			return channels[(i+1)%len(channels)]
+		}
+	}
+	return channels[0]
+}
+
+// nextChannel switches to the next of the room and the open direct message
+// channels.
+func nextChannel(g *gocui.Gui, v *gocui.View) error {
+	channels := openChannels(chat.history.All(), chat.dmChannel)
+	return switchChannel(g, nextChannelAfter(channels, activeChannel))
+}
+
+// switchChannel makes c the channel typed messages are sent to.
+func switchChannel(g *gocui.Gui, c channel) error {
+	activeChannel = c
+	return drawStatusBar(g, currentClusterStatus())
+}
+
+// sendToActiveChannel sends text to the room or, in a direct message
+// channel, to the client it is with.
+func sendToActiveChannel(text string) error {
+	if activeChannel.peer == "" {
+		return chat.SendMessage(text)
+	}
+	name := chat.dmChannel(activeChannel.peer)[1:]
+	return chat.SendDirectMessage(activeChannel.peer, name, text)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestOpenChannels(t *testing.T) {
+	defer func(addr NodeAddress) { localAddress = addr }(localAddress)
+	localAddress = "192.168.0.101:8888"
+	bob := NodeAddress("192.168.0.11:9999")
+	carol := NodeAddress("192.168.0.12:9999")
+	msgs := []chatMessage{
+		{ID: "room-1--", From: carol},
+		{ID: "dm-1----", From: bob, To: localAddress},
+		{ID: "dm-2----", From: localAddress, To: carol},
+		{ID: "dm-3----", From: localAddress, To: bob},
+		{ID: "room-2--", From: localAddress},
+	}
+	name := func(addr NodeAddress) string { return "@" + string(addr) }
+
+	channels := openChannels(msgs, name)
+	room := channel{name: roomChannel}
+	withBob := channel{name: "@" + string(bob), peer: bob}
+	withCarol := channel{name: "@" + string(carol), peer: carol}
+	if expected := []channel{room, withBob, withCarol}; !reflect.DeepEqual(channels, expected) {
+		t.Fatalf("Expected %v but got %v", expected, channels)
+	}
+
+	var cases = []struct {
+		current  channel
+		expected channel
+	}{
+		{room, withBob},
+		{withBob, withCarol},
+		{withCarol, room},
+		{channel{name: "@dave", peer: "192.168.0.13:9999"}, room},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if next := nextChannelAfter(channels, c.current); next != c.expected {
+				t.Fatalf("Expected %v but got %v", c.expected, next)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/clockworksoul/smudge"
@@ -19,6 +21,12 @@ type NodeAddress string
 // https://godoc.org/github.com/clockworksoul/smudge#StatusListener
 type ClientList map[NodeAddress]ChatClient
 
+// clientsMu guards the ClientList. Smudge reports membership changes and
+// broadcasts from its own goroutines while the GUI draws the list, so every
+// access goes through it. The functions you implement, such as AddClient, are
+// called with it held and must not lock it themselves.
+var clientsMu sync.RWMutex
+
 // OnChange is the only method defined on the smudge.StatusListener. By
 // implementing this method on the ClientStatusListener struct, that struct will
 // satisfy the interface and we can register it with smudge.
@@ -27,15 +35,34 @@ type ClientList map[NodeAddress]ChatClient
 // internal list of the membership. We can use this internally maintained
 // membership list to display a friends list.
 func (cl ClientList) OnChange(node *smudge.Node, status smudge.NodeStatus) {
+	addr := NodeAddress(node.Address())
+	if status == smudge.StatusAlive && cl.ignoreHeartbeat(node, time.Now()) {
+		logDebug("Ignoring a heartbeat from a node which is leaving", "addr", addr)
+		return
+	}
+	clientsMu.Lock()
 	if status == smudge.StatusAlive {
-		printDebug("Adding a new node: %s", node.Address())
+		logDebug("Adding a node", "addr", node.Address())
 		cl.AddClient(node)
+		cl.markSeen(addr, time.Now())
+		if addr != localAddress {
+			systemEvents.Add(systemEvent{kind: eventJoin, addr: addr})
+		}
 	} else {
-		printDebug("Removing a node: " + node.Address())
+		logDebug("Removing a node", "addr", node.Address())
+		// A client which announced that it was leaving is already gone.
+		if c, ok := cl[addr]; ok && status == smudge.StatusDead && addr != localAddress {
+			systemEvents.Add(systemEvent{kind: eventTimeout, addr: addr, name: c.GetName()})
+		}
 		cl.RemoveClient(node)
 	}
+	clientsMu.Unlock()
 
+	if status == smudge.StatusAlive && addr != localAddress {
+		announcePresence(cl)
+	}
 	printClientList(cl)
+	printStatusBar()
 }
 
 // AddClient creates a ChatClient for the provided node and inserts it into the
@@ -69,7 +96,7 @@ func (cl ClientList) RemoveClient(node *smudge.Node) {
 // ClientList with the usernames provided. It is possible that a node may change
 // username, in which case the map should be updated.
 func (cl ClientList) AddUsernames(usernames map[NodeAddress]string) error {
-	printDebug("Received username list containing: %+v", usernames)
+	logDebug("Received a username list", "count", len(usernames))
 
 	// TODO: Implement this function
 	// loop over the provided map of usernames, updating our client list with
@@ -100,14 +127,17 @@ func (cl ClientList) getUsernameMap() map[NodeAddress]string {
 // BroadcastUsernames builds a map of the known usernames and broadcasts them
 // to the chat cluster.
 func (cl ClientList) BroadcastUsernames() error {
-	printDebug("Processing request to broadcast our known usernames...")
+	logDebug("Broadcasting our known usernames")
 
+	clientsMu.RLock()
 	usernames := cl.getUsernameMap()
+	clientsMu.RUnlock()
 	msg := message{
 		Type:      messageTypeUsernames,
 		Usernames: usernames,
+		Version:   clientVersion,
 	}
-	return smudge.BroadcastBytes(msg.Encode())
+	return broadcast(&msg)
 }
 
 // FillMissingInfo looks for any connected clients for which we do not already
@@ -116,11 +146,17 @@ func (cl ClientList) BroadcastUsernames() error {
 func (cl ClientList) FillMissingInfo() {
 	c := time.Tick(15 * time.Second)
 	for _ = range c {
-		printDebug("Checking for clients with a missing username...")
+		logDebug("Checking for clients with a missing username")
 
-		if addrMissing, ok := cl.GetMissingUsername(); ok {
+		clientsMu.RLock()
+		addrMissing, ok := cl.GetMissingUsername()
+		clientsMu.RUnlock()
+		if ok {
 			if err := cl.RequestUsernameList(addrMissing); err != nil {
-				printError("Error requesting missing usernames: %s", err)
+				usernameRequests.Inc("failed")
+				logError("Failed to request missing usernames", "err", err)
+			} else {
+				usernameRequests.Inc("sent")
 			}
 		}
 	}
@@ -142,13 +178,163 @@ func (cl ClientList) GetMissingUsername() (NodeAddress, bool) {
 // A broadcast is used because we have no way of directly connecting to this
 // node. Other nodes will just have to ignore this message.
 func (cl ClientList) RequestUsernameList(addrMissing NodeAddress) error {
-	printDebug("Sending username request to %s", addrMissing)
+	logDebug("Sending a username request", "to", addrMissing)
 	msg := message{
-		Type: messageTypeUsernameReq,
-		Body: string(addrMissing),
+		Type:    messageTypeUsernameReq,
+		Body:    string(addrMissing),
+		Version: clientVersion,
+	}
+
+	return broadcast(&msg)
+}
+
+// Sorted returns the addresses in the ClientList ordered by the name shown for
+// each client. Addresses break ties, so the order is stable between redraws
+// of the Clients pane even when two clients share a name.
+func (cl ClientList) Sorted() []NodeAddress {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	return cl.sorted()
+}
+
+// sorted is Sorted, called with clientsMu held.
+func (cl ClientList) sorted() []NodeAddress {
+	addrs := make([]NodeAddress, 0, len(cl))
+	for addr := range cl {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		a, b := cl[addrs[i]], cl[addrs[j]]
+		nameA, nameB := a.GetName(), b.GetName()
+		if nameA != nameB {
+			return nameA < nameB
+		}
+		return addrs[i] < addrs[j]
+	})
+	return addrs
+}
+
+// Lookup finds the client whose address or username matches name.
+func (cl ClientList) Lookup(name string) (NodeAddress, bool) {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+
+	if _, ok := cl[NodeAddress(name)]; ok {
+		return NodeAddress(name), true
+	}
+
+	for _, addr := range cl.sorted() {
+		if cl[addr].username == name {
+			return addr, true
+		}
+	}
+	return NodeAddress(""), false
+}
+
+// get returns the client at addr.
+func (cl ClientList) get(addr NodeAddress) (ChatClient, bool) {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	c, ok := cl[addr]
+	return c, ok
+}
+
+// snapshot returns a copy of the list which can be read without holding
+// clientsMu.
+func (cl ClientList) snapshot() ClientList {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+
+	copied := make(ClientList, len(cl))
+	for addr, c := range cl {
+		copied[addr] = c
 	}
+	return copied
+}
 
-	return smudge.BroadcastBytes(msg.Encode())
+// remove deletes the client at addr, returning it if it was listed.
+func (cl ClientList) remove(addr NodeAddress) (ChatClient, bool) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	c, ok := cl[addr]
+	delete(cl, addr)
+	return c, ok
+}
+
+// markSeen records the first time a client was reported alive. Later calls
+// for the same client leave the original time in place. It is called with
+// clientsMu held.
+func (cl ClientList) markSeen(addr NodeAddress, now time.Time) {
+	c, ok := cl[addr]
+	if !ok || !c.firstSeen.IsZero() {
+		return
+	}
+
+	c.firstSeen = now
+	cl[addr] = c
+}
+
+// touch records that a broadcast arrived from addr. The version reported in
+// the broadcast is remembered, and chat messages also reset the idle time
+// shown in the Clients pane.
+func (cl ClientList) touch(addr NodeAddress, version string, chat bool, now time.Time) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	c, ok := cl[addr]
+	if !ok {
+		return
+	}
+
+	if version != "" {
+		c.version = version
+	}
+	if chat {
+		c.lastActive = now
+	}
+	cl[addr] = c
+}
+
+// sawKey records that addr sealed a message with the cluster key keyID, and
+// reports whether it switched to a key it has not used before. A client
+// going back to an earlier key, as happens while keys are rotated, is only
+// reported the first time.
+func (cl ClientList) sawKey(addr NodeAddress, keyID string) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	c, ok := cl[addr]
+	if !ok || keyID == "" || keyID == c.keyID {
+		return false
+	}
+
+	if c.keyIDs == nil {
+		c.keyIDs = make(map[string]bool)
+	}
+	changed := c.keyID != "" && !c.keyIDs[keyID]
+	if c.keyID != "" {
+		c.keyIDs[c.keyID] = true
+	}
+	c.keyIDs[keyID] = true
+	c.keyID = keyID
+	cl[addr] = c
+	return changed
+}
+
+// usernames returns the names we currently know for the clients in the given
+// address->username map, other than ourselves, so renames can be spotted.
+func (cl ClientList) usernames(update map[NodeAddress]string) map[NodeAddress]string {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+
+	names := make(map[NodeAddress]string)
+	for addr := range update {
+		if c, ok := cl[addr]; ok && addr != localAddress {
+			names[addr] = c.username
+		}
+	}
+	return names
 }
 
 // ChatClient is a structure containing a reference to the smudge.Node
@@ -159,6 +345,26 @@ type ChatClient struct {
 
 	// username is a value we will query the client for when first discovered
 	username string
+
+	// version is the client version reported in the client's broadcasts, if
+	// it has sent us any.
+	version string
+
+	// firstSeen is when smudge first told us this client was alive.
+	firstSeen time.Time
+
+	// lastActive is when we last received a chat message from this client.
+	lastActive time.Time
+
+	// presence is what the client told us about being away or busy.
+	presence presence
+
+	// keyID identifies the cluster key the client last sealed a message
+	// with, when there are cluster keys.
+	keyID string
+
+	// keyIDs holds every cluster key the client has sealed a message with.
+	keyIDs map[string]bool
 }
 
 // GetName returns the username of the connected client if the username is
@@ -167,3 +373,61 @@ func (c *ChatClient) GetName() string {
 	// TODO: Implement this function
 	return ""
 }
+
+const (
+	// suspectHeartbeats is the number of heartbeats a node may go without
+	// answering before it is shown as suspect, even though smudge has not yet
+	// declared it dead.
+	suspectHeartbeats = 4
+
+	// awayAfter is how long a client may go without chatting before it is
+	// marked as away in the Clients pane.
+	awayAfter = 10 * time.Minute
+)
+
+// isLocal reports whether this client is ourselves.
+func (c *ChatClient) isLocal() bool {
+	return c.node != nil && NodeAddress(c.node.Address()) == localAddress
+}
+
+// Status describes how healthy smudge believes the client to be: "online",
+// "suspect" when it has stopped answering pings, or "dead".
+func (c *ChatClient) Status() string {
+	if c.isLocal() {
+		return "online"
+	}
+	if c.node == nil {
+		return "unknown"
+	}
+
+	switch c.node.Status() {
+	case smudge.StatusAlive:
+		if c.node.PingMillis() == smudge.PingTimedOut ||
+			c.node.Age() > suspectHeartbeats*heartbeatMillis {
+			return "suspect"
+		}
+		return "online"
+	case smudge.StatusDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+// Idle returns how long it has been since the client last chatted, or since
+// it joined if it has not chatted yet.
+func (c *ChatClient) Idle(now time.Time) time.Duration {
+	last := c.lastActive
+	if last.IsZero() {
+		last = c.firstSeen
+	}
+	if last.IsZero() {
+		return 0
+	}
+	return now.Sub(last)
+}
+
+// IsAway reports whether the client has been idle for longer than awayAfter.
+func (c *ChatClient) IsAway(now time.Time) bool {
+	return !c.isLocal() && c.Idle(now) >= awayAfter
+}
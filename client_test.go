@@ -6,6 +6,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/clockworksoul/smudge"
 )
@@ -383,3 +384,150 @@ func TestAddUsernames(t *testing.T) {
 		})
 	}
 }
+
+func TestSorted(t *testing.T) {
+	testNode, err := smudge.CreateNodeByIP(net.ParseIP("127.0.0.1"), 9999)
+	CheckNoError(t, err)
+	testNode2, err := smudge.CreateNodeByIP(net.ParseIP("127.0.0.2"), 9998)
+	CheckNoError(t, err)
+	testNode3, err := smudge.CreateNodeByIP(net.ParseIP("127.0.0.3"), 9997)
+	CheckNoError(t, err)
+
+	var cases = []struct {
+		clientList     *ClientList
+		expectedResult []NodeAddress
+	}{
+		{ // Clients without usernames are sorted by address
+			clientList: &ClientList{
+				NodeAddress("127.0.0.3:9997"): ChatClient{node: testNode3},
+				NodeAddress("127.0.0.1:9999"): ChatClient{node: testNode},
+				NodeAddress("127.0.0.2:9998"): ChatClient{node: testNode2},
+			},
+			expectedResult: []NodeAddress{
+				NodeAddress("127.0.0.1:9999"),
+				NodeAddress("127.0.0.2:9998"),
+				NodeAddress("127.0.0.3:9997"),
+			},
+		},
+		{ // Clients sharing a name are sorted by address
+			clientList: &ClientList{
+				NodeAddress("127.0.0.2:9998"): ChatClient{username: "same", node: testNode2},
+				NodeAddress("127.0.0.1:9999"): ChatClient{username: "same", node: testNode},
+			},
+			expectedResult: []NodeAddress{
+				NodeAddress("127.0.0.1:9999"),
+				NodeAddress("127.0.0.2:9998"),
+			},
+		},
+		{ // Test that it still works if there are no clients connected
+			clientList:     &ClientList{},
+			expectedResult: []NodeAddress{},
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			result := c.clientList.Sorted()
+			if !reflect.DeepEqual(result, c.expectedResult) {
+				t.Fatalf("Expected %v but got %v", c.expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	testNode, err := smudge.CreateNodeByIP(net.ParseIP("127.0.0.1"), 9999)
+	CheckNoError(t, err)
+
+	clientList := ClientList{
+		NodeAddress("127.0.0.1:9999"): ChatClient{username: "tester", node: testNode},
+	}
+
+	var cases = []struct {
+		name               string
+		expectedResultAddr NodeAddress
+		expectedResultBool bool
+	}{
+		{"tester", NodeAddress("127.0.0.1:9999"), true},
+		{"127.0.0.1:9999", NodeAddress("127.0.0.1:9999"), true},
+		{"nobody", NodeAddress(""), false},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			resultAddr, resultBool := clientList.Lookup(c.name)
+			if resultAddr != c.expectedResultAddr {
+				t.Fatalf("Expected %v but got %v", c.expectedResultAddr, resultAddr)
+			}
+			if resultBool != c.expectedResultBool {
+				t.Fatalf("Expected %v but got %v", c.expectedResultBool, resultBool)
+			}
+		})
+	}
+}
+
+func TestIdle(t *testing.T) {
+	now := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var cases = []struct {
+		client         ChatClient
+		expectedIdle   time.Duration
+		expectedIsAway bool
+	}{
+		{ // A client we know nothing about is not idle
+			client:         ChatClient{},
+			expectedIdle:   0,
+			expectedIsAway: false,
+		},
+		{ // A client that never chatted is idle since it joined
+			client:         ChatClient{firstSeen: now.Add(-time.Minute)},
+			expectedIdle:   time.Minute,
+			expectedIsAway: false,
+		},
+		{ // A client that chatted is idle since its last message
+			client: ChatClient{
+				firstSeen:  now.Add(-time.Hour),
+				lastActive: now.Add(-awayAfter),
+			},
+			expectedIdle:   awayAfter,
+			expectedIsAway: true,
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if idle := c.client.Idle(now); idle != c.expectedIdle {
+				t.Fatalf("Expected %v but got %v", c.expectedIdle, idle)
+			}
+			if away := c.client.IsAway(now); away != c.expectedIsAway {
+				t.Fatalf("Expected %v but got %v", c.expectedIsAway, away)
+			}
+		})
+	}
+}
+
+func TestClientListConcurrentAccess(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	cl := ClientList{bob: ChatClient{}}
+
+	// Run with -race: smudge writes the list while the GUI reads it.
+	done := make(chan bool)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			cl.touch(bob, clientVersion, true, time.Now())
+			cl.setPresence(bob, presence{State: "away", Version: i})
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		snapshot := cl.snapshot()
+		_ = snapshot[bob].presence
+		cl.get(bob)
+		cl.Lookup("bob")
+	}
+	<-done
+
+	if c, _ := cl.get(bob); c.presence.Version != 100 || c.version != clientVersion {
+		t.Fatalf("Expected every update to be kept but got %#v", c)
+	}
+}
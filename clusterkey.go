@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealVersion is the first byte of every sealed payload, so the format can be
+// changed later.
+const sealVersion byte = 1
+
+// keyIDLength is how many bytes of a key's fingerprint are sent with each
+// payload, so the receiver knows which key to open it with.
+const keyIDLength = 4
+
+// keyDerivationLabel separates the cluster key from any other use of the same
+// secret.
+const keyDerivationLabel = "beginning-go cluster key v1"
+
+// errUnknownClusterKey is returned for a payload sealed with a key we were not
+// given.
+var errUnknownClusterKey = errors.New("sealed with an unknown cluster key")
+
+// clusterKey is the AEAD derived from one -cluster-key secret.
+type clusterKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// clusterKeys holds the keys given with -cluster-key. The first one seals the
+// payloads we send, and any of them may open a payload we receive. When it is
+// empty, payloads are sent and accepted in the clear.
+var clusterKeys []clusterKey
+
+// clusterKeyFlag collects the -cluster-key flag, which may be given more than
+// once.
+type clusterKeyFlag []string
+
+func (f *clusterKeyFlag) String() string {
+	// Never print the secrets, for example in the usage message.
+	return strings.Repeat("*", len(*f))
+}
+
+func (f *clusterKeyFlag) Set(secret string) error {
+	if secret == "" {
+		return fmt.Errorf("the cluster key is empty")
+	}
+	*f = append(*f, secret)
+	return nil
+}
+
+// deriveClusterKey turns a secret shared by everyone in a chat into an
+// AES-256-GCM key. The secret is not stretched, so it should be long and
+// random rather than a word.
+func deriveClusterKey(secret string) (clusterKey, error) {
+	mac := hmac.New(sha256.New, []byte(keyDerivationLabel))
+	mac.Write([]byte(secret))
+	key := mac.Sum(nil)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return clusterKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return clusterKey{}, err
+	}
+
+	fingerprint := sha256.Sum256(key)
+	return clusterKey{id: fingerprint[:keyIDLength], aead: aead}, nil
+}
+
+// setClusterKeys derives clusterKeys from the given secrets.
+func setClusterKeys(secrets []string) error {
+	keys := make([]clusterKey, 0, len(secrets))
+	for _, secret := range secrets {
+		key, err := deriveClusterKey(secret)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	clusterKeys = keys
+	return nil
+}
+
+// seal encrypts and authenticates an encoded message with the first cluster
+// key. The result is the version byte, the key ID, the nonce and the
+// ciphertext, with the version and key ID authenticated too.
+func seal(data []byte) ([]byte, error) {
+	if len(clusterKeys) == 0 {
+		return data, nil
+	}
+	key := clusterKeys[0]
+
+	header := append([]byte{sealVersion}, key.id...)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// The header is authenticated as well, so it must not share memory with
+	// the output.
+	out := make([]byte, 0, len(header)+len(nonce)+len(data)+key.aead.Overhead())
+	out = append(append(out, header...), nonce...)
+	return key.aead.Seal(out, nonce, data, header), nil
+}
+
+// unseal checks and decrypts a payload made by seal, using whichever of the
+// cluster keys it was sealed with. It also returns the ID of that key in hex,
+// which is empty when there are no cluster keys.
+func unseal(data []byte) ([]byte, string, error) {
+	if len(clusterKeys) == 0 {
+		return data, "", nil
+	}
+
+	headerLength := 1 + keyIDLength
+	if len(data) < headerLength || data[0] != sealVersion {
+		return nil, "", fmt.Errorf("not sealed with a cluster key")
+	}
+	header, id := data[:headerLength], data[1:headerLength]
+
+	for _, key := range clusterKeys {
+		if !bytes.Equal(key.id, id) {
+			continue
+		}
+		rest := data[headerLength:]
+		if len(rest) < key.aead.NonceSize() {
+			return nil, "", fmt.Errorf("sealed payload is too short")
+		}
+		nonce, ciphertext := rest[:key.aead.NonceSize()], rest[key.aead.NonceSize():]
+		plain, err := key.aead.Open(nil, nonce, ciphertext, header)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed authentication: %s", err)
+		}
+		return plain, hex.EncodeToString(key.id), nil
+	}
+	return nil, "", errUnknownClusterKey
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSealUnseal(t *testing.T) {
+	defer setClusterKeys(nil)
+	payload := []byte("compressed json")
+
+	var cases = []struct {
+		sendKeys    []string
+		receiveKeys []string
+		tamper      bool
+		expectErr   bool
+	}{
+		{ // Without keys payloads pass through
+		},
+		{ // The same key opens the payload
+			sendKeys:    []string{"team-a"},
+			receiveKeys: []string{"team-a"},
+		},
+		{ // Another team's key does not
+			sendKeys:    []string{"team-a"},
+			receiveKeys: []string{"team-b"},
+			expectErr:   true,
+		},
+		{ // A client which has not rotated yet is still understood
+			sendKeys:    []string{"old"},
+			receiveKeys: []string{"new", "old"},
+		},
+		{ // And so is one which already has
+			sendKeys:    []string{"new", "old"},
+			receiveKeys: []string{"old", "new"},
+		},
+		{ // Payloads sent in the clear are rejected
+			receiveKeys: []string{"team-a"},
+			expectErr:   true,
+		},
+		{ // So are modified ones
+			sendKeys:    []string{"team-a"},
+			receiveKeys: []string{"team-a"},
+			tamper:      true,
+			expectErr:   true,
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			CheckNoError(t, setClusterKeys(c.sendKeys))
+			sealed, err := seal(payload)
+			CheckNoError(t, err)
+			if len(c.sendKeys) > 0 && bytes.Contains(sealed, payload) {
+				t.Fatalf("The sealed payload contains the plaintext")
+			}
+			if c.tamper {
+				sealed[len(sealed)-1] ^= 1
+			}
+
+			CheckNoError(t, setClusterKeys(c.receiveKeys))
+			opened, _, err := unseal(sealed)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("Expected an error but got %q", opened)
+				}
+				return
+			}
+			CheckNoError(t, err)
+			if !bytes.Equal(opened, payload) {
+				t.Fatalf("Expected %q but got %q", payload, opened)
+			}
+		})
+	}
+}
+
+func TestReceiveRejectsUnsealed(t *testing.T) {
+	defer setClusterKeys(nil)
+	CheckNoError(t, setClusterKeys([]string{"team-a"}))
+
+	sender := NodeAddress("192.168.0.79:9999")
+	m := Messenger{clients: ClientList{}}
+	chat := message{Type: messageTypeChat, Body: "hi"}
+	m.receive(sender, chat.Encode())
+	if count := rejectedMessages.Get(string(sender)); count != 1 {
+		t.Fatalf("Expected 1 rejected message but got %d", count)
+	}
+
+	sealed, err := seal(chat.Encode())
+	CheckNoError(t, err)
+	m.receive(sender, sealed)
+	if count := rejectedMessages.Get(string(sender)); count != 1 {
+		t.Fatalf("Expected the sealed message to be accepted")
+	}
+}
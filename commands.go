@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// command handles a line typed into the "enter-text" view which starts with a
+// slash. args is everything after the command name, with surrounding spaces
+// removed.
+type command func(args string) error
+
+// commands maps command names (without the leading slash) to their handlers.
+// It is filled in by init because some handlers, such as /help, refer back to
+// the map itself.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"away":     cmdAway,
+		"back":     cmdBack,
+		"busy":     cmdBusy,
+		"delete":   cmdDelete,
+		"edit":     cmdEdit,
+		"export":   cmdExport,
+		"help":     cmdHelp,
+		"ignore":   cmdIgnore,
+		"ignored":  cmdIgnored,
+		"keys":     cmdKeys,
+		"msg":      cmdMsg,
+		"netinfo":  cmdNetinfo,
+		"open":     cmdOpen,
+		"quit":     cmdQuit,
+		"react":    cmdReact,
+		"reply":    cmdReply,
+		"save":     cmdSave,
+		"search":   cmdSearch,
+		"send":     cmdSend,
+		"thread":   cmdThread,
+		"unignore": cmdUnignore,
+		"whois":    cmdWhois,
+	}
+}
+
+// splitFirst separates the first word of s from the rest of it.
+func splitFirst(s string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+// splitCommand separates a line such as "/msg alice hi" into the command name
+// "msg" and its arguments "alice hi".
+func splitCommand(line string) (string, string) {
+	name, args := splitFirst(strings.TrimPrefix(strings.TrimSpace(line), "/"))
+	return strings.ToLower(name), args
+}
+
+// handleInput decides whether a line typed by the user is a command or a chat
+// message. Commands report their problems in the messages view instead of
+// returning them, since an error returned to gocui ends the main loop. The
+// exception is errSlowDown, so the caller can give the text back to the user.
+func handleInput(text string) error {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return sendToActiveChannel(text)
+	}
+
+	name, args := splitCommand(text)
+	cmd, ok := commands[name]
+	if !ok {
+		printNotice(fmt.Sprintf("Unknown command /%s, try /help", name))
+		return nil
+	}
+
+	if err := cmd(args); err == errSlowDown {
+		return err
+	} else if err != nil {
+		printNotice(fmt.Sprintf("/%s: %s", name, err))
+	}
+	return nil
+}
+
+// cmdHelp lists the available commands.
+func cmdHelp(args string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, "/"+name)
+	}
+	sort.Strings(names)
+
+	printNotice("Commands: " + strings.Join(names, " "))
+	return nil
+}
+
+// cmdMsg sends a direct message: /msg <user> <text>
+func cmdMsg(args string) error {
+	name, text := splitFirst(args)
+	if name == "" || text == "" {
+		return fmt.Errorf("usage: /msg <user> <text>")
+	}
+
+	addr, ok := clients.Lookup(name)
+	if !ok {
+		return fmt.Errorf("no client named %q", name)
+	}
+
+	return chat.SendDirectMessage(addr, name, text)
+}
+
+// cmdKeys shows the key bindings in effect.
+func cmdKeys(args string) error {
+	gui.Update(showKeys)
+	return nil
+}
+
+// cmdOpen prints the Nth most recent link, so it can be copied from the
+// messages view: /open [N]
+func cmdOpen(args string) error {
+	n := 1
+	if args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n < 1 {
+			return fmt.Errorf("usage: /open [N], where N counts back from the latest link")
+		}
+	}
+	if n > len(recentLinks) {
+		return fmt.Errorf("only %d links have been seen", len(recentLinks))
+	}
+
+	printNotice(recentLinks[len(recentLinks)-n])
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	var cases = []struct {
+		line         string
+		expectedName string
+		expectedArgs string
+	}{
+		{"/help", "help", ""},
+		{"/MSG alice  hello there ", "msg", "alice  hello there"},
+		{"  /msg   alice hi", "msg", "alice hi"},
+		{"/", "", ""},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			name, args := splitCommand(c.line)
+			if name != c.expectedName {
+				t.Fatalf("Expected %q but got %q", c.expectedName, name)
+			}
+			if args != c.expectedArgs {
+				t.Fatalf("Expected %q but got %q", c.expectedArgs, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// config holds the settings read from the JSON configuration file. Fields
+// left out of the file keep their default values.
+type config struct {
+	// Keys maps action names, such as "quit" or "scroll-up", to the key which
+	// triggers them, such as "ctrl-c" or "pgup".
+	Keys map[string]string `json:"keys"`
+
+	// Theme chooses the colors of the UI.
+	Theme themeConfig `json:"theme"`
+
+	// RateLimits limits how fast chat messages can be sent and received.
+	RateLimits rateLimits `json:"rate-limits"`
+
+	// Privacy turns off features which tell other clients what we are doing.
+	Privacy privacyConfig `json:"privacy"`
+
+	// History controls the chat history kept in the data directory.
+	History historyConfig `json:"history"`
+
+	// AutoAwayMinutes is how long without typing before we are marked away.
+	// Zero, the default, never marks us away.
+	AutoAwayMinutes int `json:"auto-away-minutes"`
+
+	// HideSystemNotices stops the lines in the messages view saying who
+	// joined, left, timed out, changed name or switched cluster key.
+	HideSystemNotices bool `json:"hide-system-notices"`
+}
+
+// privacyConfig is the privacy section of the configuration file.
+type privacyConfig struct {
+	// NoTyping stops us telling other clients when we are typing.
+	NoTyping bool `json:"no-typing"`
+
+	// NoReadReceipts stops telling the sender of a direct message when we
+	// have seen it. Delivery is still acknowledged.
+	NoReadReceipts bool `json:"no-read-receipts"`
+}
+
+// themeConfig is the theme as written in the configuration file. Colors are
+// names such as "red" or "default", optionally preceded by "bold",
+// "underline" or "reverse", for example "bold yellow".
+type themeConfig struct {
+	Frame         string `json:"frame"`
+	FrameSelected string `json:"frame-selected"`
+	SelectionFg   string `json:"selection-fg"`
+	SelectionBg   string `json:"selection-bg"`
+	Timestamp     string `json:"timestamp"`
+	Username      string `json:"username"`
+	Mention       string `json:"mention"`
+	Code          string `json:"code"`
+	Quote         string `json:"quote"`
+	Link          string `json:"link"`
+	Ignored       string `json:"ignored"`
+	System        string `json:"system"`
+
+	// Monochrome drops all colors, keeping only bold and reverse text.
+	Monochrome bool `json:"monochrome"`
+}
+
+// theme is a themeConfig with its colors parsed into gocui attributes.
+type theme struct {
+	frame, frameSelected     gocui.Attribute
+	selectionFg, selectionBg gocui.Attribute
+	timestamp, username      gocui.Attribute
+	mention                  gocui.Attribute
+	code, quote, link        gocui.Attribute
+	ignored, system          gocui.Attribute
+	monochrome               bool
+}
+
+// defaultTheme is used for any color the configuration file does not set.
+var defaultTheme = theme{
+	frame:         gocui.ColorDefault,
+	frameSelected: gocui.ColorGreen,
+	selectionFg:   gocui.ColorBlack,
+	selectionBg:   gocui.ColorGreen,
+	timestamp:     gocui.ColorBlue,
+	username:      gocui.ColorCyan,
+	mention:       gocui.ColorYellow | gocui.AttrBold,
+	code:          gocui.ColorGreen,
+	quote:         gocui.ColorMagenta,
+	link:          gocui.ColorBlue | gocui.AttrUnderline,
+
+	// Bold black is shown as dark gray by most terminals.
+	ignored: gocui.ColorBlack | gocui.AttrBold,
+	system:  gocui.ColorBlack | gocui.AttrBold,
+}
+
+// defaultConfigPath is where the configuration file is looked for when the
+// -config flag is not given. An empty string means there is no default.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "beginning-go", "config.json")
+}
+
+// defaultDataDir is where files such as the ignore list are kept when the
+// -data-dir flag is not given: next to the configuration file.
+func defaultDataDir() string {
+	path := defaultConfigPath()
+	if path == "" {
+		return ""
+	}
+	return filepath.Dir(path)
+}
+
+// loadConfig reads the configuration file at path. A missing file is not an
+// error unless required is set, in which case the user asked for that file
+// explicitly.
+func loadConfig(path string, required bool) (config, error) {
+	var cfg config
+	if path == "" {
+		return cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("Failed to parse %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// colorNames maps the color names accepted in the theme to gocui colors.
+var colorNames = map[string]gocui.Attribute{
+	"default": gocui.ColorDefault,
+	"black":   gocui.ColorBlack,
+	"red":     gocui.ColorRed,
+	"green":   gocui.ColorGreen,
+	"yellow":  gocui.ColorYellow,
+	"blue":    gocui.ColorBlue,
+	"magenta": gocui.ColorMagenta,
+	"cyan":    gocui.ColorCyan,
+	"white":   gocui.ColorWhite,
+}
+
+// styleNames maps the text styles accepted in the theme to gocui attributes.
+var styleNames = map[string]gocui.Attribute{
+	"bold":      gocui.AttrBold,
+	"underline": gocui.AttrUnderline,
+	"reverse":   gocui.AttrReverse,
+}
+
+// parseColor parses a theme color such as "bold yellow".
+func parseColor(s string) (gocui.Attribute, error) {
+	var attr gocui.Attribute
+	colors := 0
+	for _, word := range strings.Fields(strings.ToLower(s)) {
+		if style, ok := styleNames[word]; ok {
+			attr |= style
+		} else if color, ok := colorNames[word]; ok {
+			attr |= color
+			colors++
+		} else {
+			return 0, fmt.Errorf("unknown color %q", word)
+		}
+	}
+	if colors > 1 {
+		return 0, fmt.Errorf("%q names more than one color", s)
+	}
+	return attr, nil
+}
+
+// resolveTheme applies the colors set in tc on top of defaultTheme. Colors
+// which cannot be parsed keep their default, and are described in problems.
+func resolveTheme(tc themeConfig) (theme, []string) {
+	t := defaultTheme
+	var problems []string
+
+	fields := []struct {
+		name  string
+		value string
+		attr  *gocui.Attribute
+	}{
+		{"frame", tc.Frame, &t.frame},
+		{"frame-selected", tc.FrameSelected, &t.frameSelected},
+		{"selection-fg", tc.SelectionFg, &t.selectionFg},
+		{"selection-bg", tc.SelectionBg, &t.selectionBg},
+		{"timestamp", tc.Timestamp, &t.timestamp},
+		{"username", tc.Username, &t.username},
+		{"mention", tc.Mention, &t.mention},
+		{"code", tc.Code, &t.code},
+		{"quote", tc.Quote, &t.quote},
+		{"link", tc.Link, &t.link},
+		{"ignored", tc.Ignored, &t.ignored},
+		{"system", tc.System, &t.system},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		attr, err := parseColor(f.value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("theme %s: %s", f.name, err))
+			continue
+		}
+		*f.attr = attr
+	}
+
+	if tc.Monochrome {
+		t = theme{
+			frame:         gocui.ColorDefault,
+			frameSelected: gocui.ColorDefault | gocui.AttrBold,
+			selectionFg:   gocui.ColorDefault | gocui.AttrReverse,
+			selectionBg:   gocui.ColorDefault,
+			timestamp:     gocui.ColorDefault,
+			username:      gocui.ColorDefault | gocui.AttrBold,
+			mention:       gocui.ColorDefault | gocui.AttrReverse,
+			code:          gocui.ColorDefault | gocui.AttrReverse,
+			quote:         gocui.ColorDefault,
+			link:          gocui.ColorDefault | gocui.AttrUnderline,
+			ignored:       gocui.ColorDefault,
+			system:        gocui.ColorDefault,
+			monochrome:    true,
+		}
+	}
+	return t, problems
+}
+
+// keyAction is something the user can do by pressing a key. Actions without
+// a name cannot be rebound in the configuration file.
+type keyAction struct {
+	name        string
+	description string
+	view        string
+	defaultKey  string
+	handler     func(*gocui.Gui, *gocui.View) error
+}
+
+// keyBinding is a keyAction together with the key that triggers it.
+type keyBinding struct {
+	keyAction
+	spec string
+	key  interface{}
+	mod  gocui.Modifier
+}
+
+// keyNames maps the names of special keys accepted in the configuration file
+// to gocui keys.
+var keyNames = map[string]gocui.Key{
+	"enter":     gocui.KeyEnter,
+	"tab":       gocui.KeyTab,
+	"esc":       gocui.KeyEsc,
+	"space":     gocui.KeySpace,
+	"backspace": gocui.KeyBackspace2,
+	"delete":    gocui.KeyDelete,
+	"insert":    gocui.KeyInsert,
+	"home":      gocui.KeyHome,
+	"end":       gocui.KeyEnd,
+	"pgup":      gocui.KeyPgup,
+	"pgdn":      gocui.KeyPgdn,
+	"up":        gocui.KeyArrowUp,
+	"down":      gocui.KeyArrowDown,
+	"left":      gocui.KeyArrowLeft,
+	"right":     gocui.KeyArrowRight,
+	"f1":        gocui.KeyF1,
+	"f2":        gocui.KeyF2,
+	"f3":        gocui.KeyF3,
+	"f4":        gocui.KeyF4,
+	"f5":        gocui.KeyF5,
+	"f6":        gocui.KeyF6,
+	"f7":        gocui.KeyF7,
+	"f8":        gocui.KeyF8,
+	"f9":        gocui.KeyF9,
+	"f10":       gocui.KeyF10,
+	"f11":       gocui.KeyF11,
+	"f12":       gocui.KeyF12,
+
+	"mouse-left":   gocui.MouseLeft,
+	"mouse-middle": gocui.MouseMiddle,
+	"mouse-right":  gocui.MouseRight,
+	"wheel-up":     gocui.MouseWheelUp,
+	"wheel-down":   gocui.MouseWheelDown,
+}
+
+// parseKey parses a key such as "ctrl-l", "pgup", "alt-n" or "q" into the
+// values expected by gocui.Gui.SetKeybinding.
+func parseKey(spec string) (interface{}, gocui.Modifier, error) {
+	s := strings.TrimSpace(spec)
+	mod := gocui.ModNone
+	if strings.HasPrefix(strings.ToLower(s), "alt-") {
+		mod = gocui.ModAlt
+		s = s[len("alt-"):]
+	}
+
+	lower := strings.ToLower(s)
+	if key, ok := keyNames[lower]; ok {
+		return key, mod, nil
+	}
+	if strings.HasPrefix(lower, "ctrl-") {
+		letter := strings.TrimPrefix(lower, "ctrl-")
+		if len(letter) == 1 && letter[0] >= 'a' && letter[0] <= 'z' {
+			// Ctrl-A through Ctrl-Z are the key codes 1 through 26.
+			return gocui.Key(letter[0] - 'a' + 1), mod, nil
+		}
+	}
+	if r := []rune(s); len(r) == 1 {
+		return r[0], mod, nil
+	}
+	return nil, mod, fmt.Errorf("unknown key %q", spec)
+}
+
+// resolveBindings works out the key for each action, using overrides from the
+// configuration file where they are given. Bindings that name an unknown
+// action or key, or that clash with another binding, are left out and
+// described in problems. An action whose override is dropped keeps its
+// default key unless that is taken too.
+func resolveBindings(actions []keyAction, overrides map[string]string) ([]keyBinding, []string) {
+	var problems []string
+
+	known := make(map[string]bool)
+	for _, a := range actions {
+		if a.name != "" {
+			known[a.name] = true
+		}
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !known[name] {
+			problems = append(problems, fmt.Sprintf("unknown action %q", name))
+		}
+	}
+
+	var bindings []keyBinding
+	add := func(a keyAction, spec string) error {
+		key, mod, err := parseKey(spec)
+		if err != nil {
+			return err
+		}
+		_, typed := key.(rune)
+		if (typed || key == gocui.KeySpace) && mod == gocui.ModNone && a.view == "" {
+			return fmt.Errorf("%q would stop it being typed", spec)
+		}
+		for _, b := range bindings {
+			sameView := a.view == "" || b.view == "" || a.view == b.view
+			if sameView && b.key == key && b.mod == mod {
+				return fmt.Errorf("%q is already bound to %s", spec, b.describe())
+			}
+		}
+
+		bindings = append(bindings, keyBinding{keyAction: a, spec: spec, key: key, mod: mod})
+		return nil
+	}
+
+	// Bind the fixed actions first, then the keys the user chose, so that a
+	// default key never takes precedence over a chosen one.
+	var deferred []keyAction
+	for _, a := range actions {
+		if a.name == "" {
+			if err := add(a, a.defaultKey); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", a.describe(), err))
+			}
+		}
+	}
+	for _, a := range actions {
+		if a.name == "" {
+			continue
+		}
+		spec, ok := overrides[a.name]
+		if !ok {
+			deferred = append(deferred, a)
+			continue
+		}
+		if err := add(a, spec); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", a.name, err))
+			deferred = append(deferred, a)
+		}
+	}
+	for _, a := range deferred {
+		if err := add(a, a.defaultKey); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", a.name, err))
+		}
+	}
+
+	// Keep the bindings in the order the actions were given, for /keys.
+	order := make(map[string]int)
+	for i, a := range actions {
+		order[a.describe()] = i
+	}
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return order[bindings[i].describe()] < order[bindings[j].describe()]
+	})
+	return bindings, problems
+}
+
+// describe names the action for messages to the user.
+func (a keyAction) describe() string {
+	if a.name != "" {
+		return a.name
+	}
+	return a.description
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jroimartin/gocui"
+)
+
+func TestParseKey(t *testing.T) {
+	var cases = []struct {
+		spec        string
+		expectedKey interface{}
+		expectedMod gocui.Modifier
+		expectError bool
+	}{
+		{spec: "ctrl-c", expectedKey: gocui.KeyCtrlC, expectedMod: gocui.ModNone},
+		{spec: "Ctrl-L", expectedKey: gocui.KeyCtrlL, expectedMod: gocui.ModNone},
+		{spec: "pgup", expectedKey: gocui.KeyPgup, expectedMod: gocui.ModNone},
+		{spec: "alt-n", expectedKey: 'n', expectedMod: gocui.ModAlt},
+		{spec: "Q", expectedKey: 'Q', expectedMod: gocui.ModNone},
+		{spec: "ctrl-", expectError: true},
+		{spec: "hyper-x", expectError: true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			key, mod, err := parseKey(c.spec)
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error for %q", c.spec)
+				}
+				return
+			}
+			CheckNoError(t, err)
+			if key != c.expectedKey || mod != c.expectedMod {
+				t.Fatalf("Expected %v %v but got %v %v", c.expectedKey, c.expectedMod, key, mod)
+			}
+		})
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	var cases = []struct {
+		color          string
+		expectedResult gocui.Attribute
+		expectError    bool
+	}{
+		{color: "red", expectedResult: gocui.ColorRed},
+		{color: "bold Yellow", expectedResult: gocui.ColorYellow | gocui.AttrBold},
+		{color: "reverse", expectedResult: gocui.AttrReverse},
+		{color: "red blue", expectError: true},
+		{color: "purple", expectError: true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			result, err := parseColor(c.color)
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error for %q", c.color)
+				}
+				return
+			}
+			CheckNoError(t, err)
+			if result != c.expectedResult {
+				t.Fatalf("Expected %v but got %v", c.expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestResolveBindings(t *testing.T) {
+	actions := []keyAction{
+		{name: "quit", defaultKey: "ctrl-c"},
+		{name: "toggle-logs", defaultKey: "ctrl-l"},
+		{name: "send", view: "enter-text", defaultKey: "enter"},
+		{description: "Select next client", view: "clients", defaultKey: "down"},
+	}
+
+	var cases = []struct {
+		overrides        map[string]string
+		expectedSpecs    []string
+		expectedProblems int
+	}{
+		{ // The defaults are used without any overrides
+			overrides:        nil,
+			expectedSpecs:    []string{"ctrl-c", "ctrl-l", "enter", "down"},
+			expectedProblems: 0,
+		},
+		{ // An override replaces the default key
+			overrides:        map[string]string{"quit": "ctrl-q"},
+			expectedSpecs:    []string{"ctrl-q", "ctrl-l", "enter", "down"},
+			expectedProblems: 0,
+		},
+		{ // Unknown actions and keys are reported
+			overrides:        map[string]string{"no-such-action": "ctrl-n", "quit": "hyper-q"},
+			expectedSpecs:    []string{"ctrl-c", "ctrl-l", "enter", "down"},
+			expectedProblems: 2,
+		},
+		{ // A key chosen for two actions is only bound to the first
+			overrides:        map[string]string{"quit": "ctrl-x", "toggle-logs": "ctrl-x"},
+			expectedSpecs:    []string{"ctrl-x", "ctrl-l", "enter", "down"},
+			expectedProblems: 1,
+		},
+		{ // Global keys may not take over the fixed ones or typing
+			overrides:        map[string]string{"quit": "down", "toggle-logs": "l"},
+			expectedSpecs:    []string{"ctrl-c", "ctrl-l", "enter", "down"},
+			expectedProblems: 2,
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			bindings, problems := resolveBindings(actions, c.overrides)
+			specs := make([]string, len(bindings))
+			for i, b := range bindings {
+				specs[i] = b.spec
+			}
+			if !reflect.DeepEqual(specs, c.expectedSpecs) {
+				t.Fatalf("Expected %v but got %v", c.expectedSpecs, specs)
+			}
+			if len(problems) != c.expectedProblems {
+				t.Fatalf("Expected %d problems but got %v", c.expectedProblems, problems)
+			}
+		})
+	}
+}
+
+func TestResolveTheme(t *testing.T) {
+	result, problems := resolveTheme(themeConfig{Mention: "bold red", Username: "pink"})
+	if len(problems) != 1 {
+		t.Fatalf("Expected 1 problem but got %v", problems)
+	}
+	if result.mention != gocui.ColorRed|gocui.AttrBold {
+		t.Fatalf("Expected the mention color to be set but got %v", result.mention)
+	}
+	if result.username != defaultTheme.username {
+		t.Fatalf("Expected the default username color but got %v", result.username)
+	}
+
+	result, _ = resolveTheme(themeConfig{Mention: "bold red", Monochrome: true})
+	if !result.monochrome || result.mention&^(gocui.AttrBold|gocui.AttrReverse) != gocui.ColorDefault {
+		t.Fatalf("Expected a monochrome theme but got %+v", result)
+	}
+}
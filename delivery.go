@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAcksPerMessage is how many message IDs one acknowledgement carries.
+	// It is chosen so a sealed acknowledgement to the longest address still
+	// fits in smudge.DefaultMaxBroadcastBytes.
+	maxAcksPerMessage = 10
+
+	// ackInterval is how long acknowledgements are collected before they are
+	// sent, so several fit in one broadcast.
+	ackInterval = 500 * time.Millisecond
+
+	// firstRetransmit is how long we wait for the acknowledgement of a direct
+	// message before sending it again. The wait doubles after each attempt.
+	firstRetransmit = 2 * time.Second
+
+	// maxDeliveryAttempts is how many times a direct message is sent before
+	// it is marked as failed.
+	maxDeliveryAttempts = 5
+)
+
+// deliveryState is how far a direct message we sent is known to have got.
+type deliveryState int
+
+const (
+	deliverySent deliveryState = iota
+	deliveryFailed
+	deliveryDelivered
+	deliveryRead
+)
+
+// String returns the mark shown after a direct message in this state.
+func (s deliveryState) String() string {
+	switch s {
+	case deliveryDelivered:
+		return "✓"
+	case deliveryRead:
+		return "✓✓"
+	case deliveryFailed:
+		return "failed"
+	}
+	return ""
+}
+
+// sendReadReceipts is whether we tell the sender of a direct message that we
+// have seen it. It is turned off by the no-read-receipts privacy option.
+var sendReadReceipts = true
+
+// outgoingDM is a direct message we sent which has not been acknowledged.
+type outgoingDM struct {
+	msg      message
+	attempts int
+	next     time.Time
+}
+
+// deliveryTracker follows the direct messages we sent until they are
+// acknowledged. The zero value is empty, and it is safe to use from several
+// goroutines.
+type deliveryTracker struct {
+	mu      sync.Mutex
+	pending map[string]*outgoingDM
+	states  map[string]deliveryState
+	to      map[string]NodeAddress
+}
+
+// Sent starts tracking msg, which was just broadcast for the first time.
+func (t *deliveryTracker) Sent(msg message, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pending == nil {
+		t.pending = make(map[string]*outgoingDM)
+		t.states = make(map[string]deliveryState)
+		t.to = make(map[string]NodeAddress)
+	}
+	t.pending[msg.ID] = &outgoingDM{msg: msg, attempts: 1, next: now.Add(firstRetransmit)}
+	t.states[msg.ID] = deliverySent
+	t.to[msg.ID] = msg.To
+}
+
+// Ack records that from acknowledged the message with the given ID. Only the
+// recipient of the message may acknowledge it, and a state never goes back,
+// so a late delivery ack does not undo a read receipt. It reports whether the
+// state changed.
+func (t *deliveryTracker) Ack(id string, from NodeAddress, state deliveryState) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if to, ok := t.to[id]; !ok || to != from || state <= t.states[id] {
+		return false
+	}
+	t.states[id] = state
+	delete(t.pending, id)
+	return true
+}
+
+// Forget stops tracking the direct message with the given ID, which is no
+// longer in the history.
+func (t *deliveryTracker) Forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, id)
+	delete(t.states, id)
+	delete(t.to, id)
+}
+
+// State returns the state of the direct message with the given ID. It
+// reports false for messages which are not tracked.
+func (t *deliveryTracker) State(id string) (deliveryState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.states[id]
+	return state, ok
+}
+
+// Due returns the messages to send again at now, and the IDs of those which
+// have run out of attempts and are now marked as failed.
+func (t *deliveryTracker) Due(now time.Time) (resend []message, failed []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, dm := range t.pending {
+		if now.Before(dm.next) {
+			continue
+		}
+		if dm.attempts >= maxDeliveryAttempts {
+			t.states[id] = deliveryFailed
+			delete(t.pending, id)
+			failed = append(failed, id)
+			continue
+		}
+		dm.attempts++
+		dm.next = now.Add(firstRetransmit << uint(dm.attempts-1))
+		resend = append(resend, dm.msg)
+	}
+	sort.Strings(failed)
+	return resend, failed
+}
+
+// ackQueue collects the acknowledgements we owe other clients, so they can be
+// sent together. It is safe to use from several goroutines.
+type ackQueue struct {
+	mu        sync.Mutex
+	delivered map[NodeAddress][]string
+	read      map[NodeAddress][]string
+}
+
+// Add queues an acknowledgement of the message with the given ID to the
+// client at to.
+func (q *ackQueue) Add(to NodeAddress, id string, read bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.delivered == nil {
+		q.delivered = make(map[NodeAddress][]string)
+		q.read = make(map[NodeAddress][]string)
+	}
+	if read {
+		q.read[to] = append(q.read[to], id)
+	} else {
+		q.delivered[to] = append(q.delivered[to], id)
+	}
+}
+
+// Take empties the queue into acknowledgement messages, each carrying at most
+// maxAcksPerMessage IDs.
+func (q *ackQueue) Take() []message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var msgs []message
+	for _, read := range []bool{false, true} {
+		queue := q.delivered
+		if read {
+			queue = q.read
+		}
+		for to, ids := range queue {
+			for len(ids) > 0 {
+				n := len(ids)
+				if n > maxAcksPerMessage {
+					n = maxAcksPerMessage
+				}
+				msgs = append(msgs, message{
+					Type:    messageTypeAck,
+					To:      to,
+					Acks:    ids[:n],
+					Read:    read,
+					Version: clientVersion,
+				})
+				ids = ids[n:]
+			}
+			delete(queue, to)
+		}
+	}
+	return msgs
+}
+
+// markDMsRead queues read receipts for direct messages which have now been
+// seen.
+func (m *Messenger) markDMsRead(msgs []chatMessage) {
+	if !sendReadReceipts {
+		return
+	}
+	for _, msg := range msgs {
+		m.acks.Add(msg.From, m.history.WireID(msg.ID), true)
+	}
+}
+
+// receiveAck applies the acknowledgements of our direct messages sent by
+// senderAddr.
+func (m *Messenger) receiveAck(senderAddr NodeAddress, msg message) {
+	if msg.To != localAddress {
+		return
+	}
+	state := deliveryDelivered
+	if msg.Read {
+		state = deliveryRead
+	}
+
+	changed := false
+	for _, id := range msg.Acks {
+		if m.deliveries.Ack(id, senderAddr, state) {
+			changed = true
+		}
+	}
+	if changed {
+		refreshMessages()
+	}
+}
+
+// SendAcks periodically broadcasts the acknowledgements we owe, and sends
+// unacknowledged direct messages again.
+func (m *Messenger) SendAcks() {
+	for now := range time.Tick(ackInterval) {
+		for _, msg := range m.acks.Take() {
+			if err := broadcast(&msg); err != nil {
+				logError("Failed to send an acknowledgement", "err", err)
+			}
+		}
+
+		resend, failed := m.deliveries.Due(now)
+		for _, msg := range resend {
+			logDebug("Sending a direct message again", "id", msg.ID, "to", msg.To)
+			if err := broadcast(&msg); err != nil {
+				logError("Failed to send a direct message again", "id", msg.ID, "err", err)
+			}
+		}
+		if len(failed) > 0 {
+			logWarn("Direct messages were not acknowledged", "count", len(failed))
+			refreshMessages()
+		}
+	}
+}
+
+// formatDelivery returns the mark shown after a direct message we sent, or
+// "" for other messages.
+func formatDelivery(msg chatMessage) string {
+	if msg.From != localAddress || msg.To == "" || chat == nil {
+		return ""
+	}
+	state, ok := chat.deliveries.State(msg.ID)
+	if !ok {
+		return ""
+	}
+	if state == deliveryFailed {
+		return fmt.Sprintf("(%s)", state)
+	}
+	return state.String()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+func TestDeliveryTracker(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	start := time.Unix(1000, 0)
+
+	var tracker deliveryTracker
+	tracker.Sent(message{Type: messageTypeChat, ID: "AAAAAAAA", To: bob}, start)
+	tracker.Sent(message{Type: messageTypeChat, ID: "BBBBBBBB", To: bob}, start)
+
+	// Only bob may acknowledge his messages, and a read receipt is not undone
+	// by a delivery ack arriving after it.
+	if tracker.Ack("AAAAAAAA", "192.168.0.12:9999", deliveryRead) {
+		t.Fatalf("Expected an ack from another client to be ignored")
+	}
+	if !tracker.Ack("AAAAAAAA", bob, deliveryRead) {
+		t.Fatalf("Expected the read receipt to change the state")
+	}
+	if tracker.Ack("AAAAAAAA", bob, deliveryDelivered) {
+		t.Fatalf("Expected a late delivery ack to be ignored")
+	}
+	if state, _ := tracker.State("AAAAAAAA"); state != deliveryRead {
+		t.Fatalf("Expected the first message to be read but got %v", state)
+	}
+
+	// The unacknowledged message is sent again with a doubling wait, then
+	// given up on.
+	var resent []time.Duration
+	now := start
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Second)
+		resend, failed := tracker.Due(now)
+		if len(resend) > 0 {
+			if resend[0].ID != "BBBBBBBB" {
+				t.Fatalf("Expected to resend the second message but got %s", resend[0].ID)
+			}
+			resent = append(resent, now.Sub(start))
+		}
+		if len(failed) > 0 {
+			break
+		}
+	}
+	expected := []time.Duration{2 * time.Second, 6 * time.Second, 14 * time.Second, 30 * time.Second}
+	if fmt.Sprint(resent) != fmt.Sprint(expected) {
+		t.Fatalf("Expected resends at %v but got %v", expected, resent)
+	}
+	if state, _ := tracker.State("BBBBBBBB"); state != deliveryFailed {
+		t.Fatalf("Expected the second message to have failed but got %v", state)
+	}
+
+	// An ack arriving after we gave up still counts.
+	if !tracker.Ack("BBBBBBBB", bob, deliveryDelivered) {
+		t.Fatalf("Expected a late ack to mark the message delivered")
+	}
+}
+
+func TestAckQueue(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	bob := NodeAddress("192.168.0.11:9999")
+
+	var q ackQueue
+	for i := 0; i < maxAcksPerMessage+1; i++ {
+		q.Add(alice, fmt.Sprintf("%08d", i), false)
+	}
+	q.Add(bob, "BBBBBBBB", false)
+	q.Add(bob, "BBBBBBBB", true)
+
+	msgs := q.Take()
+	if len(msgs) != 4 {
+		t.Fatalf("Expected 4 acknowledgements but got %d", len(msgs))
+	}
+	ids := 0
+	for _, msg := range msgs {
+		CheckNoError(t, msg.validate())
+		ids += len(msg.Acks)
+	}
+	if ids != maxAcksPerMessage+3 {
+		t.Fatalf("Expected %d acknowledged IDs but got %d", maxAcksPerMessage+3, ids)
+	}
+	if msgs := q.Take(); len(msgs) != 0 {
+		t.Fatalf("Expected the queue to be empty but got %d messages", len(msgs))
+	}
+}
+
+func TestAckSize(t *testing.T) {
+	defer setClusterKeys(nil)
+
+	ids := make([]string, maxAcksPerMessage)
+	for i := range ids {
+		ids[i] = newMessageID()
+	}
+	msg := message{
+		Type:    messageTypeAck,
+		To:      NodeAddress("[" + strings.Repeat("ffff:", 7) + "ffff]:65535"),
+		Acks:    ids,
+		Read:    true,
+		Version: clientVersion,
+	}
+
+	for i, secrets := range [][]string{nil, {"correct horse battery staple"}} {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			CheckNoError(t, setClusterKeys(secrets))
+			data, err := seal(msg.Encode())
+			CheckNoError(t, err)
+			if len(data) > smudge.GetMaxBroadcastBytes() {
+				t.Fatalf("Expected at most %d bytes but got %d", smudge.GetMaxBroadcastBytes(), len(data))
+			}
+		})
+	}
+}
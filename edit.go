@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// EditMessage replaces the text of one of our own messages.
+func (m *Messenger) EditMessage(target chatMessage, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("the new text is empty, use /delete to delete a message")
+	}
+	if target.From != localAddress {
+		return fmt.Errorf("you can only edit your own messages")
+	}
+	if target.Deleted {
+		return fmt.Errorf("the message was deleted")
+	}
+	if err := checkSendLimit(); err != nil {
+		return err
+	}
+
+	msg := message{
+		Type:     messageTypeEdit,
+		Body:     text,
+		Target:   m.history.WireID(target.ID),
+		Revision: target.Revision + 1,
+		Version:  clientVersion,
+	}
+	m.history.Change(target.ID, messageChange{from: localAddress, body: text, revision: msg.Revision})
+	refreshMessages()
+
+	return broadcast(&msg)
+}
+
+// DeleteMessage deletes one of our own messages.
+func (m *Messenger) DeleteMessage(target chatMessage) error {
+	if target.From != localAddress {
+		return fmt.Errorf("you can only delete your own messages")
+	}
+	if err := checkSendLimit(); err != nil {
+		return err
+	}
+
+	msg := message{
+		Type:    messageTypeDelete,
+		Target:  m.history.WireID(target.ID),
+		Version: clientVersion,
+	}
+	m.history.Change(target.ID, messageChange{from: localAddress, delete: true})
+	refreshMessages()
+
+	return broadcast(&msg)
+}
+
+// receiveChange applies an edit or delete sent by another client. Changes to
+// messages which have not arrived yet are applied when they do.
+func (m *Messenger) receiveChange(senderAddr NodeAddress, msg message) {
+	change := messageChange{
+		from:     senderAddr,
+		body:     msg.Body,
+		revision: msg.Revision,
+		delete:   msg.Type == messageTypeDelete,
+	}
+	if m.history.Change(msg.Target, change) {
+		refreshMessages()
+	}
+}
+
+// findOwnMessage finds one of our messages by ID, or by counting back from
+// our most recent message when ref is a number.
+func findOwnMessage(store *messageStore, ref string) (chatMessage, bool) {
+	if msg, ok := store.Get(ref); ok && msg.From == localAddress {
+		return msg, true
+	}
+	n, err := strconv.Atoi(ref)
+	if err != nil {
+		return chatMessage{}, false
+	}
+	return store.RecentFrom(localAddress, n)
+}
+
+// looksLikeRef reports whether ref was meant to pick a message, being a
+// number or the ID of a message we have.
+func looksLikeRef(store *messageStore, ref string) bool {
+	if _, err := strconv.Atoi(ref); err == nil {
+		return true
+	}
+	_, ok := store.Get(ref)
+	return ok
+}
+
+// editTarget works out which message /edit changes and its new text from
+// the arguments: [N|id] <text>.
+func editTarget(store *messageStore, args string) (chatMessage, string, error) {
+	ref, text := splitFirst(args)
+	if looksLikeRef(store, ref) {
+		target, ok := findOwnMessage(store, ref)
+		if !ok {
+			return chatMessage{}, "", fmt.Errorf("no message %q of yours", ref)
+		}
+		if text == "" {
+			return chatMessage{}, "", fmt.Errorf("usage: /edit [N|id] <text>")
+		}
+		return target, text, nil
+	}
+
+	if args == "" {
+		return chatMessage{}, "", fmt.Errorf("usage: /edit [N|id] <text>")
+	}
+	target, ok := store.RecentFrom(localAddress, 1)
+	if !ok {
+		return chatMessage{}, "", fmt.Errorf("you have not sent any messages")
+	}
+	return target, args, nil
+}
+
+// cmdEdit replaces the text of one of our messages: /edit [N|id] <text>,
+// where N counts back from our most recent message, which is edited when
+// neither is given.
+func cmdEdit(args string) error {
+	target, text, err := editTarget(&chat.history, args)
+	if err != nil {
+		return err
+	}
+	return chat.EditMessage(target, text)
+}
+
+// cmdDelete deletes one of our messages: /delete [N|id], where N counts back
+// from our most recent message.
+func cmdDelete(args string) error {
+	ref := args
+	if ref == "" {
+		ref = "1"
+	}
+	target, ok := findOwnMessage(&chat.history, ref)
+	if !ok {
+		return fmt.Errorf("no message %q of yours", ref)
+	}
+	return chat.DeleteMessage(target)
+}
+
+// editLast starts editing our most recent message when Up is pressed in an
+// empty Send box. Otherwise Up moves the cursor as usual.
+func editLast(g *gocui.Gui, v *gocui.View) error {
+	if strings.TrimSpace(v.Buffer()) != "" {
+		gocui.DefaultEditor.Edit(v, gocui.KeyArrowUp, 0, gocui.ModNone)
+		return nil
+	}
+
+	for n := 1; ; n++ {
+		msg, ok := chat.history.RecentFrom(localAddress, n)
+		if !ok {
+			return nil
+		}
+		if !msg.Deleted {
+			return setInput(g, fmt.Sprintf("/edit %s %s", msg.ID, msg.Body))
+		}
+	}
+}
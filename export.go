@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportOptions are the arguments of /export and the export subcommand.
+type exportOptions struct {
+	format string
+	path   string
+
+	// since, channel and skipIgnored pick which messages are exported. A zero
+	// since and an empty channel export everything.
+	since       time.Time
+	channel     string
+	skipIgnored bool
+
+	// dataDir is where the export subcommand finds the history.
+	dataDir string
+}
+
+// exportUsage describes the arguments shared by /export and the export
+// subcommand.
+const exportUsage = "<markdown|html|jsonl> <path> [--since 2h|2006-01-02] [--channel room|@user] [--skip-ignored]"
+
+// parseExportArgs reads the arguments of /export and the export subcommand.
+// Options may come before or after the format and path.
+func parseExportArgs(args []string, now time.Time) (exportOptions, error) {
+	opts := exportOptions{dataDir: dataDir}
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if name == "skip-ignored" {
+			opts.skipIgnored = true
+			continue
+		}
+		if i+1 == len(args) {
+			return opts, fmt.Errorf("%s needs a value", arg)
+		}
+		i++
+		value := args[i]
+
+		switch name {
+		case "since":
+			since, err := parseSince(value, now)
+			if err != nil {
+				return opts, err
+			}
+			opts.since = since
+		case "channel":
+			opts.channel = normalizeChannel(value)
+		case "data-dir":
+			opts.dataDir = value
+		default:
+			return opts, fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	if len(positional) != 2 {
+		return opts, fmt.Errorf("usage: %s", exportUsage)
+	}
+	switch strings.ToLower(positional[0]) {
+	case "markdown", "md":
+		opts.format = "markdown"
+	case "html":
+		opts.format = "html"
+	case "jsonl", "json":
+		opts.format = "jsonl"
+	default:
+		return opts, fmt.Errorf("unknown format %q, use markdown, html or jsonl", positional[0])
+	}
+	opts.path = positional[1]
+	return opts, nil
+}
+
+// parseSince reads a point in time given as a duration before now, such as
+// "90m" or "7d", a date, or an RFC 3339 time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot read %q as a time, try 2h, 7d or 2006-01-02", s)
+}
+
+// normalizeChannel turns the ways of naming a channel, such as "#room" or
+// "bob", into the form kept in the history.
+func normalizeChannel(channel string) string {
+	channel = strings.TrimPrefix(strings.ToLower(channel), "#")
+	if channel == roomChannel || strings.HasPrefix(channel, "@") {
+		return channel
+	}
+	return "@" + channel
+}
+
+// selectExport returns the messages opts asks for, leaving out deleted ones.
+func selectExport(msgs []chatMessage, opts exportOptions) []chatMessage {
+	var selected []chatMessage
+	for _, msg := range msgs {
+		if msg.Deleted || msg.Time.Before(opts.since) {
+			continue
+		}
+		if opts.channel != "" && strings.ToLower(msg.Channel) != opts.channel {
+			continue
+		}
+		if opts.skipIgnored && ignored.Has(clientIdentity(msg.From)) {
+			continue
+		}
+		selected = append(selected, msg)
+	}
+	return selected
+}
+
+// exportRecord is one line of a JSON Lines export.
+type exportRecord struct {
+	ID      string      `json:"id"`
+	Time    time.Time   `json:"time"`
+	Channel string      `json:"channel"`
+	Sender  string      `json:"sender"`
+	Address NodeAddress `json:"address"`
+	Body    string      `json:"body"`
+	ReplyTo string      `json:"reply-to,omitempty"`
+	Edited  bool        `json:"edited,omitempty"`
+}
+
+// writeExport writes msgs to w in the given format.
+func writeExport(w io.Writer, format string, msgs []chatMessage, now time.Time) error {
+	switch format {
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, msg := range msgs {
+			err := enc.Encode(exportRecord{
+				ID:      msg.ID,
+				Time:    msg.Time,
+				Channel: msg.Channel,
+				Sender:  msg.Sender,
+				Address: msg.From,
+				Body:    msg.Body,
+				ReplyTo: msg.ReplyTo,
+				Edited:  msg.Edited,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "markdown":
+		return writeMarkdownExport(w, msgs, now)
+	case "html":
+		return htmlExport.Execute(w, struct {
+			Exported string
+			Messages []chatMessage
+		}{now.Format("2006-01-02 15:04 MST"), msgs})
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// writeMarkdownExport writes msgs as Markdown, with each body quoted so
+// anything in it stays inside the message.
+func writeMarkdownExport(w io.Writer, msgs []chatMessage, now time.Time) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Chat transcript\n\nExported %s, %d messages.\n", now.Format("2006-01-02 15:04 MST"), len(msgs))
+	for _, msg := range msgs {
+		edited := ""
+		if msg.Edited {
+			edited = " (edited)"
+		}
+		fmt.Fprintf(&b, "\n**%s** (%s) · %s · %s · `%s`%s\n\n", sanitizeLine(msg.Sender), msg.From,
+			msg.Channel, msg.Time.Format("2006-01-02 15:04:05"), msg.ID, edited)
+		if msg.ReplyTo != "" {
+			fmt.Fprintf(&b, "↱ reply to `%s`\n\n", msg.ReplyTo)
+		}
+		for _, line := range strings.Split(sanitizeText(msg.Body), "\n") {
+			fmt.Fprintf(&b, "> %s\n", line)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// htmlExport is the page written by an HTML export. It has no outside
+// resources, so it can be attached to a report as it is.
+var htmlExport = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chat transcript</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; color: #222; }
+.message { margin: 1em 0; }
+.meta { color: #777; font-size: 0.85em; }
+.sender { font-weight: bold; color: #222; }
+pre { white-space: pre-wrap; margin: 0.25em 0 0; font-family: inherit; }
+</style>
+</head>
+<body>
+<h1>Chat transcript</h1>
+<p class="meta">Exported {{.Exported}}, {{len .Messages}} messages.</p>
+{{range .Messages}}<div class="message" id="{{.ID}}">
+<div class="meta"><span class="sender" title="{{.From}}">{{.Sender}}</span> · {{.Channel}} · {{.Time.Format "2006-01-02 15:04:05"}}{{if .Edited}} · edited{{end}}{{if .ReplyTo}} · <a href="#{{.ReplyTo}}">reply</a>{{end}}</div>
+<pre>{{.Body}}</pre>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// exportHistory writes the messages in the history file at historyPath which
+// opts asks for, and returns how many there were.
+func exportHistory(historyPath string, opts exportOptions, now time.Time) (int, error) {
+	store, err := readHistory(historyPath)
+	if err != nil {
+		return 0, err
+	}
+	msgs := selectExport(store.All(), opts)
+
+	if opts.path == "-" {
+		return len(msgs), writeExport(os.Stdout, opts.format, msgs, now)
+	}
+	out, err := os.OpenFile(opts.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeExport(out, opts.format, msgs, now); err != nil {
+		out.Close()
+		return 0, err
+	}
+	return len(msgs), out.Close()
+}
+
+// cmdExport writes the saved history to a file: /export <format> <path>
+// [--since] [--channel] [--skip-ignored]
+func cmdExport(args string) error {
+	opts, err := parseExportArgs(strings.Fields(args), time.Now())
+	if err != nil {
+		return err
+	}
+	if chat.history.log == nil {
+		return fmt.Errorf("the history is not being saved")
+	}
+
+	n, err := exportHistory(chat.history.log.path, opts, time.Now())
+	if err != nil {
+		return err
+	}
+	printNotice(fmt.Sprintf("Exported %d messages to %s", n, opts.path))
+	return nil
+}
+
+// runExport is the export subcommand, which exports the saved history
+// without starting the chat.
+func runExport(args []string) error {
+	opts, err := parseExportArgs(args, time.Now())
+	if err != nil {
+		return err
+	}
+	if opts.skipIgnored {
+		if ignored, err = loadIgnoreList(opts.dataDir); err != nil {
+			return err
+		}
+	}
+
+	n, err := exportHistory(filepath.Join(opts.dataDir, historyFile), opts, time.Now())
+	if err != nil {
+		return err
+	}
+	if opts.path != "-" {
+		fmt.Printf("Exported %d messages to %s\n", n, opts.path)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExportArgs(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var cases = []struct {
+		args        string
+		expected    exportOptions
+		expectError bool
+	}{
+		{"md out.md", exportOptions{format: "markdown", path: "out.md"}, false},
+		{"html out.html --since 2h --channel #Room", exportOptions{format: "html", path: "out.html",
+			since: now.Add(-2 * time.Hour), channel: "room"}, false},
+		{"--skip-ignored --channel bob jsonl -", exportOptions{format: "jsonl", path: "-", channel: "@bob",
+			skipIgnored: true}, false},
+		{"jsonl out --since 2026-10-01", exportOptions{format: "jsonl", path: "out",
+			since: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{"jsonl out --since 7d", exportOptions{format: "jsonl", path: "out", since: now.AddDate(0, 0, -7)}, false},
+		{"pdf out.pdf", exportOptions{}, true},
+		{"md", exportOptions{}, true},
+		{"md out.md --since", exportOptions{}, true},
+		{"md out.md --since yesterday", exportOptions{}, true},
+		{"md out.md --colour red", exportOptions{}, true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			opts, err := parseExportArgs(strings.Fields(c.args), now)
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error for %q", c.args)
+				}
+				return
+			}
+			CheckNoError(t, err)
+			opts.dataDir = ""
+			if opts != c.expected {
+				t.Fatalf("Expected %#v but got %#v", c.expected, opts)
+			}
+		})
+	}
+}
+
+// writeTestHistory saves a short conversation with an edit, a delete and an
+// ignored user to a history file in dir, and returns its path.
+func writeTestHistory(t *testing.T, dir string) string {
+	alice := NodeAddress("192.168.0.10:9999")
+	bob := NodeAddress("192.168.0.11:9999")
+	mallory := NodeAddress("192.168.0.66:9999")
+	start := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+
+	log, err := openHistoryLog(dir, 0)
+	CheckNoError(t, err)
+	store := messageStore{log: log}
+	store.Add(chatMessage{ID: "AAAAAAAA", From: alice, Sender: "alice", Channel: "room",
+		Body: "the db is down", Time: start})
+	store.Add(chatMessage{ID: "BBBBBBBB", From: bob, Sender: "bob", Channel: "room",
+		Body: "rolling back <script>alert(1)</script>", ReplyTo: "AAAAAAAA", Time: start.Add(time.Minute)})
+	store.Add(chatMessage{ID: "CCCCCCCC", From: mallory, Sender: "mallory", Channel: "room",
+		Body: "spam", Time: start.Add(2 * time.Minute)})
+	store.Add(chatMessage{ID: "DDDDDDDD", From: alice, Sender: "alice", Channel: "@bob", To: bob,
+		Body: "oops", Time: start.Add(3 * time.Minute)})
+
+	// The edit of bob's message by alice is ignored, like in the chat.
+	store.Change("BBBBBBBB", messageChange{from: bob, body: "rolled back <b>", revision: 1})
+	store.Change("BBBBBBBB", messageChange{from: alice, body: "hijacked", revision: 2})
+	store.Change("DDDDDDDD", messageChange{from: alice, delete: true})
+	CheckNoError(t, log.file.Close())
+	return log.path
+}
+
+func TestExportHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	historyPath := writeTestHistory(t, dir)
+
+	ignored = &ignoreList{names: map[string]string{"192.168.0.66:9999": "mallory"}}
+	defer func() { ignored = &ignoreList{names: make(map[string]string)} }()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	out := filepath.Join(dir, "out.jsonl")
+	n, err := exportHistory(historyPath, exportOptions{format: "jsonl", path: out, skipIgnored: true}, now)
+	CheckNoError(t, err)
+	if n != 2 {
+		t.Fatalf("Expected 2 messages but got %d", n)
+	}
+
+	f, err := os.Open(out)
+	CheckNoError(t, err)
+	defer f.Close()
+	var records []exportRecord
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var rec exportRecord
+		CheckNoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	expected := []exportRecord{
+		{ID: "AAAAAAAA", Time: time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC), Channel: "room", Sender: "alice",
+			Address: "192.168.0.10:9999", Body: "the db is down"},
+		{ID: "BBBBBBBB", Time: time.Date(2026, 10, 18, 9, 1, 0, 0, time.UTC), Channel: "room", Sender: "bob",
+			Address: "192.168.0.11:9999", Body: "rolled back <b>", ReplyTo: "AAAAAAAA", Edited: true},
+	}
+	if fmt.Sprint(records) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v but got %v", expected, records)
+	}
+
+	// Changes by someone other than the sender are not saved at all.
+	saved, err := ioutil.ReadFile(historyPath)
+	CheckNoError(t, err)
+	if strings.Contains(string(saved), "hijacked") {
+		t.Fatalf("Expected alice's edit of bob's message not to be saved")
+	}
+
+	// Only the channel asked for, and the other formats.
+	store, err := readHistory(historyPath)
+	CheckNoError(t, err)
+	var cases = []struct {
+		opts     exportOptions
+		contains []string
+		excludes []string
+	}{
+		{exportOptions{format: "markdown"}, []string{"> rolled back <b>", "**mallory**", "↱ reply to `AAAAAAAA`"},
+			[]string{"hijacked", "oops"}},
+		{exportOptions{format: "html", skipIgnored: true},
+			[]string{"rolled back &lt;b&gt;", `<a href="#AAAAAAAA">reply</a>`}, []string{"<b>", "mallory"}},
+		{exportOptions{format: "markdown", since: time.Date(2026, 10, 18, 9, 1, 0, 0, time.UTC)},
+			[]string{"**bob**"}, []string{"**alice**"}},
+		{exportOptions{format: "markdown", channel: "@bob"}, []string{"0 messages"}, []string{"**alice**"}},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			var b bytes.Buffer
+			CheckNoError(t, writeExport(&b, c.opts.format, selectExport(store.All(), c.opts), now))
+			for _, s := range c.contains {
+				if !strings.Contains(b.String(), s) {
+					t.Fatalf("Expected the export to contain %q:\n%s", s, b.String())
+				}
+			}
+			for _, s := range c.excludes {
+				if strings.Contains(b.String(), s) {
+					t.Fatalf("Expected the export not to contain %q:\n%s", s, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	alice := NodeAddress("192.168.0.10:9999")
+	log, err := openHistoryLog(dir, 400)
+	CheckNoError(t, err)
+	store := messageStore{log: log}
+	for i := 0; i < 10; i++ {
+		store.Add(chatMessage{ID: fmt.Sprintf("AAAAAAA%d", i), From: alice, Sender: "alice",
+			Channel: "room", Body: "hello"})
+	}
+	CheckNoError(t, log.file.Close())
+
+	// Only the file and the one it was last rotated to are kept, and both
+	// are read back.
+	for _, path := range []string{log.path, log.path + ".1"} {
+		info, err := os.Stat(path)
+		CheckNoError(t, err)
+		if info.Size() > 400 {
+			t.Fatalf("Expected %s to hold at most 400 bytes but it has %d", path, info.Size())
+		}
+	}
+	if _, err := os.Stat(log.path + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no second older file")
+	}
+	replayed, err := readHistory(log.path)
+	CheckNoError(t, err)
+	msgs := replayed.All()
+	if len(msgs) == 0 || len(msgs) >= 10 || msgs[len(msgs)-1].ID != "AAAAAAA9" {
+		t.Fatalf("Expected the newest messages but got %v", msgs)
+	}
+}
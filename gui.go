@@ -1,56 +1,146 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/clockworksoul/smudge"
 	"github.com/jroimartin/gocui"
 )
 
-//
-// This file does not need to be edited!
-//
-// Please feel free to dig through this file if you are curious, however the
-// contents are fully implemented, so no edits are required to arrive at a
-// functional chat client.
-//
-
 var (
 	gui *gocui.Gui
 
 	logsVisible = false
+
+	// clients is the ClientList shown in the Clients pane. Commands use it to
+	// look up other clients by name.
+	clients ClientList
+
+	// chat is the Messenger which sends our messages and whose history is
+	// shown in the messages view.
+	chat *Messenger
+
+	// transcript holds everything written to the messages view, so the view
+	// can be redrawn when a message in it changes. It is only touched from
+	// the GUI goroutine.
+	transcript []transcriptEntry
+
+	// clientRows holds the address shown on each line of the Clients pane, so
+	// the selected line can be mapped back to a client. It is only touched
+	// from the GUI goroutine.
+	clientRows []NodeAddress
+
+	// overlayReturn is the view to focus again when an overlay is closed.
+	overlayReturn = "enter-text"
+
+	// keyBindings are the key bindings in effect, listed by /keys.
+	keyBindings []keyBinding
+
+	// currentTheme holds the colors used to draw the UI.
+	currentTheme = defaultTheme
+
+	// unreadCount is the number of chat messages that arrived while the
+	// messages view was covered or the "enter-text" view was not focused. It
+	// is only touched from the GUI goroutine.
+	unreadCount int
+
+	// unreadDMs holds the direct messages to us which arrived while the
+	// messages view was hidden, so read receipts are sent once it is not.
+	unreadDMs []chatMessage
 )
 
-func runGUI(cl ClientList) {
+// transcriptEntry is one entry of the messages view: either a chat message,
+// looked up in the history by ID when it is drawn, a shared file, looked up by
+// its ID, or a notice.
+type transcriptEntry struct {
+	id     string
+	file   string
+	notice string
+
+	// system is set on a notice about a client joining, leaving and so on,
+	// which is shown with the time it was printed.
+	system bool
+	time   time.Time
+}
+
+// continuationIndent lines up the second and later lines of a multi-line
+// message under the first, past the timestamp.
+const continuationIndent = "      "
+
+// clientRefreshInterval is how often the Clients pane is redrawn to keep idle
+// times and pings current between membership changes.
+const clientRefreshInterval = 5 * time.Second
+
+// keyActions lists everything the user can do with a key press. The named
+// actions can be bound to other keys in the configuration file.
+func keyActions() []keyAction {
+	return []keyAction{
+		{name: "quit", description: "Quit", defaultKey: "ctrl-c", handler: quit},
+		{name: "toggle-logs", description: "Show logs, raise their level, hide them", defaultKey: "ctrl-l", handler: cycleLogs},
+		{name: "send", description: "Send message", view: "enter-text", defaultKey: "enter", handler: readGuiMsg},
+		{name: "newline", description: "Start a new line", view: "enter-text", defaultKey: "ctrl-j", handler: insertNewline},
+		{name: "edit-last", description: "Edit your last message when empty", view: "enter-text", defaultKey: "up", handler: editLast},
+		{name: "scroll-up", description: "Scroll messages up", defaultKey: "pgup", handler: scrollUp},
+		{name: "scroll-down", description: "Scroll messages down", defaultKey: "pgdn", handler: scrollDown},
+		{name: "switch-pane", description: "Switch between Send and Clients", defaultKey: "tab", handler: switchPane},
+		{name: "next-channel", description: "Send to the next channel", defaultKey: "ctrl-n", handler: nextChannel},
+		{description: "Select previous client", view: "clients", defaultKey: "up", handler: selectPrevClient},
+		{description: "Select next client", view: "clients", defaultKey: "down", handler: selectNextClient},
+		{description: "Message selected client", view: "clients", defaultKey: "enter", handler: openDirectMessage},
+		{description: "Show selected client", view: "clients", defaultKey: "i", handler: showClientInfo},
+		{description: "Select client, twice to message", view: "clients", defaultKey: "mouse-left", handler: clickClient},
+		{description: "Focus the Send box", view: "enter-text", defaultKey: "mouse-left", handler: focusInput},
+		{description: "Message menu", view: "messages", defaultKey: "mouse-right", handler: showMessageMenu},
+		{description: "Choose a channel", view: "status", defaultKey: "mouse-left", handler: showChannelMenu},
+		{description: "Scroll messages up", view: "messages", defaultKey: "wheel-up", handler: wheelUp},
+		{description: "Scroll messages down", view: "messages", defaultKey: "wheel-down", handler: wheelDown},
+		{description: "Scroll logs up", view: "logs", defaultKey: "wheel-up", handler: wheelUp},
+		{description: "Scroll logs down", view: "logs", defaultKey: "wheel-down", handler: wheelDown},
+	}
+}
+
+func runGUI(m *Messenger, cfg config) {
 	g, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
-		fmt.Println("Fatal GUI error: ", err)
+		fmt.Fprintln(consoleOut, "Fatal GUI error: ", err)
 		os.Exit(1)
 	}
 	defer gui.Close()
 
 	gui = g
+	clients = m.clients
+	chat = m
 
 	// Set GUI managers and key bindings
 
 	gui.Cursor = true
+	gui.InputEsc = true
+	gui.Mouse = true
 	gui.SetManagerFunc(layout)
 
-	err = gui.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, quit)
-	if err != nil {
-		fmt.Println("Fatal GUI error: ", err)
-		os.Exit(1)
-	}
-	err = gui.SetKeybinding("", gocui.KeyCtrlL, gocui.ModNone, toggleLogs)
-	if err != nil {
-		fmt.Println("Fatal GUI error: ", err)
-		os.Exit(1)
+	bindings, problems := resolveBindings(keyActions(), cfg.Keys)
+	for _, b := range bindings {
+		err = gui.SetKeybinding(b.view, b.key, b.mod, b.handler)
+		if err != nil {
+			fmt.Fprintln(consoleOut, "Fatal GUI error: ", err)
+			os.Exit(1)
+		}
 	}
-	err = gui.SetKeybinding("enter-text", gocui.KeyEnter, gocui.ModNone, readGuiMsg)
-	if err != nil {
-		fmt.Println("Fatal GUI error: ", err)
-		os.Exit(1)
+	keyBindings = bindings
+
+	t, themeProblems := resolveTheme(cfg.Theme)
+	currentTheme = t
+	gui.FgColor = t.frame
+	gui.SelFgColor = t.frameSelected
+	gui.Highlight = true
+
+	for _, problem := range append(problems, themeProblems...) {
+		logError("Problem with the configuration", "problem", problem)
+		printNotice("Configuration: " + problem)
 	}
 
 	// We will update the client list after the GUI is initialized because we
@@ -58,10 +148,16 @@ func runGUI(cl ClientList) {
 	// creating Smudge.
 	// If this is skipped, we will not see the initial node connected until
 	// another node is added or removed.
-	printClientList(cl)
+	printClientList(clients)
+	printStatusBar()
+	go func() {
+		for range time.Tick(clientRefreshInterval) {
+			printClientList(clients)
+		}
+	}()
 
 	if err := gui.MainLoop(); err != nil && err != gocui.ErrQuit {
-		fmt.Println("Fatal GUI error: ", err)
+		fmt.Fprintln(consoleOut, "Fatal GUI error: ", err)
 		os.Exit(1)
 	}
 }
@@ -69,7 +165,7 @@ func runGUI(cl ClientList) {
 func layout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
 
-	helpY := maxY - 2
+	statusY := maxY - 2
 	chatX := 25
 	if maxX < 25 {
 		// Support for small terminals
@@ -82,6 +178,7 @@ func layout(g *gocui.Gui) error {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
+		applyTheme(v)
 
 		v.Title = "Logs"
 		v.Autoscroll = true
@@ -92,23 +189,20 @@ func layout(g *gocui.Gui) error {
 		}
 	}
 
-	if v, err := g.SetView("help", 0, helpY, maxX, maxY); err != nil {
+	if v, err := g.SetView("status", 0, statusY, maxX, maxY); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
+		applyTheme(v)
 
 		v.Frame = false
-
-		fmt.Fprintf(v, "%s %s    %s %s    %s %s",
-			frameText("Ctrl-L"), "Toggle Logs",
-			frameText("Ctrl-C"), "Quit",
-			frameText("Enter"), "Send Message")
 	}
 
-	if v, err := g.SetView("clients", 0, 0, chatX-1, helpY); err != nil {
+	if v, err := g.SetView("clients", 0, 0, chatX-1, statusY); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
+		applyTheme(v)
 
 		v.Title = "Clients"
 	}
@@ -117,27 +211,44 @@ func layout(g *gocui.Gui) error {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
+		applyTheme(v)
 
 		v.Autoscroll = true
 		v.Wrap = true
 		v.Title = "Message-History"
 	}
 
-	if v, err := g.SetView("enter-text", chatX, chatMaxY+1, maxX-1, helpY); err != nil {
+	if v, err := g.SetView("enter-text", chatX, chatMaxY+1, maxX-1, statusY); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
+		applyTheme(v)
 		if _, err := g.SetCurrentView("enter-text"); err != nil {
 			return err
 		}
 
 		v.Title = "Send:"
 		v.Editable = true
+		v.Editor = gocui.EditorFunc(typingEditor)
 		v.Wrap = true
 	}
 	return nil
 }
 
+// applyTheme sets the selection colors of a newly created view. Views inherit
+// the frame color from the Gui, so the text color is reset to the default.
+func applyTheme(v *gocui.View) {
+	v.FgColor = gocui.ColorDefault
+	v.BgColor = gocui.ColorDefault
+	v.SelFgColor = currentTheme.selectionFg
+	v.SelBgColor = currentTheme.selectionBg
+}
+
+func insertNewline(g *gocui.Gui, v *gocui.View) error {
+	v.EditNewLine()
+	return nil
+}
+
 func readGuiMsg(g *gocui.Gui, v *gocui.View) error {
 	msgText := v.Buffer()
 	v.Clear()
@@ -146,82 +257,640 @@ func readGuiMsg(g *gocui.Gui, v *gocui.View) error {
 		return err
 	}
 
-	return SendMessage(msgText)
+	err := handleInput(msgText)
+	if err == errSlowDown {
+		// Put the text back so it can be sent once the limit allows.
+		wait := sendLimiter.Wait().Round(100 * time.Millisecond)
+		printNotice(fmt.Sprintf("Slow down! You can send another message in %s", wait))
+		return setInput(g, strings.TrimRight(msgText, "\n"))
+	}
+	return err
 }
 
-func printChatMessage(msg, sender string) {
+// printChatMessage adds a chat message from the history to the messages view.
+func printChatMessage(msg chatMessage) {
+	if gui == nil {
+		return
+	}
+
 	gui.Update(func(g *gocui.Gui) error {
 		v, err := g.View("messages")
 		if err != nil {
 			return err
 		}
 
-		fmt.Fprintf(v, "%s: %s\n", sender, msg)
+		transcript = append(transcript, transcriptEntry{id: msg.ID})
+		writeChatMessage(v, msg)
+		rememberLinks(sanitizeText(msg.Body))
+
+		if messagesHidden(g) {
+			unreadCount++
+			if msg.To == localAddress {
+				unreadDMs = append(unreadDMs, msg)
+			}
+			return drawStatusBar(g, currentClusterStatus())
+		}
+		if msg.To == localAddress {
+			chat.markDMsRead([]chatMessage{msg})
+		}
 		return nil
 	})
 }
 
-// printClientList takes a ClientList and prints the username or NodeAddress for
-// each entry into the clients section of the UI.
-func printClientList(cl ClientList) {
+// writeChatMessage writes msg to the messages view v. A reply starts with a
+// line quoting the beginning of its parent, and reactions are counted on a
+// line after the message. Edited and deleted messages are marked as such.
+func writeChatMessage(v *gocui.View, msg chatMessage) {
+	label := sanitizeLine(msg.Label)
+	body := sanitizeText(msg.Body)
+	lines := renderMarkdown(body, currentTheme)
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	if msg.Deleted {
+		body = ""
+		lines = []string{styleText(currentTheme.quote, "message deleted")}
+	} else if msg.Edited {
+		lines[len(lines)-1] += " " + styleText(currentTheme.timestamp, "(edited)")
+	}
+	if mark := formatDelivery(msg); mark != "" {
+		lines[len(lines)-1] += " " + styleText(currentTheme.timestamp, mark)
+	}
+
+	if msg.ReplyTo != "" {
+		fmt.Fprintf(v, "%s%s\n", continuationIndent, styleText(currentTheme.quote, replySnippet(msg.ReplyTo)))
+	}
+
+	stamp := msg.Time.Format("15:04")
+	prefix := fmt.Sprintf("%s %s:", styleText(currentTheme.timestamp, stamp),
+		styleText(currentTheme.username, label))
+	if msg.From != localAddress && mentions(body, localUsername) {
+		prefix = styleText(currentTheme.mention, fmt.Sprintf("%s %s:", stamp, label))
+	}
+
+	fmt.Fprintf(v, "%s %s\n", prefix, lines[0])
+	for _, line := range lines[1:] {
+		fmt.Fprintf(v, "%s%s\n", continuationIndent, line)
+	}
+	if counts := chat.reactions.Counts(msg.ID); len(counts) > 0 && !msg.Deleted {
+		fmt.Fprintf(v, "%s%s\n", continuationIndent, formatReactions(counts))
+	}
+
+	messageLines = append(messageLines, chatLine{
+		id:     msg.ID,
+		sender: sanitizeLine(msg.Sender),
+		body:   body,
+		plain:  plainText(fmt.Sprintf("%s %s: %s", stamp, label, lines[0])),
+	})
+}
+
+// refreshMessages redraws the messages view, for when a message already in
+// it has changed.
+func refreshMessages() {
 	if gui == nil {
 		return
 	}
+	gui.Update(redrawMessages)
+}
 
+// redrawMessages writes the whole transcript to the messages view again.
+func redrawMessages(g *gocui.Gui) error {
+	v, err := g.View("messages")
+	if err != nil {
+		return err
+	}
+
+	v.Clear()
+	messageLines = nil
+	for _, entry := range transcript {
+		if entry.system {
+			writeSystemNotice(v, entry.time, entry.notice)
+			continue
+		}
+		if entry.notice != "" {
+			writeNotice(v, entry.notice)
+			continue
+		}
+		if entry.file != "" {
+			writeFileEntry(v, entry.file)
+			continue
+		}
+		if msg, ok := chat.history.Get(entry.id); ok {
+			writeChatMessage(v, msg)
+		}
+	}
+	return nil
+}
+
+// messagesHidden reports whether the user is probably not looking at the
+// messages view, because another view covers it or has focus.
+func messagesHidden(g *gocui.Gui) bool {
+	if v, err := g.View("messages"); err == nil && !v.Autoscroll {
+		// Scrolled back through the history
+		return true
+	}
+	cv := g.CurrentView()
+	return logsVisible || cv == nil || cv.Name() != "enter-text"
+}
+
+// markRead clears the unread count once the user is looking at the messages
+// view again.
+func markRead(g *gocui.Gui) error {
+	if unreadCount == 0 || messagesHidden(g) {
+		return nil
+	}
+
+	unreadCount = 0
+	chat.markDMsRead(unreadDMs)
+	unreadDMs = nil
+	return drawStatusBar(g, currentClusterStatus())
+}
+
+// printStatusBar redraws the status bar with the current cluster size. It is
+// called when the cluster membership changes.
+func printStatusBar() {
+	if gui == nil {
+		return
+	}
+
+	status := currentClusterStatus()
 	gui.Update(func(g *gocui.Gui) error {
-		v, err := g.View("clients")
+		return drawStatusBar(g, status)
+	})
+}
+
+// drawStatusBar writes status to the status bar. It must be called from the
+// GUI goroutine.
+func drawStatusBar(g *gocui.Gui, status clusterStatus) error {
+	v, err := g.View("status")
+	if err != nil {
+		return err
+	}
+
+	status.unread = unreadCount
+	status.channel = activeChannel.name
+	v.Clear()
+	if status.peers == 0 {
+		fmt.Fprint(v, colorText(gocui.ColorYellow, status.String()))
+	} else {
+		fmt.Fprint(v, status.String())
+	}
+	return nil
+}
+
+// printNotice writes a line from the client itself, such as the result of a
+// command, into the messages view.
+func printNotice(msg string) {
+	if gui == nil {
+		fmt.Fprintln(consoleOut, msg)
+		return
+	}
+
+	gui.Update(func(g *gocui.Gui) error {
+		v, err := g.View("messages")
 		if err != nil {
 			return err
 		}
 
-		v.Clear()
-		err = v.SetCursor(0, 0)
+		transcript = append(transcript, transcriptEntry{notice: msg})
+		writeNotice(v, msg)
+		return nil
+	})
+}
+
+// writeNotice writes a notice to the messages view v.
+func writeNotice(v *gocui.View, msg string) {
+	fmt.Fprintf(v, "%s %s\n", frameText("*"), msg)
+}
+
+// printClientList takes a ClientList and prints one line for each entry into
+// the clients section of the UI, sorted by name. Each line shows the client's
+// status, name, ping and idle time. We are marked with a "*" and clients that
+// have been idle for a while with a "z".
+func printClientList(cl ClientList) {
+	if gui == nil {
+		return
+	}
+
+	cl = cl.snapshot()
+	now := time.Now()
+	addrs := cl.Sorted()
+	rows := make([]string, len(addrs))
+	for i, addr := range addrs {
+		client := cl[addr]
+		rows[i] = formatClientRow(&client, now)
+	}
+
+	gui.Update(func(g *gocui.Gui) error {
+		v, err := g.View("clients")
 		if err != nil {
 			return err
 		}
 
-		for _, client := range cl {
-			fmt.Fprintln(v, client.GetName())
+		// Keep the selection on the same client if it is still listed.
+		_, cy := v.Cursor()
+		_, oy := v.Origin()
+		selected := oy + cy
+		if selected < len(clientRows) {
+			for i, addr := range addrs {
+				if addr == clientRows[selected] {
+					selected = i
+					break
+				}
+			}
+		}
+		if selected >= len(addrs) {
+			selected = len(addrs) - 1
+		}
+		if selected < 0 {
+			selected = 0
+		}
+
+		v.Clear()
+		clientRows = addrs
+		for _, row := range rows {
+			fmt.Fprintln(v, row)
 		}
-		return nil
+		return selectRow(v, selected)
 	})
 }
 
-func printLogs(msg string) {
-	if gui == nil {
-		fmt.Println(msg)
-	} else {
-		gui.Update(func(g *gocui.Gui) error {
-			v, err := g.View("logs")
-			if err != nil {
-				return err
-			}
+// selectRow moves the cursor of v to line row of its buffer, scrolling the
+// view when the line is out of sight.
+func selectRow(v *gocui.View, row int) error {
+	_, maxY := v.Size()
+	oy := 0
+	if maxY > 0 && row >= maxY {
+		oy = row - maxY + 1
+	}
+	if err := v.SetOrigin(0, oy); err != nil {
+		return err
+	}
+	if maxY == 0 {
+		return nil
+	}
+	return v.SetCursor(0, row-oy)
+}
 
-			fmt.Fprintln(v, msg)
-			return nil
-		})
+// formatClientRow renders one line of the Clients pane.
+func formatClientRow(c *ChatClient, now time.Time) string {
+	dot := colorText(gocui.ColorWhite, "?")
+	switch c.Status() {
+	case "online":
+		dot = colorText(gocui.ColorGreen, "●")
+	case "suspect":
+		dot = colorText(gocui.ColorYellow, "●")
+	case "dead":
+		dot = colorText(gocui.ColorRed, "●")
 	}
+
+	isIgnored := c.node != nil && ignored.Has(clientIdentity(NodeAddress(c.node.Address())))
+	marker := " "
+	if c.isLocal() {
+		marker = "*"
+	} else if isIgnored {
+		marker = "x"
+	} else if c.presence.State == "busy" {
+		marker = "!"
+	} else if c.presence.State == "away" || c.IsAway(now) {
+		marker = "z"
+	}
+
+	ping := ""
+	if !c.isLocal() && c.node != nil {
+		ping = formatPing(c.node.PingMillis())
+	}
+
+	details := fmt.Sprintf("%-10.10s %5s %3s", sanitizeLine(c.GetName()), ping,
+		formatIdle(c.Idle(now)))
+	if isIgnored {
+		details = styleText(currentTheme.ignored, details)
+	}
+	return dot + marker + details
 }
 
-func toggleLogs(g *gocui.Gui, v *gocui.View) error {
-	if logsVisible {
-		_, err := g.SetViewOnBottom("logs")
-		if err != nil {
-			return err
+// formatPing shortens a smudge.Node.PingMillis value to fit the Clients pane.
+func formatPing(ms int) string {
+	switch {
+	case ms == smudge.PingNoData:
+		return "-"
+	case ms == smudge.PingTimedOut:
+		return "t/o"
+	case ms >= 1000:
+		return fmt.Sprintf("%.1fs", float64(ms)/1000)
+	default:
+		return fmt.Sprintf("%dms", ms)
+	}
+}
+
+// formatIdle shortens an idle duration to its largest unit, such as "5m".
+// Clients idle for less than a minute show nothing.
+func formatIdle(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return ""
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	}
+}
+
+// selectedClient returns the address on the highlighted line of the Clients
+// pane.
+func selectedClient(v *gocui.View) (NodeAddress, bool) {
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+	if oy+cy >= len(clientRows) {
+		return NodeAddress(""), false
+	}
+	return clientRows[oy+cy], true
+}
+
+// switchPane moves the focus between the "enter-text" view and the Clients
+// pane. It does nothing while an overlay has the focus.
+func switchPane(g *gocui.Gui, v *gocui.View) error {
+	cv := g.CurrentView()
+	if cv == nil {
+		return nil
+	}
+
+	switch cv.Name() {
+	case "enter-text":
+		return focusClients(g, v)
+	case "clients":
+		return focusInput(g, v)
+	}
+	return nil
+}
+
+func scrollUp(g *gocui.Gui, v *gocui.View) error {
+	return scrollMessages(g, -1)
+}
+
+func scrollDown(g *gocui.Gui, v *gocui.View) error {
+	return scrollMessages(g, 1)
+}
+
+// scrollMessages moves the messages view by pages, a page being the height of
+// the view.
+func scrollMessages(g *gocui.Gui, pages int) error {
+	v, err := g.View("messages")
+	if err != nil {
+		return err
+	}
+
+	_, maxY := v.Size()
+	return scrollView(g, v, pages*(maxY-1))
+}
+
+// scrollView moves v up or down by a number of lines. Scrolling back to the
+// bottom turns autoscroll on again.
+func scrollView(g *gocui.Gui, v *gocui.View, lines int) error {
+	_, maxY := v.Size()
+	_, oy := v.Origin()
+	bottom := strings.Count(v.ViewBuffer(), "\n") - maxY
+	if bottom < 0 {
+		bottom = 0
+	}
+
+	oy += lines
+	v.Autoscroll = oy >= bottom
+	if oy > bottom {
+		oy = bottom
+	}
+	if oy < 0 {
+		oy = 0
+	}
+	if err := v.SetOrigin(0, oy); err != nil {
+		return err
+	}
+	return markRead(g)
+}
+
+// showKeys opens an overlay listing the key bindings in effect.
+func showKeys(g *gocui.Gui) error {
+	lines := make([]string, len(keyBindings))
+	for i, b := range keyBindings {
+		lines[i] = fmt.Sprintf("%-8s %-14s %s", b.spec, b.name, b.description)
+	}
+	return showOverlay(g, "keys", "Keys", lines)
+}
+
+func focusClients(g *gocui.Gui, v *gocui.View) error {
+	cv, err := g.SetCurrentView("clients")
+	if err != nil {
+		return err
+	}
+	cv.Highlight = true
+	return nil
+}
+
+func focusInput(g *gocui.Gui, v *gocui.View) error {
+	if cv, err := g.View("clients"); err == nil {
+		cv.Highlight = false
+	}
+	if _, err := g.SetCurrentView("enter-text"); err != nil {
+		return err
+	}
+	return markRead(g)
+}
+
+func selectPrevClient(g *gocui.Gui, v *gocui.View) error {
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+	if oy+cy == 0 {
+		return nil
+	}
+	return selectRow(v, oy+cy-1)
+}
+
+func selectNextClient(g *gocui.Gui, v *gocui.View) error {
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+	if oy+cy+1 >= len(clientRows) {
+		return nil
+	}
+	return selectRow(v, oy+cy+1)
+}
+
+// openDirectMessage starts a direct message to the selected client by filling
+// in a /msg command in the "enter-text" view.
+func openDirectMessage(g *gocui.Gui, v *gocui.View) error {
+	addr, ok := selectedClient(v)
+	if !ok {
+		return nil
+	}
+
+	target := string(addr)
+	if c, _ := clients.get(addr); c.username != "" && !strings.Contains(c.username, " ") {
+		target = c.username
+	}
+
+	return setInput(g, "/msg "+target+" ")
+}
+
+// setInput replaces the contents of the "enter-text" view with text, places
+// the cursor after it and focuses the view.
+func setInput(g *gocui.Gui, text string) error {
+	if err := focusInput(g, nil); err != nil {
+		return err
+	}
+	input, err := g.View("enter-text")
+	if err != nil {
+		return err
+	}
+
+	input.Clear()
+	fmt.Fprint(input, text)
+
+	// The view wraps long lines, so the end of the text may be further down.
+	maxX, maxY := input.Size()
+	if maxX == 0 || maxY == 0 {
+		return nil
+	}
+	length := len([]rune(text))
+	x, y := length%maxX, length/maxX
+	if y >= maxY {
+		x, y = maxX-1, maxY-1
+	}
+	if err := input.SetOrigin(0, 0); err != nil {
+		return err
+	}
+	return input.SetCursor(x, y)
+}
+
+// showClientInfo opens an overlay with the details of the selected client.
+func showClientInfo(g *gocui.Gui, v *gocui.View) error {
+	addr, ok := selectedClient(v)
+	if !ok {
+		return nil
+	}
+	return showOverlay(g, "client-info", "Client", clientInfoLines(addr))
+}
+
+// clientInfoLines describes the client at addr for the client details
+// overlay.
+func clientInfoLines(addr NodeAddress) []string {
+	c, _ := clients.get(addr)
+	now := time.Now()
+
+	version := sanitizeLine(c.version)
+	if c.isLocal() {
+		version = clientVersion
+	} else if version == "" {
+		version = "unknown"
+	}
+
+	ping := "-"
+	if !c.isLocal() && c.node != nil {
+		ping = formatPing(c.node.PingMillis())
+	}
+
+	// The key is the fingerprint of the cluster key the client's last
+	// broadcast was sealed with. We seal ours with the first key.
+	key := "none"
+	if len(clusterKeys) > 0 {
+		key = "unknown"
+		if c.isLocal() {
+			key = hex.EncodeToString(clusterKeys[0].id)
+		} else if c.keyID != "" {
+			key = c.keyID
 		}
-	} else {
-		_, err := g.SetViewOnTop("logs")
-		if err != nil {
+	}
+
+	firstSeen := "unknown"
+	if !c.firstSeen.IsZero() {
+		firstSeen = fmt.Sprintf("%s (%s ago)", c.firstSeen.Format("15:04:05"),
+			now.Sub(c.firstSeen).Truncate(time.Second))
+	}
+
+	lines := []string{
+		fmt.Sprintf("Name:       %s", sanitizeLine(c.GetName())),
+		fmt.Sprintf("Address:    %s", addr),
+		fmt.Sprintf("Status:     %s", c.Status()),
+		fmt.Sprintf("Presence:   %s", formatPresence(&c, now)),
+		fmt.Sprintf("Ping:       %s", ping),
+		fmt.Sprintf("Version:    %s", version),
+		fmt.Sprintf("Key:        %s", key),
+		fmt.Sprintf("First seen: %s", firstSeen),
+		fmt.Sprintf("Idle:       %s", c.Idle(now).Truncate(time.Second)),
+	}
+	return lines
+}
+
+// showOverlay opens a framed view in the middle of the screen, on top of the
+// others, containing lines. The overlay takes focus until it is dismissed with
+// Esc or q.
+func showOverlay(g *gocui.Gui, name, title string, lines []string) error {
+	maxX, maxY := g.Size()
+	width := len(title) + 4
+	for _, line := range lines {
+		if len(line)+2 > width {
+			width = len(line) + 2
+		}
+	}
+	if width > maxX-2 {
+		width = maxX - 2
+	}
+	height := len(lines) + 1
+	if height > maxY-2 {
+		height = maxY - 2
+	}
+
+	x0 := (maxX - width) / 2
+	y0 := (maxY - height) / 2
+	v, err := g.SetView(name, x0, y0, x0+width, y0+height)
+	if err != nil {
+		if err != gocui.ErrUnknownView {
 			return err
 		}
+
+		applyTheme(v)
+		for _, key := range []interface{}{gocui.KeyEsc, 'q'} {
+			if err := g.SetKeybinding(name, key, gocui.ModNone, closeOverlay); err != nil {
+				return err
+			}
+		}
 	}
 
-	logsVisible = !logsVisible
-	return nil
+	v.Title = title
+	v.Wrap = true
+	v.Clear()
+	for _, line := range lines {
+		fmt.Fprintln(v, line)
+	}
+
+	if cv := g.CurrentView(); cv != nil && cv.Name() != name {
+		overlayReturn = cv.Name()
+	}
+	if _, err := g.SetViewOnTop(name); err != nil {
+		return err
+	}
+	_, err = g.SetCurrentView(name)
+	return err
 }
 
+// closeOverlay removes the overlay view v and returns focus to the view that
+// was focused before it was opened.
+func closeOverlay(g *gocui.Gui, v *gocui.View) error {
+	g.DeleteKeybindings(v.Name())
+	if err := g.DeleteView(v.Name()); err != nil {
+		return err
+	}
+	if _, err := g.SetCurrentView(overlayReturn); err != nil {
+		return err
+	}
+	return markRead(g)
+}
+
+// quit leaves the chat like /quit does. Pressed again while we are leaving,
+// it quits at once.
 func quit(g *gocui.Gui, v *gocui.View) error {
-	return gocui.ErrQuit
+	quitWith("")
+	return nil
 }
 
 func stringFormatBoth(fg, bg int, str string, args []string) string {
@@ -232,3 +901,31 @@ func stringFormatBoth(fg, bg int, str string, args []string) string {
 func frameText(text string) string {
 	return stringFormatBoth(15, 0, text, []string{"1"})
 }
+
+// colorText wraps text in the escape sequence for one of the eight basic
+// gocui colors. In a monochrome theme the text is returned unchanged.
+func colorText(color gocui.Attribute, text string) string {
+	if currentTheme.monochrome {
+		return text
+	}
+	return styleText(color, text)
+}
+
+// styleText wraps text in the escape sequences for attr, which may combine a
+// color with bold, underline and reverse.
+func styleText(attr gocui.Attribute, text string) string {
+	params := []string{"39"}
+	if color := attr &^ (gocui.AttrBold | gocui.AttrUnderline | gocui.AttrReverse); color != gocui.ColorDefault {
+		params[0] = fmt.Sprint(30 + int(color) - 1)
+	}
+	if attr&gocui.AttrBold != 0 {
+		params = append(params, "1")
+	}
+	if attr&gocui.AttrUnderline != 0 {
+		params = append(params, "4")
+	}
+	if attr&gocui.AttrReverse != 0 {
+		params = append(params, "7")
+	}
+	return fmt.Sprintf("\x1b[%sm%s\x1b[0m", strings.Join(params, ";"), text)
+}
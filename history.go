@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// messageIDLength is the length of the IDs made by newMessageID.
+const messageIDLength = 8
+
+// chatMessage is a chat message we sent or received, as kept in the history.
+type chatMessage struct {
+	ID   string
+	From NodeAddress
+
+	// Sender is the name of the sender when the message arrived.
+	Sender string
+
+	// Label is what the message is shown as coming from, such as "bob" or
+	// "[DM to alice] bob".
+	Label string
+
+	// Channel is roomChannel, or "@name" for direct messages with name.
+	Channel string
+
+	To      NodeAddress
+	Body    string
+	ReplyTo string
+	Time    time.Time
+
+	// Revision counts the edits applied to Body, so an older edit arriving
+	// after a newer one is ignored.
+	Revision int
+	Edited   bool
+	Deleted  bool
+}
+
+// maxPendingChanges is how many edits and deletes of messages which have not
+// arrived yet are kept.
+const maxPendingChanges = 1000
+
+// maxPendingChangesFrom is how many of the pending changes may come from one
+// sender, so one client cannot fill the space kept for everyone.
+const maxPendingChangesFrom = 100
+
+// messageChange is an edit or delete of a message, sent by from.
+type messageChange struct {
+	from     NodeAddress
+	body     string
+	revision int
+	delete   bool
+}
+
+// newMessageID returns a random ID for a message we send. Other clients refer
+// to the message by this ID, for example to reply to it.
+func newMessageID() string {
+	b := make([]byte, messageIDLength*6/8)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to the time, which is unique enough for one client.
+		return fmt.Sprintf("%08x", uint32(time.Now().UnixNano()))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// validateMessageID checks that id looks like an ID made by newMessageID.
+func validateMessageID(id string) error {
+	if len(id) != messageIDLength {
+		return fmt.Errorf("message ID %q is not %d characters long", sanitizeLine(id), messageIDLength)
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(id); err != nil {
+		return fmt.Errorf("message ID %q is malformed", sanitizeLine(id))
+	}
+	return nil
+}
+
+// messageStore holds the chat messages we have seen, in the order they
+// arrived. The zero value is an empty store, and it is safe to use from
+// several goroutines.
+type messageStore struct {
+	mu       sync.Mutex
+	messages map[string]*chatMessage
+	order    []string
+
+	// replies maps a message ID to the IDs of its replies, in order. A
+	// parent may have replies before it arrives itself.
+	replies map[string][]string
+
+	// pending holds the changes to messages which have not arrived yet, by
+	// message ID. They are applied when the message arrives, if it came from
+	// the same sender. pendingFrom counts them by sender.
+	pending      map[string][]messageChange
+	pendingCount int
+	pendingFrom  map[NodeAddress]int
+
+	// index maps each word to the IDs of the messages containing it, so a
+	// search only looks at messages which might match.
+	index map[string]map[string]bool
+
+	// IDs are chosen by the sender, so another client may already have used
+	// the ID of a message, by accident or to have it dropped. Such a message
+	// is stored under a new ID. aliases maps the sender and the ID it used to
+	// the ID the message is stored under, and wireIDs maps it back.
+	aliases map[messageKey]string
+	wireIDs map[string]string
+
+	// limit is how many messages are kept, the oldest being forgotten
+	// first. Zero keeps them all. evicted holds the messages forgotten
+	// since TakeEvicted was last called, so what refers to them can go too.
+	limit   int
+	evicted []evictedMessage
+
+	// log is where messages and changes are saved, if anywhere.
+	log *historyLog
+}
+
+// messageKey identifies a message by its sender and the ID the sender gave
+// it.
+type messageKey struct {
+	from NodeAddress
+	id   string
+}
+
+// evictedMessage is a message the store forgot to stay within its limit. id
+// is the ID it was stored under, and wireID the one its sender gave it.
+type evictedMessage struct {
+	id     string
+	from   NodeAddress
+	wireID string
+}
+
+// Add stores msg. It reports false if the same sender already sent a message
+// with that ID, in which case nothing changes. A message whose ID was used by
+// another sender is stored under a new ID; Resolve returns it.
+func (s *messageStore) Add(msg chatMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.messages == nil {
+		s.messages = make(map[string]*chatMessage)
+		s.replies = make(map[string][]string)
+	}
+	if s.has(msg.From, msg.ID) {
+		return false
+	}
+	wireID := msg.ID
+	if _, ok := s.messages[msg.ID]; ok {
+		for ok {
+			msg.ID = newMessageID()
+			_, ok = s.messages[msg.ID]
+		}
+		if s.aliases == nil {
+			s.aliases = make(map[messageKey]string)
+			s.wireIDs = make(map[string]string)
+		}
+		s.aliases[messageKey{msg.From, wireID}] = msg.ID
+		s.wireIDs[msg.ID] = wireID
+	}
+
+	s.messages[msg.ID] = &msg
+	s.order = append(s.order, msg.ID)
+	s.log.Append(messageRecord(msg))
+	if msg.ReplyTo != "" {
+		s.replies[msg.ReplyTo] = append(s.replies[msg.ReplyTo], msg.ID)
+	}
+
+	s.indexMessage(&msg)
+	for _, change := range s.pending[wireID] {
+		if s.apply(&msg, change) {
+			s.log.Append(changeRecord(msg.ID, change, time.Now()))
+		}
+		s.pendingCount--
+		if s.pendingFrom[change.from]--; s.pendingFrom[change.from] == 0 {
+			delete(s.pendingFrom, change.from)
+		}
+	}
+	delete(s.pending, wireID)
+
+	for s.limit > 0 && len(s.order) > s.limit {
+		s.forget(s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+// TakeEvicted returns the messages forgotten to stay within the limit since
+// it was last called.
+func (s *messageStore) TakeEvicted() []evictedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evicted := s.evicted
+	s.evicted = nil
+	return evicted
+}
+
+// forget drops the message stored under id, apart from its place in s.order,
+// and adds it to s.evicted. The caller must hold s.mu.
+func (s *messageStore) forget(id string) {
+	msg, ok := s.messages[id]
+	if !ok {
+		return
+	}
+	s.unindexMessage(msg)
+	delete(s.messages, id)
+	evicted := evictedMessage{id: id, from: msg.From, wireID: id}
+
+	siblings := s.replies[msg.ReplyTo]
+	for i, reply := range siblings {
+		if reply == id {
+			s.replies[msg.ReplyTo] = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(s.replies[msg.ReplyTo]) == 0 {
+		delete(s.replies, msg.ReplyTo)
+	}
+	if wireID, ok := s.wireIDs[id]; ok {
+		delete(s.aliases, messageKey{msg.From, wireID})
+		delete(s.wireIDs, id)
+		evicted.wireID = wireID
+	}
+	s.evicted = append(s.evicted, evicted)
+}
+
+// has reports whether from sent a message with the given ID. The caller must
+// hold s.mu.
+func (s *messageStore) has(from NodeAddress, id string) bool {
+	if _, ok := s.aliases[messageKey{from, id}]; ok {
+		return true
+	}
+	msg, ok := s.messages[id]
+	return ok && msg.From == from
+}
+
+// Has reports whether from sent a message with the given ID.
+func (s *messageStore) Has(from NodeAddress, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.has(from, id)
+}
+
+// GetFrom returns the message from sent with the given ID, if we have it.
+func (s *messageStore) GetFrom(from NodeAddress, id string) (chatMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.has(from, id) {
+		return chatMessage{}, false
+	}
+	if alias, ok := s.aliases[messageKey{from, id}]; ok {
+		id = alias
+	}
+	return *s.messages[id], true
+}
+
+// Author returns the sender of the message stored under id, or nothing if we
+// do not have it.
+func (s *messageStore) Author(id string) NodeAddress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg, ok := s.messages[id]; ok {
+		return msg.From
+	}
+	return ""
+}
+
+// Resolve returns the ID under which the message from sent with the given ID
+// is stored.
+func (s *messageStore) Resolve(from NodeAddress, id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if alias, ok := s.aliases[messageKey{from, id}]; ok {
+		return alias
+	}
+	return id
+}
+
+// WireID returns the ID the sender gave the message stored under id, which
+// is what other clients know it by.
+func (s *messageStore) WireID(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wireID, ok := s.wireIDs[id]; ok {
+		return wireID
+	}
+	return id
+}
+
+// Change applies an edit or delete to the message with the given ID, or
+// keeps it until the message arrives. It reports whether a stored message
+// changed. Changes not sent by the message's own sender are ignored, and
+// only the changes which were applied are saved.
+func (s *messageStore) Change(id string, change messageChange) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if alias, ok := s.aliases[messageKey{change.from, id}]; ok {
+		id = alias
+	}
+	msg, ok := s.messages[id]
+	if !ok {
+		if s.pendingCount >= maxPendingChanges || s.pendingFrom[change.from] >= maxPendingChangesFrom {
+			return false
+		}
+		if s.pending == nil {
+			s.pending = make(map[string][]messageChange)
+			s.pendingFrom = make(map[NodeAddress]int)
+		}
+		s.pending[id] = append(s.pending[id], change)
+		s.pendingCount++
+		s.pendingFrom[change.from]++
+		return false
+	}
+	if !s.apply(msg, change) {
+		return false
+	}
+	s.log.Append(changeRecord(id, change, time.Now()))
+	return true
+}
+
+// apply makes change to msg, reporting whether it changed. A delete always
+// wins, and an edit only replaces an older revision. The caller must hold
+// s.mu.
+func (s *messageStore) apply(msg *chatMessage, change messageChange) bool {
+	if change.from != msg.From || msg.Deleted {
+		return false
+	}
+	if change.delete {
+		s.unindexMessage(msg)
+		msg.Deleted = true
+		msg.Body = ""
+		return true
+	}
+	if change.revision <= msg.Revision {
+		return false
+	}
+	s.unindexMessage(msg)
+	msg.Body = change.body
+	msg.Revision = change.revision
+	msg.Edited = true
+	s.indexMessage(msg)
+	return true
+}
+
+// Get returns a copy of the message with the given ID.
+func (s *messageStore) Get(id string) (chatMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return chatMessage{}, false
+	}
+	return *msg, true
+}
+
+// HasReplies reports whether any stored message replies to id.
+func (s *messageStore) HasReplies(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.replies[id]) > 0
+}
+
+// Thread returns the replies to id, and the replies to those, in the order
+// they arrived.
+func (s *messageStore) Thread(id string) []chatMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inThread := map[string]bool{id: true}
+	queue := []string{id}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, reply := range s.replies[parent] {
+			if !inThread[reply] {
+				inThread[reply] = true
+				queue = append(queue, reply)
+			}
+		}
+	}
+
+	var thread []chatMessage
+	for _, msgID := range s.order {
+		if msgID != id && inThread[msgID] {
+			thread = append(thread, *s.messages[msgID])
+		}
+	}
+	return thread
+}
+
+// Recent returns the ID of the nth most recent message, counting from 1.
+func (s *messageStore) Recent(n int) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n < 1 || n > len(s.order) {
+		return "", false
+	}
+	return s.order[len(s.order)-n], true
+}
+
+// RecentFrom returns the nth most recent message sent by from, counting from
+// 1.
+func (s *messageStore) RecentFrom(from NodeAddress, n int) (chatMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.order) - 1; i >= 0 && n > 0; i-- {
+		msg := s.messages[s.order[i]]
+		if msg.From != from {
+			continue
+		}
+		if n--; n == 0 {
+			return *msg, true
+		}
+	}
+	return chatMessage{}, false
+}
+
+// All returns every stored message in the order they arrived.
+func (s *messageStore) All() []chatMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := make([]chatMessage, len(s.order))
+	for i, id := range s.order {
+		msgs[i] = *s.messages[id]
+	}
+	return msgs
+}
+
+// Find returns the message with the given ID, or the nth most recent one if
+// ref is a number.
+func (s *messageStore) Find(ref string) (chatMessage, bool) {
+	if msg, ok := s.Get(ref); ok {
+		return msg, true
+	}
+	n, err := strconv.Atoi(ref)
+	if err != nil {
+		return chatMessage{}, false
+	}
+	id, ok := s.Recent(n)
+	if !ok {
+		return chatMessage{}, false
+	}
+	return s.Get(id)
+}
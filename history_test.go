@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessageStore(t *testing.T) {
+	var s messageStore
+	add := func(id, replyTo string) {
+		if !s.Add(chatMessage{ID: id, ReplyTo: replyTo}) {
+			t.Fatalf("Expected %s to be added", id)
+		}
+	}
+
+	// A reply can arrive before its parent.
+	add("reply--1", "parent--")
+	if !s.HasReplies("parent--") {
+		t.Fatalf("Expected the missing parent to have replies")
+	}
+	add("parent--", "")
+	add("other---", "")
+	add("reply--2", "reply--1")
+	add("reply--3", "parent--")
+	if s.Add(chatMessage{ID: "parent--"}) {
+		t.Fatalf("Expected a duplicate to be dropped")
+	}
+
+	var ids []string
+	for _, msg := range s.Thread("parent--") {
+		ids = append(ids, msg.ID)
+	}
+	expected := []string{"reply--1", "reply--2", "reply--3"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected the thread %v but got %v", expected, ids)
+	}
+
+	var finds = []struct {
+		ref        string
+		expectedID string
+	}{
+		{"1", "reply--3"},
+		{"3", "other---"},
+		{"other---", "other---"},
+		{"0", ""},
+		{"6", ""},
+		{"missing!", ""},
+	}
+	for _, f := range finds {
+		msg, ok := s.Find(f.ref)
+		if ok != (f.expectedID != "") || msg.ID != f.expectedID {
+			t.Fatalf("Find(%q): expected %q but got %q", f.ref, f.expectedID, msg.ID)
+		}
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newMessageID()
+		CheckNoError(t, validateMessageID(id))
+		if seen[id] {
+			t.Fatalf("Got the ID %s twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestMessageChanges(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	bob := NodeAddress("192.168.0.11:9999")
+
+	var cases = []struct {
+		changes      []messageChange
+		early        bool // the changes arrive before the message
+		expectedBody string
+		edited       bool
+		deleted      bool
+	}{
+		{ // An edit replaces the text
+			changes:      []messageChange{{from: alice, body: "fixed", revision: 1}},
+			expectedBody: "fixed",
+			edited:       true,
+		},
+		{ // Only the sender may edit
+			changes:      []messageChange{{from: bob, body: "gotcha", revision: 1}},
+			expectedBody: "original",
+		},
+		{ // An older edit arriving late is ignored
+			changes: []messageChange{
+				{from: alice, body: "second", revision: 2},
+				{from: alice, body: "first", revision: 1},
+			},
+			expectedBody: "second",
+			edited:       true,
+		},
+		{ // A delete wins over later edits
+			changes: []messageChange{
+				{from: alice, delete: true},
+				{from: alice, body: "back", revision: 3},
+			},
+			deleted: true,
+		},
+		{ // Changes which arrive first are applied with the message
+			changes: []messageChange{
+				{from: alice, body: "early", revision: 1},
+				{from: bob, delete: true},
+			},
+			early:        true,
+			expectedBody: "early",
+			edited:       true,
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			var s messageStore
+			original := chatMessage{ID: "message-", From: alice, Body: "original"}
+			if !c.early {
+				s.Add(original)
+			}
+			for _, change := range c.changes {
+				s.Change(original.ID, change)
+			}
+			if c.early {
+				s.Add(original)
+			}
+
+			msg, _ := s.Get(original.ID)
+			if msg.Body != c.expectedBody || msg.Edited != c.edited || msg.Deleted != c.deleted {
+				t.Fatalf("Expected %q (edited %v, deleted %v) but got %#v",
+					c.expectedBody, c.edited, c.deleted, msg)
+			}
+		})
+	}
+}
+
+func TestRecentFrom(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	var s messageStore
+	s.Add(chatMessage{ID: "alice-1-", From: alice})
+	s.Add(chatMessage{ID: "bob-1---", From: "192.168.0.11:9999"})
+	s.Add(chatMessage{ID: "alice-2-", From: alice})
+
+	for n, expected := range []string{"", "alice-2-", "alice-1-", ""} {
+		msg, ok := s.RecentFrom(alice, n)
+		if ok != (expected != "") || msg.ID != expected {
+			t.Fatalf("RecentFrom(%d): expected %q but got %q", n, expected, msg.ID)
+		}
+	}
+}
+
+func TestMessageIDClaimedByAnother(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	mallory := NodeAddress("192.168.0.66:9999")
+	var s messageStore
+
+	// Mallory sends a message with the ID alice is about to use.
+	s.Add(chatMessage{ID: "alice-1-", From: mallory, Body: "first"})
+	s.Change("alice-1-", messageChange{from: mallory, delete: true})
+	if !s.Add(chatMessage{ID: "alice-1-", From: alice, Body: "hello"}) {
+		t.Fatalf("Expected alice's message to be kept")
+	}
+	if s.Add(chatMessage{ID: "alice-1-", From: alice, Body: "hello"}) {
+		t.Fatalf("Expected alice's message to be a duplicate the second time")
+	}
+	if !s.Has(alice, "alice-1-") || !s.Has(mallory, "alice-1-") || s.Has("192.168.0.11:9999", "alice-1-") {
+		t.Fatalf("Expected each sender to have its own message")
+	}
+
+	id := s.Resolve(alice, "alice-1-")
+	if id == "alice-1-" || s.WireID(id) != "alice-1-" || s.Resolve(mallory, "alice-1-") != "alice-1-" {
+		t.Fatalf("Expected alice's message to be stored under a new ID but got %q", id)
+	}
+
+	// Alice's edits find her own message.
+	s.Change("alice-1-", messageChange{from: alice, body: "hello again", revision: 1})
+	if msg, _ := s.Get(id); msg.Body != "hello again" || msg.Deleted {
+		t.Fatalf("Expected alice's message to be edited but got %#v", msg)
+	}
+	if msg, _ := s.Get("alice-1-"); msg.From != mallory || !msg.Deleted {
+		t.Fatalf("Expected mallory's message to be left deleted but got %#v", msg)
+	}
+}
+
+func TestThreadRoot(t *testing.T) {
+	var s messageStore
+	s.Add(chatMessage{ID: "parent--"})
+	s.Add(chatMessage{ID: "reply--1", ReplyTo: "parent--"})
+	s.Add(chatMessage{ID: "circle-1", ReplyTo: "circle-2"})
+	s.Add(chatMessage{ID: "circle-2", ReplyTo: "circle-1"})
+
+	var cases = []struct {
+		id         string
+		expectedID string
+	}{
+		{"reply--1", "parent--"},
+		{"parent--", "parent--"},
+		{"circle-1", "circle-2"},
+		{"circle-2", "circle-1"},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			msg, _ := s.Get(c.id)
+			if root := threadRoot(&s, msg); root.ID != c.expectedID {
+				t.Fatalf("Expected %s but got %s", c.expectedID, root.ID)
+			}
+		})
+	}
+}
+
+func TestEditTarget(t *testing.T) {
+	var s messageStore
+	s.Add(chatMessage{ID: "mine-1--", From: localAddress, Body: "one"})
+	s.Add(chatMessage{ID: "theirs--", From: "192.168.0.11:9999", Body: "two"})
+	s.Add(chatMessage{ID: "mine-2--", From: localAddress, Body: "three"})
+
+	var cases = []struct {
+		args         string
+		expectedID   string
+		expectedText string
+		expectError  bool
+	}{
+		{"fixed", "mine-2--", "fixed", false},
+		{"2 fixed", "mine-1--", "fixed", false},
+		{"mine-1-- fixed", "mine-1--", "fixed", false},
+		{"fixed it now", "mine-2--", "fixed it now", false},
+		{"5 fixed", "", "", true},
+		{"theirs-- fixed", "", "", true},
+		{"2", "", "", true},
+		{"", "", "", true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			target, text, err := editTarget(&s, c.args)
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error for %q but got %s %q", c.args, target.ID, text)
+				}
+				return
+			}
+			CheckNoError(t, err)
+			if target.ID != c.expectedID || text != c.expectedText {
+				t.Fatalf("Expected %s %q but got %s %q", c.expectedID, c.expectedText, target.ID, text)
+			}
+		})
+	}
+}
+
+func TestMessageStoreLimit(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	bob := NodeAddress("192.168.0.11:9999")
+	store := messageStore{limit: 3}
+	store.Add(chatMessage{ID: "AAAAAAAA", From: alice, Body: "first apple"})
+	store.Add(chatMessage{ID: "AAAAAAAA", From: bob, Body: "same ID"})
+	bobID := store.Resolve(bob, "AAAAAAAA")
+	store.Add(chatMessage{ID: "CCCCCCCC", From: alice, Body: "reply", ReplyTo: "AAAAAAAA"})
+	store.Add(chatMessage{ID: "DDDDDDDD", From: alice, Body: "second apple"})
+	store.Add(chatMessage{ID: "EEEEEEEE", From: alice, Body: "third"})
+
+	if msgs := store.All(); len(msgs) != 3 || msgs[0].ID != "CCCCCCCC" {
+		t.Fatalf("Expected the 3 newest messages but got %v", msgs)
+	}
+	if store.Has(alice, "AAAAAAAA") || store.Has(bob, "AAAAAAAA") {
+		t.Fatalf("Expected the oldest messages to be forgotten")
+	}
+	if len(store.aliases) != 0 || len(store.wireIDs) != 0 {
+		t.Fatalf("Expected the alias to be forgotten but got %v", store.aliases)
+	}
+	expected := []evictedMessage{{"AAAAAAAA", alice, "AAAAAAAA"}, {bobID, bob, "AAAAAAAA"}}
+	if evicted := store.TakeEvicted(); !reflect.DeepEqual(evicted, expected) {
+		t.Fatalf("Expected %v to be evicted but got %v", expected, evicted)
+	}
+	if evicted := store.TakeEvicted(); len(evicted) != 0 {
+		t.Fatalf("Expected the evicted messages to be taken once but got %v", evicted)
+	}
+	q, err := parseSearchQuery("apple", time.Now())
+	CheckNoError(t, err)
+	if found := searchMessages(&store, q); len(found) != 1 || found[0].ID != "DDDDDDDD" {
+		t.Fatalf("Expected only the newer apple to be found but got %v", found)
+	}
+
+	store.Add(chatMessage{ID: "FFFFFFFF", From: alice, Body: "fourth"})
+	if store.HasReplies("AAAAAAAA") {
+		t.Fatalf("Expected the forgotten reply to be dropped")
+	}
+}
+
+func TestPendingChangesBySender(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	mallory := NodeAddress("192.168.0.66:9999")
+	var s messageStore
+
+	// Mallory sends more changes to messages nobody has seen than are kept
+	// for one sender.
+	for i := 0; i < maxPendingChangesFrom+10; i++ {
+		s.Change(fmt.Sprintf("spam%04d", i), messageChange{from: mallory, delete: true})
+	}
+	if s.pendingFrom[mallory] != maxPendingChangesFrom {
+		t.Fatalf("Expected %d of mallory's changes to be kept but got %d", maxPendingChangesFrom, s.pendingFrom[mallory])
+	}
+
+	// Alice's edit still waits for her message.
+	s.Change("alice-1-", messageChange{from: alice, body: "fixed", revision: 1})
+	s.Add(chatMessage{ID: "alice-1-", From: alice, Body: "original"})
+	if msg, _ := s.Get("alice-1-"); msg.Body != "fixed" {
+		t.Fatalf("Expected alice's early edit to be applied but got %#v", msg)
+	}
+	if s.pendingCount != maxPendingChangesFrom || s.pendingFrom[alice] != 0 {
+		t.Fatalf("Expected only mallory's changes to be left but got %d (%v)", s.pendingCount, s.pendingFrom)
+	}
+}
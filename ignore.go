@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ignoreFile is the name of the file in the data directory which holds the
+// ignore list.
+const ignoreFile = "ignored.json"
+
+// ignored holds the clients whose messages are dropped. main replaces it with
+// the list saved in the data directory.
+var ignored = &ignoreList{names: make(map[string]string)}
+
+// clientIdentity returns what the ignore list remembers a client by. Clients
+// have no keys, so this is their address, which unlike the username cannot be
+// changed without restarting the client.
+func clientIdentity(addr NodeAddress) string {
+	return string(addr)
+}
+
+// ignoreList is a set of client identities, each with the name the client had
+// when it was ignored. Changes are saved to path, unless it is empty. It is
+// safe to use from several goroutines.
+type ignoreList struct {
+	mu    sync.Mutex
+	path  string
+	names map[string]string
+}
+
+// loadIgnoreList reads the ignore list saved in dir. A missing file is an
+// empty list.
+func loadIgnoreList(dir string) (*ignoreList, error) {
+	l := &ignoreList{names: make(map[string]string)}
+	if dir == "" {
+		return l, nil
+	}
+	l.path = filepath.Join(dir, ignoreFile)
+
+	data, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal(data, &l.names); err != nil {
+		return l, fmt.Errorf("Failed to parse %s: %s", l.path, err)
+	}
+	if l.names == nil {
+		l.names = make(map[string]string)
+	}
+	return l, nil
+}
+
+// save writes the list to its file. The caller must hold l.mu.
+func (l *ignoreList) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.names, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path, data, 0600)
+}
+
+// Has reports whether the client with the given identity is ignored.
+func (l *ignoreList) Has(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.names[id]
+	return ok
+}
+
+// Add ignores the client with the given identity, remembering its name.
+func (l *ignoreList) Add(id, name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.names[id] = name
+	return l.save()
+}
+
+// Remove stops ignoring the client known by id, which may be its identity or
+// the name it was ignored under. It reports whether anybody was removed.
+func (l *ignoreList) Remove(id string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, name := range l.names {
+		if key == id || strings.EqualFold(name, id) {
+			delete(l.names, key)
+			return true, l.save()
+		}
+	}
+	return false, nil
+}
+
+// List describes each ignored client as "name (identity)", sorted by name.
+func (l *ignoreList) List() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]string, 0, len(l.names))
+	for id, name := range l.names {
+		list = append(list, fmt.Sprintf("%s (%s)", sanitizeLine(name), sanitizeLine(id)))
+	}
+	sort.Strings(list)
+	return list
+}
+
+// cmdIgnore drops all messages from a client: /ignore <user>
+func cmdIgnore(args string) error {
+	if args == "" {
+		return fmt.Errorf("usage: /ignore <user>")
+	}
+
+	addr, ok := clients.Lookup(args)
+	if !ok {
+		return fmt.Errorf("no client named %q", args)
+	}
+	if addr == localAddress {
+		return fmt.Errorf("you cannot ignore yourself")
+	}
+
+	client, _ := clients.get(addr)
+	if err := ignored.Add(clientIdentity(addr), client.GetName()); err != nil {
+		return fmt.Errorf("unable to save the ignore list: %s", err)
+	}
+	printNotice(fmt.Sprintf("Ignoring %s", sanitizeLine(client.GetName())))
+	printClientList(clients)
+	return nil
+}
+
+// cmdUnignore shows messages from an ignored client again: /unignore <user>
+func cmdUnignore(args string) error {
+	if args == "" {
+		return fmt.Errorf("usage: /unignore <user>")
+	}
+
+	// The name may now belong to a client other than the one ignored, so
+	// fall back to the name the ignored client had.
+	var removed bool
+	var err error
+	if addr, ok := clients.Lookup(args); ok {
+		removed, err = ignored.Remove(clientIdentity(addr))
+	}
+	if !removed && err == nil {
+		removed, err = ignored.Remove(args)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save the ignore list: %s", err)
+	}
+	if !removed {
+		return fmt.Errorf("%q is not ignored", args)
+	}
+	printNotice(fmt.Sprintf("No longer ignoring %s", sanitizeLine(args)))
+	printClientList(clients)
+	return nil
+}
+
+// cmdIgnored lists the ignored clients.
+func cmdIgnored(args string) error {
+	list := ignored.List()
+	if len(list) == 0 {
+		printNotice("Nobody is ignored")
+		return nil
+	}
+	printNotice("Ignored: " + strings.Join(list, ", "))
+	return nil
+}
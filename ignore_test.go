@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIgnoreList(t *testing.T) {
+	dir := t.TempDir()
+	l, err := loadIgnoreList(dir)
+	CheckNoError(t, err)
+
+	CheckNoError(t, l.Add("192.168.0.10:9999", "alice"))
+	CheckNoError(t, l.Add("192.168.0.11:9999", "bob"))
+	if !l.Has("192.168.0.10:9999") {
+		t.Fatalf("Expected alice to be ignored")
+	}
+	if l.Has("alice") {
+		t.Fatalf("Expected the list to be keyed by identity, not name")
+	}
+
+	// The list survives a restart.
+	l, err = loadIgnoreList(dir)
+	CheckNoError(t, err)
+	expected := []string{"alice (192.168.0.10:9999)", "bob (192.168.0.11:9999)"}
+	if list := l.List(); !reflect.DeepEqual(list, expected) {
+		t.Fatalf("Expected %v but got %v", expected, list)
+	}
+
+	// Clients can be removed by identity or by the name they were ignored
+	// under.
+	removed, err := l.Remove("192.168.0.10:9999")
+	CheckNoError(t, err)
+	if !removed || l.Has("192.168.0.10:9999") {
+		t.Fatalf("Expected alice to be removed")
+	}
+	removed, err = l.Remove("BOB")
+	CheckNoError(t, err)
+	if !removed || l.Has("192.168.0.11:9999") {
+		t.Fatalf("Expected bob to be removed")
+	}
+	removed, err = l.Remove("carol")
+	CheckNoError(t, err)
+	if removed {
+		t.Fatalf("Expected nobody to be removed")
+	}
+
+	l, err = loadIgnoreList(dir)
+	CheckNoError(t, err)
+	if list := l.List(); len(list) != 0 {
+		t.Fatalf("Expected an empty list but got %v", list)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+	"github.com/jroimartin/gocui"
+)
+
+// leaveHeartbeats is how many heartbeats we wait after announcing that we
+// are leaving, so smudge has time to pass the announcement along.
+const leaveHeartbeats = 4
+
+var (
+	// leavingMu guards leaving.
+	leavingMu sync.Mutex
+
+	// leaving is set once we have started to leave, so a second Ctrl-C or
+	// signal quits at once.
+	leaving bool
+
+	// departedMu guards departed.
+	departedMu sync.Mutex
+
+	// departed holds the clients which recently announced that they were
+	// leaving. The client keeps sending heartbeats while its announcement
+	// spreads, and smudge has no way for us to ignore them.
+	departed = make(map[NodeAddress]departure)
+)
+
+// departure is a client which announced that it was leaving.
+type departure struct {
+	// until is when smudge telling us that the client is alive is believed
+	// again.
+	until time.Time
+
+	// presence is the version of the client's presence when it left. A
+	// newer one means it came back.
+	presence int
+
+	// node is set once a heartbeat from the client was ignored. Smudge does
+	// not tell us again about a node it already thinks is alive, so the
+	// client has to be added from it if it turns out to be back.
+	node *smudge.Node
+}
+
+// departedGrace is how long after a client announces that it is leaving we
+// ignore its heartbeats: twice as long as it waits before it stops sending
+// them.
+func departedGrace() time.Duration {
+	return time.Duration(2*leaveHeartbeats*smudge.GetHeartbeatMillis()) * time.Millisecond
+}
+
+// markDeparted records that the client at addr announced that it is leaving,
+// when its presence had the given version.
+func markDeparted(addr NodeAddress, presenceVersion int, now time.Time) {
+	departedMu.Lock()
+	defer departedMu.Unlock()
+	for a, d := range departed {
+		if now.After(d.until) {
+			delete(departed, a)
+		}
+	}
+	departed[addr] = departure{until: now.Add(departedGrace()), presence: presenceVersion}
+}
+
+// ignoreHeartbeat reports whether smudge saying that node is alive should be
+// ignored, because the client announced that it is leaving so recently that
+// these may be its last heartbeats. The first time, cl checks again once the
+// grace period is over, in case the client really is back.
+func (cl ClientList) ignoreHeartbeat(node *smudge.Node, now time.Time) bool {
+	addr := NodeAddress(node.Address())
+	departedMu.Lock()
+	defer departedMu.Unlock()
+
+	d, ok := departed[addr]
+	if !ok || now.After(d.until) {
+		return false
+	}
+	if d.node == nil {
+		d.node = node
+		departed[addr] = d
+		time.AfterFunc(d.until.Sub(now), func() { cl.recheckDeparted(addr) })
+	}
+	return true
+}
+
+// recheckDeparted adds the client at addr back if smudge still thinks it is
+// alive once its grace period is over, since smudge will not tell us again.
+func (cl ClientList) recheckDeparted(addr NodeAddress) {
+	if node := takeDeparted(addr); node != nil && node.Status() == smudge.StatusAlive {
+		cl.OnChange(node, smudge.StatusAlive)
+	}
+}
+
+// returnedWith reports whether a presence with the given version from the
+// client at addr is newer than the one it had when it left, which means it
+// is back. The node of an ignored heartbeat, if there was one, is returned
+// so the client can be added again.
+func returnedWith(addr NodeAddress, presenceVersion int) (*smudge.Node, bool) {
+	departedMu.Lock()
+	d, ok := departed[addr]
+	departedMu.Unlock()
+	if !ok || presenceVersion <= d.presence {
+		return nil, false
+	}
+	return takeDeparted(addr), true
+}
+
+// takeDeparted forgets that the client at addr left, returning the node of
+// an ignored heartbeat if there was one.
+func takeDeparted(addr NodeAddress) *smudge.Node {
+	departedMu.Lock()
+	defer departedMu.Unlock()
+	d := departed[addr]
+	delete(departed, addr)
+	return d.node
+}
+
+// startLeaving reports whether this is the first attempt to leave.
+func startLeaving() bool {
+	leavingMu.Lock()
+	defer leavingMu.Unlock()
+	first := !leaving
+	leaving = true
+	return first
+}
+
+// leave tells the other clients that we are going, and why if reason is not
+// empty, then waits for the announcement to spread.
+func leave(reason string) {
+	msg := message{Type: messageTypeLeave, Body: reason, Version: clientVersion}
+	if err := broadcast(&msg); err != nil {
+		logError("Failed to announce that we are leaving", "err", err)
+		return
+	}
+	logInfo("Leaving the cluster", "reason", reason)
+	time.Sleep(time.Duration(leaveHeartbeats*smudge.GetHeartbeatMillis()) * time.Millisecond)
+}
+
+// quitWith leaves in the background and then stops the GUI. If we were
+// already leaving it stops the GUI straight away.
+func quitWith(reason string) {
+	if !startLeaving() {
+		stopGUI()
+		return
+	}
+	printNotice("Leaving…")
+	go func() {
+		leave(reason)
+		stopGUI()
+	}()
+}
+
+// stopGUI ends the GUI main loop, which ends the program, or exits when
+// there is no GUI.
+func stopGUI() {
+	if gui == nil {
+		os.Exit(0)
+	}
+	gui.Update(func(g *gocui.Gui) error {
+		return gocui.ErrQuit
+	})
+}
+
+// cmdQuit leaves the chat: /quit [reason]
+func cmdQuit(args string) error {
+	if err := checkReason(args); err != nil {
+		return err
+	}
+	quitWith(args)
+	return nil
+}
+
+// handleSignals leaves the same way as /quit when we are interrupted or
+// terminated. The terminal is in raw mode while the GUI runs, so Ctrl-C
+// arrives as a key press instead, but kill still sends a signal.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			logInfo("Received a signal", "signal", sig)
+			quitWith("")
+		}
+	}()
+}
+
+// receiveLeave removes a client which announced that it is leaving, rather
+// than waiting for smudge to notice that it stopped answering.
+func (m *Messenger) receiveLeave(senderAddr NodeAddress, reason string) {
+	if senderAddr == localAddress {
+		return
+	}
+	c, ok := m.clients.remove(senderAddr)
+	if !ok {
+		return
+	}
+	m.typing.Stop(senderAddr)
+	markDeparted(senderAddr, c.presence.Version, time.Now())
+
+	// Marked dead, smudge tells us through OnChange when the client comes
+	// back, once its last heartbeats are ignored.
+	if c.node != nil {
+		smudge.UpdateNodeStatus(c.node, smudge.StatusDead)
+	}
+
+	printClientList(m.clients)
+	printStatusBar()
+	systemEvents.Add(systemEvent{kind: eventLeave, addr: senderAddr, name: c.GetName(), detail: reason})
+}
+
+// leaveNotice describes a client leaving, such as "bob left (lunch)".
+func leaveNotice(name, reason string) string {
+	name = sanitizeLine(name)
+	if name == "" {
+		name = "Someone"
+	}
+	if reason == "" {
+		return name + " left"
+	}
+	return fmt.Sprintf("%s left (%s)", name, sanitizeLine(reason))
+}
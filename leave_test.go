@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+func TestReceiveLeave(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	carol := NodeAddress("192.168.0.12:9999")
+	m := Messenger{clients: ClientList{bob: ChatClient{}, carol: ChatClient{}, localAddress: ChatClient{}}}
+	systemEvents.Take()
+
+	// A leave sent on behalf of someone else, or with too long a reason,
+	// is rejected.
+	relayed := message{Type: messageTypeLeave, Origin: carol, Version: clientVersion}
+	m.receive(bob, relayed.Encode())
+	long := message{Type: messageTypeLeave, Body: strings.Repeat("x", maxReasonLength+1), Version: clientVersion}
+	m.receive(carol, long.Encode())
+	if len(m.clients) != 3 {
+		t.Fatalf("Expected 3 clients but got %d", len(m.clients))
+	}
+
+	m.typing.Saw(bob, time.Now())
+	msg := message{Type: messageTypeLeave, Body: "lunch", Version: clientVersion}
+	m.receive(bob, msg.Encode())
+	if _, ok := m.clients[bob]; ok {
+		t.Fatalf("Expected bob to be removed")
+	}
+	if active := m.typing.Active(time.Now()); len(active) != 0 {
+		t.Fatalf("Expected bob to stop typing but got %v", active)
+	}
+	events := systemEvents.Take()
+	if len(events) != 1 || events[0].kind != eventLeave || events[0].detail != "lunch" {
+		t.Fatalf("Expected a notice that bob left but got %v", events)
+	}
+
+	// We never remove ourselves.
+	m.receive(localAddress, msg.Encode())
+	if len(m.clients) != 2 {
+		t.Fatalf("Expected 2 clients but got %d", len(m.clients))
+	}
+}
+
+func TestLeaveIgnoresLastHeartbeats(t *testing.T) {
+	node, err := smudge.CreateNodeByIP(net.ParseIP("192.168.0.11"), 9999)
+	CheckNoError(t, err)
+	bob := NodeAddress(node.Address())
+	m := Messenger{clients: ClientList{bob: ChatClient{}, localAddress: ChatClient{}}}
+	defer func() {
+		departedMu.Lock()
+		delete(departed, bob)
+		departedMu.Unlock()
+	}()
+	systemEvents.Take()
+
+	// Bob keeps sending heartbeats while his leave spreads, which smudge
+	// reports as him being alive again.
+	msg := message{Type: messageTypeLeave, Version: clientVersion}
+	m.receive(bob, msg.Encode())
+	m.clients.OnChange(node, smudge.StatusAlive)
+	if _, ok := m.clients.get(bob); ok {
+		t.Fatalf("Expected bob to stay gone")
+	}
+	events := systemEvents.Take()
+	if len(events) != 1 || events[0].kind != eventLeave {
+		t.Fatalf("Expected only a notice that bob left but got %v", events)
+	}
+
+	// Once he could have stopped, he is back for real.
+	departedMu.Lock()
+	departed[bob] = departure{until: time.Now().Add(-time.Second)}
+	departedMu.Unlock()
+	m.clients.OnChange(node, smudge.StatusAlive)
+	if events := systemEvents.Take(); len(events) != 1 || events[0].kind != eventJoin {
+		t.Fatalf("Expected a notice that bob joined but got %v", events)
+	}
+}
+
+func TestReturnDuringGrace(t *testing.T) {
+	node, err := smudge.CreateNodeByIP(net.ParseIP("192.168.0.12"), 9999)
+	CheckNoError(t, err)
+	carol := NodeAddress(node.Address())
+	m := Messenger{clients: ClientList{carol: ChatClient{presence: presence{State: "away", Version: 10}}}}
+	defer takeDeparted(carol)
+	systemEvents.Take()
+
+	msg := message{Type: messageTypeLeave, Version: clientVersion}
+	m.receive(carol, msg.Encode())
+	m.clients.OnChange(node, smudge.StatusAlive)
+
+	// A presence she sent before leaving does not bring her back.
+	m.receivePresence(carol, map[NodeAddress]presence{carol: {State: "away", Version: 10}})
+	if events := systemEvents.Take(); len(events) != 1 || events[0].kind != eventLeave {
+		t.Fatalf("Expected only a notice that carol left but got %v", events)
+	}
+
+	// Restarted, she announces a newer one, and smudge will not tell us
+	// about her again.
+	m.receivePresence(carol, map[NodeAddress]presence{carol: {Version: 11}})
+	if events := systemEvents.Take(); len(events) != 1 || events[0].kind != eventJoin {
+		t.Fatalf("Expected a notice that carol joined but got %v", events)
+	}
+	if m.clients.ignoreHeartbeat(node, time.Now()) {
+		t.Fatalf("Expected carol's heartbeats to count again")
+	}
+}
+
+func TestLeaveNotice(t *testing.T) {
+	var cases = []struct {
+		name           string
+		reason         string
+		expectedResult string
+	}{
+		{"bob", "", "bob left"},
+		{"bob", "lunch", "bob left (lunch)"},
+		{"", "", "Someone left"},
+		{"bob\x1b[2J", "bye\n", "bob^[[2J left (bye^J)"},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if result := leaveNotice(c.name, c.reason); result != c.expectedResult {
+				t.Fatalf("Expected %q but got %q", c.expectedResult, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/clockworksoul/smudge"
+	"github.com/jroimartin/gocui"
+)
+
+// logLevel is how serious a log entry is.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevelNames are the names of the log levels, as given to -log-level.
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	if l < levelDebug || l > levelError {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+// parseLogLevel reads a log level given by name.
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q, use %s", s, strings.Join(logLevelNames, ", "))
+}
+
+// maxLogEntries is how many log entries are kept for the Logs view, so it can
+// be redrawn when its filter changes.
+const maxLogEntries = 1000
+
+// maxLogFileSize is how large the -log-file grows before it is rotated, and
+// maxLogBackups is how many rotated files are kept beside it.
+const (
+	maxLogFileSize = 10 << 20
+	maxLogBackups  = 3
+)
+
+var (
+	// logThreshold is the least serious level which is logged at all, set
+	// with -log-level.
+	logThreshold = levelInfo
+
+	// logFilter is the least serious level shown in the Logs view, cycled
+	// with Ctrl-L. It is only touched from the GUI goroutine.
+	logFilter = levelInfo
+
+	// logFile is where log entries are written as well, if anywhere.
+	logFile *rotatingFile
+
+	// consoleOut is the real standard output, kept when smudge's output is
+	// routed into the log.
+	consoleOut io.Writer = os.Stdout
+
+	// recentLogs holds the latest log entries, oldest first, and logSeq is
+	// the seq of the last one.
+	recentLogs   []logEntry
+	logSeq       uint64
+	recentLogsMu sync.Mutex
+
+	// logsShown is the seq of the last entry written to the Logs view, so an
+	// entry is not written again after the view is redrawn. It is only
+	// touched from the GUI goroutine.
+	logsShown uint64
+)
+
+// logField is a key and value attached to a log entry.
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logEntry is one log message with the fields describing it.
+type logEntry struct {
+	// seq numbers the entries in the order they were logged.
+	seq uint64
+
+	time   time.Time
+	level  logLevel
+	msg    string
+	fields []logField
+}
+
+// newLogEntry makes a log entry from alternating keys and values. A key
+// without a value is kept with an empty one.
+func newLogEntry(now time.Time, level logLevel, msg string, keyvals []interface{}) logEntry {
+	e := logEntry{time: now, level: level, msg: msg}
+	for i := 0; i < len(keyvals); i += 2 {
+		f := logField{key: fmt.Sprint(keyvals[i]), value: ""}
+		if i+1 < len(keyvals) {
+			f.value = keyvals[i+1]
+		}
+		e.fields = append(e.fields, f)
+	}
+	return e
+}
+
+// formatLogValue writes a field value so it stays one word, quoting it when
+// it is empty or holds spaces, quotes, equals signs or control characters.
+func formatLogValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// fieldsText writes the fields of e as key=value pairs.
+func (e logEntry) fieldsText() string {
+	var b strings.Builder
+	for _, f := range e.fields {
+		fmt.Fprintf(&b, " %s=%s", f.key, formatLogValue(f.value))
+	}
+	return b.String()
+}
+
+// String formats e for people, as in the Logs view.
+func (e logEntry) String() string {
+	return fmt.Sprintf("%s %-5s %s%s", e.time.Format("15:04:05"), strings.ToUpper(e.level.String()),
+		e.msg, e.fieldsText())
+}
+
+// logfmt formats e as one line of key=value pairs, for the log file.
+func (e logEntry) logfmt() string {
+	return fmt.Sprintf("time=%s level=%s msg=%s%s", e.time.Format(time.RFC3339Nano), e.level,
+		formatLogValue(e.msg), e.fieldsText())
+}
+
+// logDebug, logInfo, logWarn and logError log msg with the fields given as
+// alternating keys and values, for example
+//
+//	logError("Failed to send a digest", "err", err)
+func logDebug(msg string, keyvals ...interface{}) { logAt(levelDebug, msg, keyvals...) }
+func logInfo(msg string, keyvals ...interface{})  { logAt(levelInfo, msg, keyvals...) }
+func logWarn(msg string, keyvals ...interface{})  { logAt(levelWarn, msg, keyvals...) }
+func logError(msg string, keyvals ...interface{}) { logAt(levelError, msg, keyvals...) }
+
+// logAt records a log entry at level, if it is at least logThreshold, and
+// writes it to the log file and the Logs view. Without the GUI it is printed
+// instead, except in tests.
+func logAt(level logLevel, msg string, keyvals ...interface{}) {
+	if level < logThreshold {
+		return
+	}
+	e := newLogEntry(time.Now(), level, msg, keyvals)
+
+	recentLogsMu.Lock()
+	logSeq++
+	e.seq = logSeq
+	recentLogs = append(recentLogs, e)
+	if len(recentLogs) > maxLogEntries {
+		recentLogs = recentLogs[len(recentLogs)-maxLogEntries:]
+	}
+	recentLogsMu.Unlock()
+
+	if logFile != nil {
+		logFile.WriteLine(e.logfmt())
+	}
+	printLogEntry(e)
+}
+
+// filterLogs returns the entries at level or above.
+func filterLogs(entries []logEntry, level logLevel) []logEntry {
+	var shown []logEntry
+	for _, e := range entries {
+		if e.level >= level {
+			shown = append(shown, e)
+		}
+	}
+	return shown
+}
+
+// rotatingFile is a log file which is renamed aside once it grows past
+// maxSize, keeping up to backups older files named path.1, path.2 and so on.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	backups int
+}
+
+// openRotatingFile opens the log file at path for appending, creating it if
+// needed. Logs mention who we talk to, so only we may read it.
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens f.path and notes how large it already is. The caller must hold
+// f.mu, or be the only one with f.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// WriteLine appends line to the file, rotating it first if it would grow too
+// large. Failures go to the console, since logging them would loop. If the
+// file cannot be rotated, it keeps growing instead.
+func (f *rotatingFile) WriteLine(line string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(line))+1 > f.maxSize {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %s\n", f.path, err)
+			f.maxSize = 0
+			if f.file == nil && f.open() != nil {
+				return
+			}
+		}
+	}
+	n, err := io.WriteString(f.file, line+"\n")
+	f.size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write to %s: %s\n", f.path, err)
+	}
+}
+
+// rotate moves the current file to path.1, path.1 to path.2 and so on,
+// dropping the oldest, and starts a new file. The caller must hold f.mu.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	for i := f.backups - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", f.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if f.backups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the file.
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// smudgeThreshold is the smudge log level matching level.
+func smudgeThreshold(level logLevel) smudge.LogLevel {
+	switch level {
+	case levelDebug:
+		return smudge.LogDebug
+	case levelInfo:
+		return smudge.LogInfo
+	case levelWarn:
+		return smudge.LogWarn
+	}
+	return smudge.LogError
+}
+
+// parseSmudgeLine reads a line written by smudge, such as
+// " Info 18/Oct/2026:09:00:00 UTC - Adding host: 10.0.0.2:9999", into the
+// level and message to log it with. Anything else was not written by smudge.
+func parseSmudgeLine(line string) (logLevel, string, bool) {
+	fields := strings.Fields(line)
+	n := strings.Index(line, " - ")
+	if len(fields) < 4 || n < 0 {
+		return 0, "", false
+	}
+
+	var level logLevel
+	switch fields[0] {
+	case "Trace", "Debug":
+		level = levelDebug
+	case "Info":
+		level = levelInfo
+	case "Warn":
+		level = levelWarn
+	case "Error", "Fatal":
+		level = levelError
+	default:
+		return 0, "", false
+	}
+	if _, err := time.Parse("02/Jan/2006:15:04:05", fields[1]); err != nil {
+		return 0, "", false
+	}
+	return level, strings.TrimSpace(line[n+3:]), true
+}
+
+// routeSmudgeLogs logs what smudge writes to standard output at the matching
+// level, rather than letting it scribble over the UI. Other output, such as
+// ours, still reaches the console.
+func routeSmudgeLogs() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	consoleOut = os.Stdout
+	os.Stdout = w
+	smudge.SetLogThreshold(smudgeThreshold(logThreshold))
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if level, msg, ok := parseSmudgeLine(line); ok {
+				logAt(level, msg, "source", "smudge")
+			} else {
+				fmt.Fprintln(consoleOut, line)
+			}
+		}
+	}()
+	return nil
+}
+
+// printLogEntry writes e to the Logs view if the filter lets it through, or
+// to the console before the GUI starts.
+func printLogEntry(e logEntry) {
+	if gui == nil {
+		if !unittestMode {
+			fmt.Fprintln(consoleOut, sanitizeLine(e.String()))
+		}
+		return
+	}
+
+	gui.Update(func(g *gocui.Gui) error {
+		v, err := g.View("logs")
+		if err != nil {
+			return err
+		}
+		if e.seq > logsShown && e.level >= logFilter {
+			fmt.Fprintln(v, sanitizeLine(e.String()))
+		}
+		if e.seq > logsShown {
+			logsShown = e.seq
+		}
+		return nil
+	})
+}
+
+// cycleLogs shows the Logs view, then raises its filter one level each time
+// it is called, and finally hides it again.
+func cycleLogs(g *gocui.Gui, v *gocui.View) error {
+	switch {
+	case !logsVisible:
+		logFilter = logThreshold
+		if _, err := g.SetViewOnTop("logs"); err != nil {
+			return err
+		}
+		logsVisible = true
+	case logFilter < levelError:
+		logFilter++
+	default:
+		if _, err := g.SetViewOnBottom("logs"); err != nil {
+			return err
+		}
+		logsVisible = false
+	}
+
+	if err := redrawLogs(g); err != nil {
+		return err
+	}
+	return markRead(g)
+}
+
+// redrawLogs writes the recent log entries passing the filter to the Logs
+// view again.
+func redrawLogs(g *gocui.Gui) error {
+	v, err := g.View("logs")
+	if err != nil {
+		return err
+	}
+
+	recentLogsMu.Lock()
+	shown := filterLogs(recentLogs, logFilter)
+	logsShown = logSeq
+	recentLogsMu.Unlock()
+
+	v.Title = fmt.Sprintf("Logs: %s and above (Ctrl-L for more)", logFilter)
+	if logFilter == levelError {
+		v.Title = "Logs: error (Ctrl-L to hide)"
+	}
+	v.Clear()
+	for _, e := range shown {
+		fmt.Fprintln(v, sanitizeLine(e.String()))
+	}
+	return nil
+}
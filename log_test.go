@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	var cases = []struct {
+		name        string
+		expected    logLevel
+		expectError bool
+	}{
+		{"debug", levelDebug, false},
+		{"INFO", levelInfo, false},
+		{"warn", levelWarn, false},
+		{"error", levelError, false},
+		{"verbose", levelInfo, true},
+		{"", levelInfo, true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			level, err := parseLogLevel(c.name)
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error for %q", c.name)
+				}
+				return
+			}
+			CheckNoError(t, err)
+			if level != c.expected {
+				t.Fatalf("Expected %s but got %s", c.expected, level)
+			}
+		})
+	}
+}
+
+func TestLogEntryFormat(t *testing.T) {
+	now := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	e := newLogEntry(now, levelWarn, "Failed to receive a message", []interface{}{
+		"from", NodeAddress("10.0.0.2:9999"), "err", errors.New("bad tag"), "name", "evil\x1b[2J", "empty", "", "odd",
+	})
+
+	expected := `09:30:00 WARN  Failed to receive a message from=10.0.0.2:9999 err="bad tag" name="evil\x1b[2J" empty="" odd=""`
+	if e.String() != expected {
+		t.Fatalf("Expected %q but got %q", expected, e.String())
+	}
+	expected = `time=2026-10-18T09:30:00Z level=warn msg="Failed to receive a message" from=10.0.0.2:9999 err="bad tag" name="evil\x1b[2J" empty="" odd=""`
+	if e.logfmt() != expected {
+		t.Fatalf("Expected %q but got %q", expected, e.logfmt())
+	}
+}
+
+func TestLogThreshold(t *testing.T) {
+	defer func() { logThreshold = levelInfo }()
+	logThreshold = levelWarn
+
+	logInfo("quiet")
+	logWarn("loud", "n", 1)
+	logError("louder")
+
+	recentLogsMu.Lock()
+	logged := recentLogs[len(recentLogs)-2:]
+	recentLogsMu.Unlock()
+	if logged[0].msg != "loud" || logged[1].msg != "louder" || logged[1].seq != logged[0].seq+1 {
+		t.Fatalf("Expected only the warning and the error to be logged but got %v", logged)
+	}
+	if shown := filterLogs(logged, levelError); len(shown) != 1 || shown[0].msg != "louder" {
+		t.Fatalf("Expected the filter to keep only the error but got %v", shown)
+	}
+}
+
+func TestParseSmudgeLine(t *testing.T) {
+	var cases = []struct {
+		line          string
+		expectedLevel logLevel
+		expectedMsg   string
+		expectOK      bool
+	}{
+		{" Info 18/Oct/2026:09:00:00 UTC - Adding host: 10.0.0.2:9999", levelInfo, "Adding host: 10.0.0.2:9999", true},
+		{"Trace 18/Oct/2026:09:00:00 UTC - Sending ping - to 10.0.0.2", levelDebug, "Sending ping - to 10.0.0.2", true},
+		{"Fatal 18/Oct/2026:09:00:00 CEST - Listen failed", levelError, "Listen failed", true},
+		{" Warn 18/Oct/2026:09:00:00 UTC - ", levelWarn, "", true},
+		{"Fatal GUI error:  terminal not cursor addressable", 0, "", false},
+		{"Info yesterday UTC - hello", 0, "", false},
+		{"", 0, "", false},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			level, msg, ok := parseSmudgeLine(c.line)
+			if ok != c.expectOK || level != c.expectedLevel || msg != c.expectedMsg {
+				t.Fatalf("Expected %v %s %q but got %v %s %q", c.expectOK, c.expectedLevel, c.expectedMsg,
+					ok, level, msg)
+			}
+		})
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "chat.log")
+
+	// Each line is 10 bytes with its newline, so three fit in a file.
+	f, err := openRotatingFile(path, 30, 2)
+	CheckNoError(t, err)
+	for i := 0; i < 10; i++ {
+		f.WriteLine(fmt.Sprintf("line %04d", i))
+	}
+	CheckNoError(t, f.Close())
+
+	expected := map[string]string{
+		"chat.log":   "line 0009\n",
+		"chat.log.1": "line 0006\nline 0007\nline 0008\n",
+		"chat.log.2": "line 0003\nline 0004\nline 0005\n",
+	}
+	files, err := ioutil.ReadDir(dir)
+	CheckNoError(t, err)
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %d files but got %d", len(expected), len(files))
+	}
+	for name, contents := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		CheckNoError(t, err)
+		if string(data) != contents {
+			t.Fatalf("Expected %s to hold %q but got %q", name, contents, data)
+		}
+	}
+
+	// Reopening carries on from the size already written.
+	f, err = openRotatingFile(path, 30, 2)
+	CheckNoError(t, err)
+	f.WriteLine("line 0010")
+	f.WriteLine("line 0011")
+	f.WriteLine("line 0012")
+	CheckNoError(t, f.Close())
+	data, err := ioutil.ReadFile(path)
+	CheckNoError(t, err)
+	if !strings.HasPrefix(string(data), "line 0012") {
+		t.Fatalf("Expected the file to have been rotated again but got %q", data)
+	}
+}
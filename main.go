@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/clockworksoul/smudge"
 )
@@ -17,6 +18,10 @@ const (
 	// heartbeatMillis is used to configure how frequently the gossip protocol
 	// announces that it is still connected. No need to change this value.
 	heartbeatMillis = 500
+
+	// clientVersion is sent along with our broadcasts so other clients can
+	// show which version of the chat client we are running.
+	clientVersion = "0.3.0"
 )
 
 var (
@@ -41,35 +46,25 @@ var (
 	// localAddress is the NodeAddress which other Clients will use to reach us.
 	localAddress NodeAddress
 
-	unittestMode = false
-)
+	// configPath is the JSON file holding key bindings and the theme.
+	configPath string
 
-// printDebug outputs a log message with the "DEBUG:" prefix. This function can
-// be edited to easily enable and disable debugging logs without removing all
-// the log lines in the codebase.
-func printDebug(msg string, args ...interface{}) {
-	if !unittestMode {
-		printLogs(fmt.Sprintf("DEBUG: "+msg, args...))
-	}
-}
+	// dataDir is the directory where the ignore list and history are kept.
+	dataDir string
 
-// printInfo outputs a log message with the "INFO:" prefix. This function can
-// be edited to easily enable and disable debugging logs without removing all
-// the log lines in the codebase.
-func printInfo(msg string, args ...interface{}) {
-	if !unittestMode {
-		printLogs(fmt.Sprintf("INFO: "+msg, args...))
-	}
-}
+	// clusterSecrets are the -cluster-key secrets, the first of which is used
+	// to send.
+	clusterSecrets clusterKeyFlag
 
-// printError outputs a log message with the "ERROR:" prefix. This function can
-// be edited to easily enable and disable error logs without removing all
-// the log lines in the codebase.
-func printError(msg string, args ...interface{}) {
-	if !unittestMode {
-		printLogs(fmt.Sprintf("ERROR: "+msg, args...))
-	}
-}
+	// logLevelName and logPath are the -log-level and -log-file flags.
+	logLevelName string
+	logPath      string
+
+	// metricsAddr is where metrics are served, if anywhere.
+	metricsAddr string
+
+	unittestMode = false
+)
 
 // cacheLocalIP populates the value of the localAddress global variable.
 // localAddress is used to determine if a broadcast was directed to us
@@ -83,7 +78,7 @@ func cacheLocalIP() {
 	// More info: https://blog.golang.org/error-handling-and-go
 	ip, err := smudge.GetLocalIP()
 	if err != nil {
-		fmt.Println("Unable to retrieve local IP", err)
+		fmt.Fprintln(consoleOut, "Unable to retrieve local IP", err)
 		os.Exit(1)
 	}
 
@@ -98,6 +93,31 @@ func cacheLocalIP() {
 
 // main is the entry point to the application.
 func main() {
+	// Subcommands work on the saved data without joining the chat.
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		dataDir = defaultDataDir()
+		if err := runExport(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "export: %s\nusage: %s export %s [--data-dir dir]\n", err, os.Args[0], exportUsage)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diag" {
+		if err := runDiag(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "diag: %s\nusage: %s diag [metrics-addr]\n", err, os.Args[0])
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "search" {
+		dataDir = defaultDataDir()
+		if err := runSearch(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "search: %s\nusage: %s search %s [--data-dir dir]\n", err, os.Args[0], searchUsage)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Populate the flag variables at the top of this file with input from the
 	// user. Afterwards, determine if any required values were omitted.
 	flag.StringVar(&localUsername, "username", "",
@@ -106,16 +126,78 @@ func main() {
 		"Port on which client listens for connections to other clients")
 	flag.StringVar(&otherClient, "client", "",
 		"Address of an existing client, if empty do not attempt to connect")
+	flag.StringVar(&configPath, "config", "",
+		"Configuration file, defaults to "+defaultConfigPath())
+	flag.StringVar(&dataDir, "data-dir", defaultDataDir(),
+		"Directory for the ignore list and history")
+	flag.Var(&clusterSecrets, "cluster-key",
+		"Secret shared by the chat, repeat to accept older keys while rotating")
+	flag.StringVar(&logLevelName, "log-level", "info",
+		"Least serious log level to keep: debug, info, warn or error")
+	flag.StringVar(&logPath, "log-file", "",
+		"File to write logs to as well, rotated when it grows large")
+	flag.StringVar(&metricsAddr, "metrics-addr", "",
+		"Address such as :9100 to serve Prometheus metrics on, at /metrics, and /netinfo for diag")
 	flag.Parse()
 
+	level, err := parseLogLevel(logLevelName)
+	if err != nil {
+		logError("Invalid log level", "err", err)
+		os.Exit(1)
+	}
+	logThreshold = level
+	if logPath != "" {
+		if logFile, err = openRotatingFile(logPath, maxLogFileSize, maxLogBackups); err != nil {
+			logError("Unable to open the log file", "err", err)
+			os.Exit(1)
+		}
+		defer logFile.Close()
+	}
+
 	if listenPort == 0 {
-		printError("Listen port is required")
+		logError("Listen port is required")
 		flag.Usage()
 		os.Exit(1)
 	} else if localUsername == "" {
-		printError("Username is required")
+		logError("Username is required")
 		flag.Usage()
 		os.Exit(1)
+	} else if err := validateUsername(localUsername); err != nil {
+		logError("Invalid username", "err", err)
+		os.Exit(1)
+	}
+
+	// An explicitly given configuration file must exist, the default one is
+	// optional.
+	path, required := configPath, true
+	if path == "" {
+		path, required = defaultConfigPath(), false
+	}
+	cfg, err := loadConfig(path, required)
+	if err != nil {
+		logError("Unable to load the configuration", "err", err)
+		os.Exit(1)
+	}
+
+	if err := setClusterKeys(clusterSecrets); err != nil {
+		logError("Unable to use the cluster key", "err", err)
+		os.Exit(1)
+	}
+
+	ignored, err = loadIgnoreList(dataDir)
+	if err != nil {
+		logError("Unable to load the ignore list", "err", err)
+		os.Exit(1)
+	}
+
+	historyCfg := cfg.History.withDefaults()
+	var history *historyLog
+	if !historyCfg.Off {
+		history, err = openHistoryLog(dataDir, int64(historyCfg.MaxFileKB)<<10)
+		if err != nil {
+			logError("Unable to open the history", "err", err)
+			os.Exit(1)
+		}
 	}
 
 	// Now the user input is parsed, lets start configuring the gossip
@@ -125,14 +207,55 @@ func main() {
 	// Set configuration options
 	smudge.SetListenPort(listenPort)
 	smudge.SetHeartbeatMillis(heartbeatMillis)
+	if smudge.GetMaxBroadcastBytes() < smudge.DefaultMaxBroadcastBytes {
+		logWarn("Broadcasts are limited to fewer bytes than acknowledgements and file chunks need",
+			"limit", smudge.GetMaxBroadcastBytes(), "need", smudge.DefaultMaxBroadcastBytes)
+	}
 
 	// Add the status listener
 	clientList := ClientList(make(map[NodeAddress]ChatClient))
 	smudge.AddStatusListener(clientList)
 
 	// Add the broadcast listener
-	messenger := Messenger{clients: clientList}
+	sendTyping = !cfg.Privacy.NoTyping
+	sendReadReceipts = !cfg.Privacy.NoReadReceipts
+	autoAwayAfter = time.Duration(cfg.AutoAwayMinutes) * time.Minute
+	showSystemNotices = !cfg.HideSystemNotices
+
+	limits := cfg.RateLimits.withDefaults()
+	sendLimiter = newTokenBucket(limits.SendPerSecond, limits.SendBurst, time.Now)
+	messenger := Messenger{
+		clients:     clientList,
+		flood:       newFloodGuard(limits.ReceivePerSecond, limits.ReceiveBurst, time.Now),
+		signalFlood: newFloodGuard(signalsPerSecond, signalBurst, time.Now),
+		fileFlood:   newFloodGuard(fileTrafficPerSecond, fileTrafficBurst, time.Now),
+	}
+
+	// Earlier history is searchable too. It is read before the log is set, so
+	// it is not saved twice.
+	messenger.history.limit = historyCfg.MaxMessages
+	if history != nil {
+		if err := messenger.history.Replay(history.path); err != nil {
+			logError("Unable to read the history", "err", err)
+			os.Exit(1)
+		}
+	}
+	messenger.history.log = history
 	smudge.AddBroadcastListener(&messenger)
+	go messenger.ReportSuppressed()
+	go messenger.ReportSystemNotices()
+	go messenger.SendAcks()
+	go messenger.GossipDigests()
+	go messenger.SendFiles()
+	go WatchIdle()
+
+	if metricsAddr != "" {
+		if err := serveMetrics(metricsAddr); err != nil {
+			logError("Unable to serve metrics", "addr", metricsAddr, "err", err)
+			os.Exit(1)
+		}
+		go SamplePings()
+	}
 
 	// Only attempt to connect to another client if the address for one was
 	// provided. If not, the client will sit and wait until a client connects.
@@ -140,20 +263,23 @@ func main() {
 		// Add a new remote node. To join an existing cluster you must
 		// add at least one of its healthy member nodes.
 		if node, err := smudge.CreateNodeByAddress(otherClient); err != nil {
-			printError("Failed to create a new node from addr: ", err)
+			logError("Failed to create a new node", "addr", otherClient, "err", err)
 			os.Exit(1)
 		} else {
 			_, err = smudge.AddNode(node)
 			if err != nil {
-				printError("Failed to add a node to Smudge: ", err)
+				logError("Failed to add a node to Smudge", "addr", otherClient, "err", err)
 				os.Exit(1)
 			}
 		}
 	}
 
-	// The default logs from smudge just print to stdout and look messy in our
-	// fancy UI.
-	smudge.SetLogThreshold(smudge.LogOff)
+	// The logs from smudge just print to stdout and would look messy in our
+	// fancy UI, so they go to our own log instead.
+	if err := routeSmudgeLogs(); err != nil {
+		logError("Unable to route the logs from smudge", "err", err)
+		smudge.SetLogThreshold(smudge.LogOff)
+	}
 
 	// Start the server!
 	// We will run the smudge server in a background go routine. This is similar
@@ -163,7 +289,7 @@ func main() {
 	// For the scope of this class, you can assume this function is
 	// running in the background. I encourage reading more about these later
 	// from a resource such as this: https://gobyexample.com/goroutines
-	printDebug("Starting Smudge...\n")
+	logDebug("Starting Smudge")
 	go smudge.Begin()
 
 	cacheLocalIP()
@@ -174,11 +300,14 @@ func main() {
 	// process.
 	go clientList.FillMissingInfo()
 
+	// Interrupted or terminated, we still say goodbye.
+	handleSignals()
+
 	// Start the gui!
 	// Notice that here we are not starting in a go routine. If we did then this
 	// thread (the main one) would reach the end of the main function, exit, and
 	// kill all the other go routines. We will hand-off control of the program
 	// to the UI which will listen for input from the user from here out.
-	printDebug("Starting the GUI...\n")
-	runGUI(clientList)
+	logDebug("Starting the GUI")
+	runGUI(&messenger, cfg)
 }
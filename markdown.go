@@ -0,0 +1,166 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// maxRecentLinks is how many links from recent messages /open remembers.
+const maxRecentLinks = 50
+
+// urlPattern finds links in chat messages. Trailing punctuation is trimmed off
+// separately, since a sentence often ends right after a link.
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// recentLinks holds the links seen in chat messages, oldest first. It is only
+// touched from the GUI goroutine.
+var recentLinks []string
+
+// rememberLinks adds the links in text to recentLinks.
+func rememberLinks(text string) {
+	for _, link := range findLinks(text) {
+		recentLinks = append(recentLinks, link)
+	}
+	if len(recentLinks) > maxRecentLinks {
+		recentLinks = recentLinks[len(recentLinks)-maxRecentLinks:]
+	}
+}
+
+// findLinks returns the links in text, in order.
+func findLinks(text string) []string {
+	var links []string
+	for _, loc := range findLinkLocations(text) {
+		links = append(links, text[loc[0]:loc[1]])
+	}
+	return links
+}
+
+// findLinkLocations returns the start and end of each link in text.
+func findLinkLocations(text string) [][]int {
+	locs := urlPattern.FindAllStringIndex(text, -1)
+	for _, loc := range locs {
+		for loc[1] > loc[0] && strings.ContainsRune(".,;:!?)]}", rune(text[loc[1]-1])) {
+			loc[1]--
+		}
+	}
+	return locs
+}
+
+// sgrPattern matches the color escape sequences written by styleText.
+var sgrPattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// plainText removes the color escape sequences from text, leaving what the
+// terminal shows.
+func plainText(text string) string {
+	return sgrPattern.ReplaceAllString(text, "")
+}
+
+// renderMarkdown turns a chat message into the lines to write to the messages
+// view, using terminal attributes for a small subset of Markdown: *bold*,
+// _italic_ (shown underlined, as the terminal UI has no italics), `code`,
+// fenced code blocks and > quotes. Links are highlighted. text must already
+// have been passed through sanitizeText.
+func renderMarkdown(text string, t theme) []string {
+	var lines []string
+	inFence := false
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+
+		switch {
+		case inFence:
+			lines = append(lines, styleText(t.code, line))
+		case strings.HasPrefix(line, ">"):
+			quoted := strings.TrimPrefix(strings.TrimPrefix(line, ">"), " ")
+			lines = append(lines, styleText(t.quote, "│ ")+renderInline(quoted, t))
+		default:
+			lines = append(lines, renderInline(line, t))
+		}
+	}
+	return lines
+}
+
+// renderInline styles the spans of a single line: `code` first, since nothing
+// inside it is formatted, then links, *bold* and _italic_.
+func renderInline(line string, t theme) string {
+	var b strings.Builder
+	for line != "" {
+		start := strings.IndexByte(line, '`')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(line[start+1:], '`')
+		if end < 0 {
+			break
+		}
+		end += start + 1
+
+		b.WriteString(renderLinks(line[:start], t))
+		b.WriteString(styleText(t.code, line[start+1:end]))
+		line = line[end+1:]
+	}
+	b.WriteString(renderLinks(line, t))
+	return b.String()
+}
+
+// renderLinks highlights the links in text and formats the rest of it.
+func renderLinks(text string, t theme) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range findLinkLocations(text) {
+		b.WriteString(renderEmphasis(text[last:loc[0]], t))
+		b.WriteString(styleText(t.link, text[loc[0]:loc[1]]))
+		last = loc[1]
+	}
+	b.WriteString(renderEmphasis(text[last:], t))
+	return b.String()
+}
+
+// renderEmphasis formats *bold* and _italic_ spans. A marker only opens a
+// span when it is followed by a non-space and closes one when it follows a
+// non-space, so "2 * 3 * 4" and snake_case_names are left alone.
+func renderEmphasis(text string, t theme) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if (c == '*' || c == '_') && opensSpan(text, i) {
+			if end := closingMarker(text, i); end > 0 {
+				attr := gocui.AttrBold
+				if c == '_' {
+					attr = gocui.AttrUnderline
+				}
+				b.WriteString(styleText(attr, text[i+1:end]))
+				i = end
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// opensSpan reports whether the marker at text[i] can start a span.
+func opensSpan(text string, i int) bool {
+	if i+1 >= len(text) || text[i+1] == ' ' || text[i+1] == text[i] {
+		return false
+	}
+	return i == 0 || !isWordByte(text[i-1])
+}
+
+// closingMarker finds the marker which closes the span opened at text[i], or
+// returns -1 if there is none.
+func closingMarker(text string, i int) int {
+	for j := i + 2; j < len(text); j++ {
+		if text[j] != text[i] || text[j-1] == ' ' {
+			continue
+		}
+		if j+1 == len(text) || !isWordByte(text[j+1]) {
+			return j
+		}
+	}
+	return -1
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jroimartin/gocui"
+)
+
+func TestFindLinks(t *testing.T) {
+	var cases = []struct {
+		text           string
+		expectedResult []string
+	}{
+		{"no links here", nil},
+		{"see https://golang.org.", []string{"https://golang.org"}},
+		{"(http://a.example/x?y=1) and https://b.example/", []string{"http://a.example/x?y=1", "https://b.example/"}},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			result := findLinks(c.text)
+			if !reflect.DeepEqual(result, c.expectedResult) {
+				t.Fatalf("Expected %q but got %q", c.expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	th := defaultTheme
+	bold := func(s string) string { return styleText(gocui.AttrBold, s) }
+	italic := func(s string) string { return styleText(gocui.AttrUnderline, s) }
+	code := func(s string) string { return styleText(th.code, s) }
+	link := func(s string) string { return styleText(th.link, s) }
+	quote := styleText(th.quote, "│ ")
+
+	var cases = []struct {
+		text           string
+		expectedResult []string
+	}{
+		{"plain", []string{"plain"}},
+		{"*bold* and _italic_", []string{bold("bold") + " and " + italic("italic")}},
+		{"2 * 3 * 4 and snake_case_name", []string{"2 * 3 * 4 and snake_case_name"}},
+		{"run `go *test*`", []string{"run " + code("go *test*")}},
+		{"> quoted *text*", []string{quote + "quoted " + bold("text")}},
+		{"see https://golang.org/_x_", []string{"see " + link("https://golang.org/_x_")}},
+		{"```\nfunc main() {\n    *x* = 1\n}\n```\ndone", []string{
+			code("func main() {"),
+			code("    *x* = 1"),
+			code("}"),
+			"done",
+		}},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			result := renderMarkdown(c.text, th)
+			if !reflect.DeepEqual(result, c.expectedResult) {
+				t.Fatalf("Expected %q but got %q", c.expectedResult, result)
+			}
+		})
+	}
+}
@@ -3,9 +3,15 @@ package main
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/clockworksoul/smudge"
 )
@@ -23,8 +29,51 @@ const (
 	messageTypeChat messageType = iota + 1
 	messageTypeUsernames
 	messageTypeUsernameReq
+	messageTypeReaction
+	messageTypeEdit
+	messageTypeDelete
+	messageTypeTyping
+	messageTypePresence
+	messageTypeAck
+	messageTypeDigest
+	messageTypeRepairReq
+	messageTypeFileOffer
+	messageTypeFileChunk
+	messageTypeFileReq
+	messageTypeLeave
 )
 
+// messageTypeNames are the names of the message types, as used in metrics.
+var messageTypeNames = map[messageType]string{
+	messageTypeChat:        "chat",
+	messageTypeUsernames:   "usernames",
+	messageTypeUsernameReq: "username-req",
+	messageTypeReaction:    "reaction",
+	messageTypeEdit:        "edit",
+	messageTypeDelete:      "delete",
+	messageTypeTyping:      "typing",
+	messageTypePresence:    "presence",
+	messageTypeAck:         "ack",
+	messageTypeDigest:      "digest",
+	messageTypeRepairReq:   "repair-req",
+	messageTypeFileOffer:   "file-offer",
+	messageTypeFileChunk:   "file-chunk",
+	messageTypeFileReq:     "file-req",
+	messageTypeLeave:       "leave",
+}
+
+func (t messageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// maxDecodedBytes is the largest a message may be once decompressed. Smudge
+// limits broadcasts to a few hundred bytes, so anything near this size is
+// either a mistake or an attack.
+const maxDecodedBytes = 16 << 10
+
 // message represents the structure of the contents in a smudge.Broadcast. We
 // can use the Type to determine what the Body will contain.
 type message struct {
@@ -47,6 +96,78 @@ type message struct {
 	// Usernames is filled only in a messageTypeUsernames. It contains a map
 	// of the address->username pairings know by the sending client.
 	Usernames map[NodeAddress]string `json:"usernames"`
+
+	// To is set on a messageTypeChat when it is a direct message. Every client
+	// receives the broadcast, but only the client at this address shows it.
+	To NodeAddress `json:"to,omitempty"`
+
+	// Version is the clientVersion of the sender.
+	Version string `json:"version,omitempty"`
+
+	// ID identifies a messageTypeChat, so other messages can refer to it.
+	// Clients older than 0.3.0 do not send one.
+	ID string `json:"id,omitempty"`
+
+	// ReplyTo is set on a messageTypeChat which replies to the message with
+	// this ID.
+	ReplyTo string `json:"reply-to,omitempty"`
+
+	// Target is the ID of the message a messageTypeReaction reacts to, or
+	// which a messageTypeEdit or messageTypeDelete changes. The emoji of a
+	// reaction is in the Body and the ID tags the reaction.
+	Target string `json:"target,omitempty"`
+
+	// Author is the sender of the message ReplyTo or Target refers to. IDs
+	// are chosen by their senders, so two clients may use the same one.
+	Author NodeAddress `json:"author,omitempty"`
+
+	// Revision numbers the edits of a message, starting from 1, with the new
+	// text in the Body.
+	Revision int `json:"revision,omitempty"`
+
+	// Presence is filled only in a messageTypePresence. It maps addresses to
+	// the presence the sender knows for them.
+	Presence map[NodeAddress]presence `json:"presence,omitempty"`
+
+	// Auto is set on a direct message sent automatically, such as the reply
+	// of a client which is away. Nobody replies automatically to one.
+	Auto bool `json:"auto,omitempty"`
+
+	// Acks is filled only in a messageTypeAck. It lists the IDs of direct
+	// messages from To which the sender received, or has read if Read is
+	// set.
+	Acks []string `json:"acks,omitempty"`
+	Read bool     `json:"read,omitempty"`
+
+	// Epoch and Seq number the room messages of one run of a client, so
+	// others can tell when one is missing. A messageTypeChat or
+	// messageTypeDelete with Origin set was sent again by another client on
+	// behalf of Origin. A messageTypeRepairReq asks To for Origin's messages
+	// after Seq.
+	Origin NodeAddress `json:"origin,omitempty"`
+	Epoch  int64       `json:"epoch,omitempty"`
+	Seq    int         `json:"seq,omitempty"`
+
+	// Marks is filled only in a messageTypeDigest. It tells how far along
+	// each client's room messages the sender has every message.
+	Marks map[NodeAddress]highWater `json:"marks,omitempty"`
+
+	// File is the ID of a shared file. A messageTypeFileOffer has the file
+	// name in the Body along with its Size and the base64 SHA-256 Hash of
+	// its contents. A messageTypeFileChunk carries chunk number Chunk,
+	// counting from 1, in Data. A messageTypeFileReq asks To for the
+	// Missing chunks again.
+	File    string `json:"file,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Chunk   int    `json:"chunk,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Missing []int  `json:"missing,omitempty"`
+
+	// Remove is set on a messageTypeReaction which takes back the reactions
+	// tagged with Tags.
+	Remove bool     `json:"remove,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
 }
 
 // Encode converts the message into a form which can be sent to other clients
@@ -69,11 +190,11 @@ func (m *message) Encode() []byte {
 	w := zlib.NewWriter(&b)
 	err := json.NewEncoder(w).Encode(m)
 	if err != nil {
-		printError("Failed to marshal a chat message to send: %s", err)
+		logError("Failed to marshal a chat message to send", "err", err)
 	}
 	err = w.Close() // The bytes might not actually be written until closed (or flushed)
 	if err != nil {
-		printError("Failed to close the encoding writer: %s", err)
+		logError("Failed to close the encoding writer", "err", err)
 	}
 
 	// read out the contents from our temporary buffer, and return them
@@ -93,6 +214,40 @@ type Messenger struct {
 	// clients is the list of all known and alive clients. Maintaining a
 	// reference here will allow us to update status based on broadcasts.
 	clients ClientList
+
+	// flood limits how many chat messages are shown from each client,
+	// signalFlood how much other traffic such as typing and reactions is
+	// taken, and fileFlood how many file chunks and resume requests. They
+	// are nil, meaning no limit, unless set up by main.
+	flood       *floodGuard
+	signalFlood *floodGuard
+	fileFlood   *floodGuard
+
+	// history holds the chat messages sent and received so far.
+	history messageStore
+
+	// reactions holds the reactions to the messages in history.
+	reactions reactionStore
+
+	// typing tracks which clients are typing a message.
+	typing typingTracker
+
+	// deliveries follows the direct messages we sent until they are
+	// acknowledged, and acks holds the acknowledgements we owe.
+	deliveries deliveryTracker
+	acks       ackQueue
+
+	// seqs numbers the room messages we send and tracks those we have seen,
+	// and repairs holds the repair requests we sent for those we missed.
+	seqs    seqLog
+	repairs repairLog
+
+	// files holds the files we are sending and receiving.
+	files fileTransfers
+
+	// self and transport replace localAddress and smudge in tests.
+	self      NodeAddress
+	transport func(data []byte) error
 }
 
 // Decode converts the byte slice received from a broadcast into a usable
@@ -106,16 +261,214 @@ func (m *message) Decode(data []byte) error {
 	if err != nil {
 		return fmt.Errorf("Failed to decompress message: %s", err)
 	}
+	defer r.Close()
+
+	// The data comes from another client, so a few hundred bytes could
+	// decompress into something enormous. Read at most one byte more than we
+	// allow to find out whether the limit was crossed.
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, maxDecodedBytes+1))
+	if err != nil {
+		return fmt.Errorf("Failed to decompress message: %s", err)
+	}
+	if len(decompressed) > maxDecodedBytes {
+		return fmt.Errorf("Decompressed message is larger than %d bytes", maxDecodedBytes)
+	}
+	if bb.Len() > 0 {
+		return fmt.Errorf("Found %d bytes after the compressed message", bb.Len())
+	}
 
 	// msg is what the decompressed bytes will be un-json-marshalled into
-	err = json.NewDecoder(r).Decode(m)
+	dec := json.NewDecoder(bytes.NewReader(decompressed))
+	err = dec.Decode(m)
 	if err != nil {
 		return fmt.Errorf("Failed to decode message: %s", err)
 	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("Found trailing data after the message")
+	}
 
 	return nil
 }
 
+// validate checks that the message has the fields its Type requires. Decode
+// only checks that the message is well formed, so anything received from
+// another client must also be validated before it is used.
+func (m *message) validate() error {
+	if m.Author != "" {
+		if err := validateAddress(m.Author); err != nil {
+			return fmt.Errorf("message refers to a bad author: %s", err)
+		}
+	}
+	if m.Seq < 0 || m.Seq > 0 && m.Epoch <= 0 {
+		return fmt.Errorf("message has sequence number %d at epoch %d", m.Seq, m.Epoch)
+	}
+	if m.Origin != "" {
+		if err := validateAddress(m.Origin); err != nil {
+			return fmt.Errorf("message has a bad origin: %s", err)
+		}
+		// Only room messages and deletes are sent again, and edits never,
+		// since they would change a message on the word of another client.
+		switch m.Type {
+		case messageTypeRepairReq:
+		case messageTypeChat, messageTypeDelete:
+			if m.Seq == 0 || m.To != "" {
+				return fmt.Errorf("message sent again has no sequence number")
+			}
+		default:
+			return fmt.Errorf("%s sent again on behalf of another client", m.Type)
+		}
+	}
+
+	switch m.Type {
+	case messageTypeChat:
+		if strings.TrimSpace(m.Body) == "" {
+			return fmt.Errorf("chat message has no body")
+		}
+		if m.To != "" {
+			if err := validateAddress(m.To); err != nil {
+				return fmt.Errorf("direct message has a bad recipient: %s", err)
+			}
+		}
+		if m.ID != "" {
+			if err := validateMessageID(m.ID); err != nil {
+				return err
+			}
+		}
+		if m.ReplyTo != "" {
+			if err := validateMessageID(m.ReplyTo); err != nil {
+				return fmt.Errorf("reply to a bad message: %s", err)
+			}
+			if m.ReplyTo == m.ID {
+				return fmt.Errorf("message replies to itself")
+			}
+		}
+		if m.Auto && m.To == "" {
+			return fmt.Errorf("automatic reply has no recipient")
+		}
+	case messageTypeReaction:
+		if err := validateEmoji(m.Body); err != nil {
+			return err
+		}
+		if err := validateMessageID(m.Target); err != nil {
+			return fmt.Errorf("reaction to a bad message: %s", err)
+		}
+		if !m.Remove {
+			return validateMessageID(m.ID)
+		}
+		if len(m.Tags) == 0 || len(m.Tags) > maxRemovedTags {
+			return fmt.Errorf("reaction removal names %d tags", len(m.Tags))
+		}
+		for _, tag := range m.Tags {
+			if err := validateMessageID(tag); err != nil {
+				return err
+			}
+		}
+	case messageTypeEdit:
+		if strings.TrimSpace(m.Body) == "" {
+			return fmt.Errorf("edit has no body")
+		}
+		if m.Revision < 1 {
+			return fmt.Errorf("edit has revision %d", m.Revision)
+		}
+		if err := validateMessageID(m.Target); err != nil {
+			return fmt.Errorf("edit of a bad message: %s", err)
+		}
+	case messageTypeDelete:
+		if err := validateMessageID(m.Target); err != nil {
+			return fmt.Errorf("delete of a bad message: %s", err)
+		}
+	case messageTypeTyping:
+	case messageTypePresence:
+		if len(m.Presence) == 0 {
+			return fmt.Errorf("presence list is empty")
+		}
+	case messageTypeAck:
+		if err := validateAddress(m.To); err != nil {
+			return fmt.Errorf("acknowledgement has a bad recipient: %s", err)
+		}
+		if len(m.Acks) == 0 || len(m.Acks) > maxAcksPerMessage {
+			return fmt.Errorf("acknowledgement names %d messages", len(m.Acks))
+		}
+		for _, id := range m.Acks {
+			if err := validateMessageID(id); err != nil {
+				return err
+			}
+		}
+	case messageTypeDigest:
+		if len(m.Marks) == 0 {
+			return fmt.Errorf("digest is empty")
+		}
+	case messageTypeRepairReq:
+		if err := validateAddress(m.To); err != nil {
+			return fmt.Errorf("repair request has a bad recipient: %s", err)
+		}
+		if m.Origin == "" || m.Epoch <= 0 {
+			return fmt.Errorf("repair request does not say which messages it wants")
+		}
+	case messageTypeFileOffer:
+		if err := validateMessageID(m.File); err != nil {
+			return fmt.Errorf("file offer has a bad ID: %s", err)
+		}
+		if err := validateFileName(m.Body); err != nil {
+			return err
+		}
+		if m.Size < 1 || m.Size > maxFileSize {
+			return fmt.Errorf("file offer has size %d", m.Size)
+		}
+		if hash, err := base64.RawStdEncoding.DecodeString(m.Hash); err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("file offer has a bad hash")
+		}
+		if m.To != "" {
+			if err := validateAddress(m.To); err != nil {
+				return fmt.Errorf("file offer has a bad recipient: %s", err)
+			}
+		}
+	case messageTypeFileChunk:
+		if err := validateMessageID(m.File); err != nil {
+			return fmt.Errorf("file chunk has a bad ID: %s", err)
+		}
+		if m.Chunk < 1 || len(m.Data) == 0 || len(m.Data) > fileChunkSize {
+			return fmt.Errorf("file chunk %d has %d bytes", m.Chunk, len(m.Data))
+		}
+	case messageTypeFileReq:
+		if err := validateAddress(m.To); err != nil {
+			return fmt.Errorf("file request has a bad recipient: %s", err)
+		}
+		if err := validateMessageID(m.File); err != nil {
+			return fmt.Errorf("file request has a bad ID: %s", err)
+		}
+		if len(m.Missing) == 0 || len(m.Missing) > maxMissingPerRequest {
+			return fmt.Errorf("file request names %d chunks", len(m.Missing))
+		}
+	case messageTypeLeave:
+		if utf8.RuneCountInString(m.Body) > maxReasonLength {
+			return fmt.Errorf("leave reason is longer than %d characters", maxReasonLength)
+		}
+	case messageTypeUsernames:
+		if len(m.Usernames) == 0 {
+			return fmt.Errorf("username list is empty")
+		}
+	case messageTypeUsernameReq:
+		if err := validateAddress(NodeAddress(m.Body)); err != nil {
+			return fmt.Errorf("username request has a bad address: %s", err)
+		}
+	default:
+		return fmt.Errorf("unknown message type %d", m.Type)
+	}
+	return nil
+}
+
+// said reports whether the message comes from something a user did, as
+// opposed to one which keeps the cluster running.
+func (m *message) said() bool {
+	switch m.Type {
+	case messageTypeChat, messageTypeReaction, messageTypeEdit, messageTypeDelete, messageTypeTyping,
+		messageTypeFileOffer:
+		return true
+	}
+	return false
+}
+
 // OnBroadcast is the only method defined on the smudge.BroadcastListener
 // interface. By implementing this method on the Messenger struct, that struct
 // will satisfy the interface and we can register it with smudge.
@@ -123,31 +476,87 @@ func (m *message) Decode(data []byte) error {
 // When another node in the gossip cluster sends a broadcast message, this
 // function will be called.
 func (m *Messenger) OnBroadcast(b *smudge.Broadcast) {
-	senderAddr := NodeAddress(b.Origin().Address())
+	m.receive(NodeAddress(b.Origin().Address()), b.Bytes())
+}
 
-	printDebug("Received %d bytes", len(b.Bytes()))
+// receive handles the bytes of a broadcast sent by senderAddr. It is separate
+// from OnBroadcast so it can be tested without a smudge.Broadcast, which
+// cannot be created outside of smudge.
+func (m *Messenger) receive(senderAddr NodeAddress, data []byte) {
+	logDebug("Received a broadcast", "from", senderAddr, "bytes", len(data))
 	var msg message
-	err := msg.Decode(b.Bytes())
+	reason := "key"
+	data, keyID, err := unseal(data)
+	if err == nil {
+		reason = "decode"
+		err = msg.Decode(data)
+	}
+	if err == nil {
+		reason = "invalid"
+		err = msg.validate()
+	}
 	if err != nil {
-		printError("Failed to receive message from %s: %s", senderAddr, err)
+		rejectedMessages.Inc(string(senderAddr))
+		decodeFailures.Inc(reason)
+		logWarn("Failed to receive a message", "from", senderAddr, "err", err)
+		return
+	}
+	receivedMessages.Inc(msg.Type.String())
+
+	// A message sent again on behalf of another client fills a gap in that
+	// client's messages, but only when it answers a repair request we sent,
+	// and it is still only as trustworthy as the client which sent it again.
+	origin := senderAddr
+	relayed := msg.Origin != "" && msg.Type != messageTypeRepairReq
+	if relayed {
+		origin = msg.Origin
+		if !m.repairs.Answers(senderAddr, origin, msg.Epoch, msg.Seq, time.Now()) {
+			rejectedMessages.Inc(string(senderAddr))
+			logWarn("Ignoring a message sent again which we did not ask for", "from", senderAddr, "origin", origin)
+			return
+		}
+	}
+
+	m.clients.touch(senderAddr, msg.Version, msg.said() && !relayed, time.Now())
+	if m.clients.sawKey(senderAddr, keyID) {
+		c, _ := m.clients.get(senderAddr)
+		systemEvents.Add(systemEvent{kind: eventKeyChange, addr: senderAddr, name: c.GetName(), detail: keyID})
+	}
+	recentOrigins.Add(senderAddr, time.Now())
+
+	// Ignored clients still take part in the cluster, so only what they
+	// say is dropped, including what they send again for others.
+	if msg.said() && (ignored.Has(clientIdentity(senderAddr)) || ignored.Has(clientIdentity(origin))) {
 		return
 	}
 
 	switch msg.Type {
 	case messageTypeUsernames:
-		printDebug("Received a broadcast containing usernames")
+		logDebug("Received usernames", "from", senderAddr)
 
-		if msg.Usernames == nil || len(msg.Usernames) == 0 {
-			printError("Received an empty username list")
+		usernames, problems := sanitizeUsernames(msg.Usernames)
+		for _, problem := range problems {
+			logWarn("Ignoring part of a username list", "from", senderAddr, "problem", problem)
+		}
+		if len(usernames) == 0 {
 			return
 		}
 
-		err := m.clients.AddUsernames(msg.Usernames)
+		before := m.clients.usernames(usernames)
+		clientsMu.Lock()
+		err := m.clients.AddUsernames(usernames)
+		clientsMu.Unlock()
 		if err != nil {
-			printError("Failed to process received usernames: %s", err)
+			logError("Failed to process received usernames", "from", senderAddr, "err", err)
+		}
+		for addr, old := range before {
+			c, _ := m.clients.get(addr)
+			if name := c.username; old != "" && name != old {
+				systemEvents.Add(systemEvent{kind: eventRename, addr: addr, name: old, detail: name})
+			}
 		}
 	case messageTypeUsernameReq:
-		printDebug("Received a broadcast requesting %s send usernames, my localAddress is %s", msg.Body, localAddress)
+		logDebug("Received a username request", "from", senderAddr, "for", msg.Body)
 
 		if msg.Body == string(localAddress) {
 			// The request targeted us...
@@ -155,35 +564,323 @@ func (m *Messenger) OnBroadcast(b *smudge.Broadcast) {
 			// for a new client.
 			err := m.clients.BroadcastUsernames()
 			if err == nil {
-				printInfo("Successfully broadcast usernames to the group")
+				logInfo("Broadcast our usernames to the group")
 			} else {
-				printError("Tried to broadcast usernames but failed: %s", err)
+				logError("Failed to broadcast usernames", "err", err)
+			}
+			if err := m.clients.BroadcastPresence(); err != nil {
+				logError("Failed to broadcast presences", "err", err)
 			}
 		}
 	case messageTypeChat:
 		// Received a chat message
 
-		sender := m.clients[senderAddr]
-		printChatMessage(msg.Body, sender.GetName())
+		if msg.To != "" && msg.To != localAddress {
+			return
+		}
+		if msg.ID == "" {
+			// Sent by an older client, so nobody else can refer to it.
+			msg.ID = newMessageID()
+		}
+		if m.history.Has(origin, msg.ID) || relayed && m.history.Has(senderAddr, msg.ID) {
+			if msg.Seq > 0 {
+				m.seqs.Saw(origin, msg.Epoch, msg.Seq, msg.ID)
+			}
+			if msg.To == localAddress {
+				// The sender is trying again, so our acknowledgement
+				// was probably lost.
+				m.acks.Add(senderAddr, msg.ID, false)
+			}
+			return
+		}
+		if m.flood != nil && !m.flood.Allow(senderAddr) {
+			return
+		}
+		if relayed {
+			m.receiveRelayed(senderAddr, msg)
+			return
+		}
+
+		m.typing.Stop(origin)
+		printStatusBar()
+
+		sender, _ := m.clients.get(origin)
+		if msg.Auto {
+			// Automatic replies are not part of the conversation.
+			printNotice(fmt.Sprintf("Automatic reply from %s: %s", sanitizeLine(sender.GetName()),
+				sanitizeLine(msg.Body)))
+			return
+		}
+		if msg.To == localAddress {
+			m.acks.Add(senderAddr, msg.ID, false)
+			m.autoReply(senderAddr)
+		}
+
+		label, channel := sender.GetName(), roomChannel
+		msg.ReplyTo = m.resolveRef(msg.Author, msg.ReplyTo)
+		if msg.To == localAddress {
+			label = "[DM] " + label
+			channel = m.dmChannel(origin)
+		}
+		m.record(chatMessage{
+			ID:       msg.ID,
+			From:     origin,
+			Sender:   sender.GetName(),
+			Label:    label,
+			Channel:  channel,
+			To:       msg.To,
+			Body:     msg.Body,
+			ReplyTo:  msg.ReplyTo,
+			Time:     time.Now(),
+			Revision: msg.Revision,
+			Edited:   msg.Revision > 0,
+		})
+		if msg.Seq > 0 {
+			m.seqs.Saw(origin, msg.Epoch, msg.Seq, msg.ID)
+		}
+	case messageTypeReaction:
+		if m.signalFlood != nil && !m.signalFlood.Allow(senderAddr) {
+			return
+		}
+		m.receiveReaction(senderAddr, msg)
+	case messageTypeEdit, messageTypeDelete:
+		if m.signalFlood != nil && !m.signalFlood.Allow(senderAddr) {
+			return
+		}
+		if relayed {
+			// A deleted message sent again only fills its gap. Whether
+			// it was really deleted is for its sender to say.
+			m.seqs.Saw(origin, msg.Epoch, msg.Seq, msg.Target)
+			return
+		}
+		m.receiveChange(origin, msg)
+	case messageTypeTyping:
+		if m.signalFlood != nil && !m.signalFlood.Allow(senderAddr) {
+			return
+		}
+		m.receiveTyping(senderAddr)
+	case messageTypePresence:
+		m.receivePresence(senderAddr, msg.Presence)
+	case messageTypeAck:
+		m.receiveAck(senderAddr, msg)
+	case messageTypeDigest:
+		if m.signalFlood != nil && !m.signalFlood.Allow(senderAddr) {
+			return
+		}
+		m.receiveDigest(senderAddr, msg.Marks)
+	case messageTypeRepairReq:
+		if m.signalFlood != nil && !m.signalFlood.Allow(senderAddr) {
+			return
+		}
+		m.receiveRepairReq(msg)
+	case messageTypeFileOffer:
+		if m.flood != nil && !m.flood.Allow(senderAddr) {
+			return
+		}
+		m.receiveFileOffer(senderAddr, msg)
+	case messageTypeFileChunk:
+		if m.fileFlood != nil && !m.fileFlood.Allow(senderAddr) {
+			return
+		}
+		m.receiveFileChunk(senderAddr, msg)
+	case messageTypeFileReq:
+		if m.fileFlood != nil && !m.fileFlood.Allow(senderAddr) {
+			return
+		}
+		if msg.To == m.address() {
+			m.files.Resend(msg.File, senderAddr, msg.Missing)
+		}
+	case messageTypeLeave:
+		m.receiveLeave(senderAddr, msg.Body)
+	}
+}
+
+// resolveRef returns the ID under which we store the message a reply or
+// reaction refers to by id, sent by author. Older clients do not say who the
+// author is, so the message stored under id is taken.
+func (m *Messenger) resolveRef(author NodeAddress, id string) string {
+	if author == "" || id == "" {
+		return id
+	}
+	if author == m.address() {
+		author = localAddress
+	}
+	return m.history.Resolve(author, id)
+}
+
+// wireAuthor returns the address other clients know the sender of a stored
+// message by. Our own messages are stored as coming from localAddress.
+func (m *Messenger) wireAuthor(from NodeAddress) NodeAddress {
+	if from == localAddress {
+		return m.address()
+	}
+	return from
+}
+
+// record adds a chat message to the history and shows it. Replies which
+// arrived before it are redrawn with it as their parent.
+func (m *Messenger) record(msg chatMessage) {
+	if !m.history.Add(msg) {
+		return
+	}
+	msg.ID = m.history.Resolve(msg.From, msg.ID)
+	m.reactions.Arrived(msg.ID)
+	m.forgetEvicted()
+	printChatMessage(msg)
+	if m.history.HasReplies(msg.ID) {
+		refreshMessages()
+	}
+}
+
+// forgetEvicted drops what refers to the messages the history forgot to
+// stay within its limit.
+func (m *Messenger) forgetEvicted() {
+	for _, evicted := range m.history.TakeEvicted() {
+		m.reactions.Forget(evicted.id)
+		m.seqs.Forget(evicted.wireID)
+		if evicted.from == localAddress {
+			m.deliveries.Forget(evicted.wireID)
+		}
 	}
 }
 
 // SendMessage takes a chat message to be sent and broadcasts it to the cluster
 // and posts to the local chat view.
-func SendMessage(text string) error {
-	text = strings.TrimSpace(text)
-	if text == "" {
+func (m *Messenger) SendMessage(text string) error {
+	return m.send(message{Type: messageTypeChat, Body: text}, localUsername)
+}
+
+// SendDirectMessage broadcasts a chat message which only the client at to will
+// display. The broadcast still travels through the whole cluster, so a direct
+// message is hidden from other clients rather than private.
+func (m *Messenger) SendDirectMessage(to NodeAddress, name, text string) error {
+	msg := message{Type: messageTypeChat, Body: text, To: to}
+	return m.send(msg, fmt.Sprintf("[DM to %s] %s", name, localUsername))
+}
+
+// SendReply sends a reply to parent. A reply to a direct message is a direct
+// message too.
+func (m *Messenger) SendReply(parent chatMessage, text string) error {
+	msg := message{Type: messageTypeChat, Body: text, ReplyTo: parent.ID, Author: m.wireAuthor(parent.From)}
+	label := localUsername
+
+	to, name := parent.To, ""
+	if parent.To == localAddress {
+		to, name = parent.From, parent.Sender
+	} else if to != "" {
+		target, _ := m.clients.get(to)
+		name = target.GetName()
+	}
+	if to != "" {
+		msg.To = to
+		label = fmt.Sprintf("[DM to %s] %s", name, localUsername)
+	}
+	return m.send(msg, label)
+}
+
+// send shows a chat message we wrote under the given label and broadcasts it.
+func (m *Messenger) send(msg message, label string) error {
+	msg.Body = strings.TrimSpace(msg.Body)
+	if msg.Body == "" {
 		return nil
 	}
 
+	if err := checkSendLimit(); err != nil {
+		return err
+	}
+
+	msg.ID = newMessageID()
+	msg.Version = clientVersion
+	if msg.To != "" {
+		m.deliveries.Sent(msg, time.Now())
+	} else {
+		msg.Epoch, msg.Seq = sessionEpoch, m.seqs.Next()
+	}
+
+	channel := roomChannel
+	if msg.To != "" {
+		channel = m.dmChannel(msg.To)
+	}
+
 	// First let's make the message show up in our own chat history
-	printChatMessage(text, localUsername)
+	m.record(chatMessage{
+		ID:      msg.ID,
+		From:    localAddress,
+		Sender:  localUsername,
+		Label:   label,
+		Channel: channel,
+		To:      msg.To,
+		Body:    msg.Body,
+		ReplyTo: msg.ReplyTo,
+		Time:    time.Now(),
+	})
 
-	// Now we can send it on to others
-	msg := message{
-		Type: messageTypeChat,
-		Body: text,
+	if msg.Seq > 0 {
+		m.seqs.Saw(m.address(), msg.Epoch, msg.Seq, msg.ID)
+	}
+
+	// Now we can send it on to others, who know the parent by the ID its
+	// sender gave it.
+	if msg.ReplyTo != "" {
+		msg.ReplyTo = m.history.WireID(msg.ReplyTo)
+	}
+	return m.broadcast(&msg)
+}
+
+// roomChannel is the channel of messages sent to everyone.
+const roomChannel = "room"
+
+// dmChannel returns the channel of direct messages with the client at addr.
+func (m *Messenger) dmChannel(addr NodeAddress) string {
+	c, _ := m.clients.get(addr)
+	if name := c.GetName(); name != "" {
+		return "@" + name
+	}
+	return "@" + string(addr)
+}
+
+// broadcast encodes msg, seals it with the cluster key if there is one, and
+// sends it to the cluster.
+func broadcast(msg *message) error {
+	data, err := seal(msg.Encode())
+	if err != nil {
+		return err
 	}
+	if len(data) > smudge.GetMaxBroadcastBytes() {
+		oversizedBroadcasts.Inc(msg.Type.String())
+	}
+	if err := smudge.BroadcastBytes(data); err != nil {
+		return err
+	}
+	sentMessages.Inc(msg.Type.String())
+	recentOrigins.Add(localAddress, time.Now())
+	return nil
+}
+
+// mentions reports whether text contains name as a whole word, ignoring case.
+func mentions(text, name string) bool {
+	if name == "" {
+		return false
+	}
+
+	text, name = strings.ToLower(text), strings.ToLower(name)
+	for i := strings.Index(text, name); i >= 0; {
+		end := i + len(name)
+		if (i == 0 || !isWordByte(text[i-1])) && (end == len(text) || !isWordByte(text[end])) {
+			return true
+		}
+
+		next := strings.Index(text[i+1:], name)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
 
-	return smudge.BroadcastBytes(msg.Encode())
+// isWordByte reports whether b can be part of a username.
+func isWordByte(b byte) bool {
+	return b == '_' || b == '-' || b >= '0' && b <= '9' ||
+		b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
 }
@@ -1,45 +1,52 @@
 package main
 
 import (
+	"bytes"
+	"compress/zlib"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
-func TestMessageEncodeDecode(t *testing.T) {
-	var cases = []struct {
-		message        message
-		expectedResult []byte
-	}{
-		{ // When all the fields are empty
-			message:        message{},
-			expectedResult: []byte{0x78, 0x9c, 0xaa, 0x56, 0x2a, 0xa9, 0x2c, 0x48, 0x55, 0xb2, 0x32, 0xd0, 0x51, 0x4a, 0xca, 0x4f, 0xa9, 0x54, 0xb2, 0x52, 0x52, 0xd2, 0x51, 0x2a, 0x2d, 0x4e, 0x2d, 0xca, 0x4b, 0xcc, 0x4d, 0x2d, 0x56, 0xb2, 0xca, 0x2b, 0xcd, 0xc9, 0xa9, 0xe5, 0x2, 0x4, 0x0, 0x0, 0xff, 0xff, 0xe8, 0xed, 0xc, 0x47},
+// messageVectors are messages together with their encoded form. They are also
+// the seed corpus for the fuzz tests.
+var messageVectors = []struct {
+	message        message
+	expectedResult []byte
+}{
+	{ // When all the fields are empty
+		message:        message{},
+		expectedResult: []byte{0x78, 0x9c, 0xaa, 0x56, 0x2a, 0xa9, 0x2c, 0x48, 0x55, 0xb2, 0x32, 0xd0, 0x51, 0x4a, 0xca, 0x4f, 0xa9, 0x54, 0xb2, 0x52, 0x52, 0xd2, 0x51, 0x2a, 0x2d, 0x4e, 0x2d, 0xca, 0x4b, 0xcc, 0x4d, 0x2d, 0x56, 0xb2, 0xca, 0x2b, 0xcd, 0xc9, 0xa9, 0xe5, 0x2, 0x4, 0x0, 0x0, 0xff, 0xff, 0xe8, 0xed, 0xc, 0x47},
+	},
+	{ // When the message is a chat
+		message: message{
+			Type: messageTypeChat,
+			Body: "Hello World",
 		},
-		{ // When the message is a chat
-			message: message{
-				Type: messageTypeChat,
-				Body: "Hello World",
+		expectedResult: []byte{0x78, 0x9c, 0xaa, 0x56, 0x2a, 0xa9, 0x2c, 0x48, 0x55, 0xb2, 0x32, 0xd4, 0x51, 0x4a, 0xca, 0x4f, 0xa9, 0x54, 0xb2, 0x52, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x57, 0x8, 0xcf, 0x2f, 0xca, 0x49, 0x51, 0xd2, 0x51, 0x2a, 0x2d, 0x4e, 0x2d, 0xca, 0x4b, 0xcc, 0x4d, 0x2d, 0x56, 0xb2, 0xca, 0x2b, 0xcd, 0xc9, 0xa9, 0xe5, 0x2, 0x4, 0x0, 0x0, 0xff, 0xff, 0x8e, 0xb7, 0x10, 0x64},
+	},
+	{ // When the message is a username update
+		message: message{
+			Type: messageTypeUsernames,
+			Usernames: map[NodeAddress]string{
+				NodeAddress("192.168.0.10:9999"): "Server-1",
+				NodeAddress("172.16.0.17:9999"):  "Server-2",
 			},
-			expectedResult: []byte{0x78, 0x9c, 0xaa, 0x56, 0x2a, 0xa9, 0x2c, 0x48, 0x55, 0xb2, 0x32, 0xd4, 0x51, 0x4a, 0xca, 0x4f, 0xa9, 0x54, 0xb2, 0x52, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x57, 0x8, 0xcf, 0x2f, 0xca, 0x49, 0x51, 0xd2, 0x51, 0x2a, 0x2d, 0x4e, 0x2d, 0xca, 0x4b, 0xcc, 0x4d, 0x2d, 0x56, 0xb2, 0xca, 0x2b, 0xcd, 0xc9, 0xa9, 0xe5, 0x2, 0x4, 0x0, 0x0, 0xff, 0xff, 0x8e, 0xb7, 0x10, 0x64},
 		},
-		{ // When the message is a username update
-			message: message{
-				Type: messageTypeUsernames,
-				Usernames: map[NodeAddress]string{
-					NodeAddress("192.168.0.10:9999"): "Server-1",
-					NodeAddress("172.16.0.17:9999"):  "Server-2",
-				},
-			},
-			expectedResult: []byte{0x78, 0x9c, 0x5c, 0xc9, 0x3d, 0xe, 0x85, 0x20, 0xc, 0x7, 0xf0, 0xfd, 0x1d, 0xe3, 0x3f, 0xf3, 0x8, 0x65, 0x10, 0xdb, 0x6b, 0x78, 0x2, 0x8d, 0x1d, 0xfd, 0x48, 0x51, 0x13, 0x42, 0xb8, 0xbb, 0x61, 0x75, 0xfe, 0x55, 0x5c, 0xe5, 0x54, 0x48, 0x74, 0x58, 0x8e, 0xb5, 0x40, 0x0, 0x87, 0x3b, 0xab, 0xed, 0xf3, 0xa6, 0x19, 0x52, 0x41, 0x29, 0x7a, 0x1a, 0x7c, 0xf0, 0x94, 0x84, 0x99, 0x19, 0x82, 0x49, 0xed, 0x51, 0xfb, 0x47, 0x38, 0x10, 0x77, 0x1d, 0x3b, 0x87, 0xf, 0x13, 0x5a, 0xfb, 0xbd, 0x1, 0x0, 0x0, 0xff, 0xff, 0x9, 0x36, 0x19, 0x96},
+		expectedResult: []byte{0x78, 0x9c, 0x5c, 0xc9, 0x3d, 0xe, 0x85, 0x20, 0xc, 0x7, 0xf0, 0xfd, 0x1d, 0xe3, 0x3f, 0xf3, 0x8, 0x65, 0x10, 0xdb, 0x6b, 0x78, 0x2, 0x8d, 0x1d, 0xfd, 0x48, 0x51, 0x13, 0x42, 0xb8, 0xbb, 0x61, 0x75, 0xfe, 0x55, 0x5c, 0xe5, 0x54, 0x48, 0x74, 0x58, 0x8e, 0xb5, 0x40, 0x0, 0x87, 0x3b, 0xab, 0xed, 0xf3, 0xa6, 0x19, 0x52, 0x41, 0x29, 0x7a, 0x1a, 0x7c, 0xf0, 0x94, 0x84, 0x99, 0x19, 0x82, 0x49, 0xed, 0x51, 0xfb, 0x47, 0x38, 0x10, 0x77, 0x1d, 0x3b, 0x87, 0xf, 0x13, 0x5a, 0xfb, 0xbd, 0x1, 0x0, 0x0, 0xff, 0xff, 0x9, 0x36, 0x19, 0x96},
+	},
+	{ // When the message is a username request
+		message: message{
+			Type: messageTypeUsernameReq,
+			Body: "192.168.0.32:9876",
 		},
-		{ // When the message is a username request
-			message: message{
-				Type: messageTypeUsernameReq,
-				Body: "192.168.0.32:9876",
-			},
-			expectedResult: []byte{0x78, 0x9c, 0xaa, 0x56, 0x2a, 0xa9, 0x2c, 0x48, 0x55, 0xb2, 0x32, 0xd6, 0x51, 0x4a, 0xca, 0x4f, 0xa9, 0x54, 0xb2, 0x52, 0x32, 0xb4, 0x34, 0xd2, 0x33, 0x34, 0xb3, 0xd0, 0x33, 0xd0, 0x33, 0x36, 0xb2, 0xb2, 0xb4, 0x30, 0x37, 0x53, 0xd2, 0x51, 0x2a, 0x2d, 0x4e, 0x2d, 0xca, 0x4b, 0xcc, 0x4d, 0x2d, 0x56, 0xb2, 0xca, 0x2b, 0xcd, 0xc9, 0xa9, 0xe5, 0x2, 0x4, 0x0, 0x0, 0xff, 0xff, 0xa8, 0xb6, 0xf, 0xbc},
-		},
-	}
+		expectedResult: []byte{0x78, 0x9c, 0xaa, 0x56, 0x2a, 0xa9, 0x2c, 0x48, 0x55, 0xb2, 0x32, 0xd6, 0x51, 0x4a, 0xca, 0x4f, 0xa9, 0x54, 0xb2, 0x52, 0x32, 0xb4, 0x34, 0xd2, 0x33, 0x34, 0xb3, 0xd0, 0x33, 0xd0, 0x33, 0x36, 0xb2, 0xb2, 0xb4, 0x30, 0x37, 0x53, 0xd2, 0x51, 0x2a, 0x2d, 0x4e, 0x2d, 0xca, 0x4b, 0xcc, 0x4d, 0x2d, 0x56, 0xb2, 0xca, 0x2b, 0xcd, 0xc9, 0xa9, 0xe5, 0x2, 0x4, 0x0, 0x0, 0xff, 0xff, 0xa8, 0xb6, 0xf, 0xbc},
+	},
+}
+
+func TestMessageEncodeDecode(t *testing.T) {
+	cases := messageVectors
 
 	for i, c := range cases {
 		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
@@ -57,3 +64,175 @@ func TestMessageEncodeDecode(t *testing.T) {
 		})
 	}
 }
+
+func TestMentions(t *testing.T) {
+	var cases = []struct {
+		text           string
+		name           string
+		expectedResult bool
+	}{
+		{"hey alice, lunch?", "alice", true},
+		{"HEY ALICE", "alice", true},
+		{"malice aforethought", "alice", false},
+		{"alice-bot is down, ping alice", "alice", true},
+		{"nothing to see", "alice", false},
+		{"anything", "", false},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			result := mentions(c.text, c.name)
+			if result != c.expectedResult {
+				t.Fatalf("Expected %v but got %v", c.expectedResult, result)
+			}
+		})
+	}
+}
+
+// compress zlib-compresses data without any JSON encoding, so tests can build
+// malformed messages.
+func compress(data []byte) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func TestDecodeVectors(t *testing.T) {
+	for i, c := range messageVectors {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			var msg message
+			err := msg.Decode(c.expectedResult)
+			CheckNoError(t, err)
+			if !reflect.DeepEqual(msg, c.message) {
+				t.Fatalf("Expected %#v but got %#v", c.message, msg)
+			}
+		})
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	valid := messageVectors[1].message
+	encoded := valid.Encode()
+
+	var cases = []struct {
+		name string
+		data []byte
+	}{
+		{"not compressed", []byte(`{"type":1,"body":"hi"}`)},
+		{"truncated", encoded[:len(encoded)-4]},
+		{"trailing bytes", append(append([]byte{}, encoded...), 0x00, 0x01)},
+		{"trailing json", compress([]byte(`{"type":1,"body":"hi"} {"type":1}`))},
+		{"not json", compress([]byte("hello"))},
+		{"decompression bomb", compress([]byte(`{"type":1,"body":"` + strings.Repeat("a", maxDecodedBytes) + `"}`))},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var msg message
+			if err := msg.Decode(c.data); err == nil {
+				t.Fatalf("Expected an error but decoded %#v", msg)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var cases = []struct {
+		message     message
+		expectError bool
+	}{
+		{message{Type: messageTypeChat, Body: "Hello World"}, false},
+		{message{Type: messageTypeChat, Body: "hi", To: "192.168.0.10:9999"}, false},
+		{message{Type: messageTypeChat, Body: "  "}, true},
+		{message{Type: messageTypeChat, Body: "hi", To: "nobody"}, true},
+		{message{Type: messageTypeChat, Body: "hi", ID: "abcd-_12", ReplyTo: "ABCDEFGH"}, false},
+		{message{Type: messageTypeChat, Body: "hi", ID: "short"}, true},
+		{message{Type: messageTypeChat, Body: "hi", ReplyTo: "abc\x1bdefg"}, true},
+		{message{Type: messageTypeChat, Body: "hi", ID: "ABCDEFGH", ReplyTo: "ABCDEFGH"}, true},
+		{message{Type: messageTypeEdit, Body: "fixed", Target: "abcd-_12", Revision: 1}, false},
+		{message{Type: messageTypeEdit, Body: "fixed", Target: "abcd-_12"}, true},
+		{message{Type: messageTypeEdit, Body: " ", Target: "abcd-_12", Revision: 1}, true},
+		{message{Type: messageTypeDelete, Target: "abcd-_12"}, false},
+		{message{Type: messageTypeDelete}, true},
+		{message{Type: messageTypeChat, Body: "away", To: "192.168.0.10:9999", Auto: true}, false},
+		{message{Type: messageTypeChat, Body: "away", Auto: true}, true},
+		{message{Type: messageTypePresence, Presence: map[NodeAddress]presence{"192.168.0.10:9999": {State: "away", Version: 1}}}, false},
+		{message{Type: messageTypePresence}, true},
+		{message{Type: messageTypeAck, To: "192.168.0.10:9999", Acks: []string{"abcd-_12"}}, false},
+		{message{Type: messageTypeAck, Acks: []string{"abcd-_12"}}, true},
+		{message{Type: messageTypeAck, To: "192.168.0.10:9999"}, true},
+		{message{Type: messageTypeChat, Body: "hi", Origin: "192.168.0.10:9999", Epoch: 1, Seq: 3}, false},
+		{message{Type: messageTypeChat, Body: "hi", Origin: "192.168.0.10:9999"}, true},
+		{message{Type: messageTypeChat, Body: "hi", Seq: 3}, true},
+		{message{Type: messageTypeEdit, Target: "abcd-_12", Body: "hi", Origin: "192.168.0.10:9999", Epoch: 1, Seq: 3}, true},
+		{message{Type: messageTypeReaction, Target: "abcd-_12", Body: "+1", Origin: "192.168.0.10:9999"}, true},
+		{message{Type: messageTypeDigest, Marks: map[NodeAddress]highWater{"192.168.0.10:9999": {Epoch: 1, Seq: 3}}}, false},
+		{message{Type: messageTypeDigest}, true},
+		{message{Type: messageTypeRepairReq, To: "192.168.0.11:9999", Origin: "192.168.0.10:9999", Epoch: 1}, false},
+		{message{Type: messageTypeRepairReq, To: "192.168.0.11:9999"}, true},
+		{message{Type: messageTypeUsernames, Usernames: map[NodeAddress]string{"192.168.0.10:9999": "a"}}, false},
+		{message{Type: messageTypeUsernames}, true},
+		{message{Type: messageTypeUsernameReq, Body: "192.168.0.32:9876"}, false},
+		{message{Type: messageTypeUsernameReq, Body: "me"}, true},
+		{message{}, true},
+		{message{Type: 99, Body: "hi"}, true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			err := c.message.validate()
+			if c.expectError && err == nil {
+				t.Fatalf("Expected an error for %#v", c.message)
+			}
+			if !c.expectError {
+				CheckNoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReceiveCountsRejected(t *testing.T) {
+	sender := NodeAddress("192.168.0.77:9999")
+	m := Messenger{clients: ClientList{}}
+
+	m.receive(sender, []byte("garbage"))
+	unknown := message{Type: 99, Body: "hi"}
+	m.receive(sender, unknown.Encode())
+	if count := rejectedMessages.Get(string(sender)); count != 2 {
+		t.Fatalf("Expected 2 rejected messages but got %d", count)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, c := range messageVectors {
+		f.Add(c.expectedResult)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg message
+		if msg.Decode(data) != nil {
+			return
+		}
+		if msg.validate() != nil {
+			return
+		}
+
+		// Anything we accept must be fit to show.
+		if msg.Type == messageTypeChat && strings.TrimSpace(msg.Body) == "" {
+			t.Fatalf("Accepted a chat message without a body: %#v", msg)
+		}
+	})
+}
+
+func FuzzReceive(f *testing.F) {
+	for _, c := range messageVectors {
+		f.Add(c.expectedResult)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := Messenger{clients: ClientList{}}
+		m.receive(NodeAddress("192.168.0.10:9999"), data)
+	})
+}
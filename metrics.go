@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+// maxAddressLabels is how many addresses a metric labelled by address keeps
+// apart. Addresses are chosen by whoever sends us something, so past this
+// they are all counted under otherLabel rather than growing the metrics
+// without end.
+const maxAddressLabels = 256
+
+// otherLabel is the label of the addresses past maxAddressLabels.
+const otherLabel = "other"
+
+// counterVec is a set of counters told apart by a label, such as the address
+// of the client a message came from. It is safe to use from several
+// goroutines.
+type counterVec struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+
+	// limit is how many labels are kept apart, or zero for no limit.
+	limit int
+}
+
+// newCounterVec creates an empty counterVec.
+func newCounterVec() *counterVec {
+	return &counterVec{counts: make(map[string]uint64)}
+}
+
+// newAddressCounterVec creates an empty counterVec labelled by address, which
+// keeps at most maxAddressLabels apart.
+func newAddressCounterVec() *counterVec {
+	return &counterVec{counts: make(map[string]uint64), limit: maxAddressLabels}
+}
+
+// Inc adds one to the counter for label.
+func (c *counterVec) Inc(label string) {
+	c.mu.Lock()
+	if _, ok := c.counts[label]; !ok && c.limit > 0 && len(c.counts) >= c.limit {
+		label = otherLabel
+	}
+	c.counts[label]++
+	c.mu.Unlock()
+}
+
+// Get returns the counter for label.
+func (c *counterVec) Get(label string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[label]
+}
+
+// Labels returns every label which has been counted, sorted.
+func (c *counterVec) Labels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	labels := make([]string, 0, len(c.counts))
+	for label := range c.counts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// rejectedMessages counts, for each sender address, the broadcasts which failed
+// cluster key authentication, could not be decoded or failed validation.
+var rejectedMessages = newAddressCounterVec()
+
+// rateLimitDrops counts, for each sender address, the chat messages which were
+// not shown because the sender went over the receive limit.
+var rateLimitDrops = newAddressCounterVec()
+
+// sentMessages and receivedMessages count the messages we broadcast and the
+// ones we accepted, by type.
+var (
+	sentMessages     = newCounterVec()
+	receivedMessages = newCounterVec()
+)
+
+// decodeFailures counts the broadcasts we could not read, by why: "key" when
+// they failed cluster key authentication, "decode" when they were not a
+// message, and "invalid" when they failed validation.
+var decodeFailures = newCounterVec()
+
+// oversizedBroadcasts counts, by type, the messages smudge refused to send
+// because they were over its broadcast size limit.
+var oversizedBroadcasts = newCounterVec()
+
+// usernameRequests counts the username requests sent by FillMissingInfo, by
+// whether they were "sent" or "failed".
+var usernameRequests = newCounterVec()
+
+// fileStalls counts the times chunks of a shared file stopped arriving, so the
+// missing ones were asked for again. Chat messages are never split up, so
+// these are the only reassemblies which can time out.
+var fileStalls = newAddressCounterVec()
+
+// pingBuckets are the upper bounds, in milliseconds, of the buckets of the
+// ping histogram.
+var pingBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500}
+
+// pingMillis holds the round-trip times of smudge pings, by node address.
+var pingMillis = newHistogramVec(pingBuckets, maxAddressLabels)
+
+// histogram counts observations into buckets with upper bounds, as well as
+// their number and sum.
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// histogramVec is a set of histograms with the same buckets, told apart by a
+// label. It is safe to use from several goroutines.
+type histogramVec struct {
+	mu     sync.Mutex
+	bounds []float64
+	series map[string]*histogram
+
+	// limit is how many labels are kept apart, or zero for no limit.
+	limit int
+}
+
+// newHistogramVec creates an empty histogramVec with the given bucket upper
+// bounds, which must be sorted. Past limit labels, if limit is not zero, the
+// rest are observed under otherLabel.
+func newHistogramVec(bounds []float64, limit int) *histogramVec {
+	return &histogramVec{bounds: bounds, series: make(map[string]*histogram), limit: limit}
+}
+
+// Observe adds v to the histogram for label.
+func (h *histogramVec) Observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.series[label]; !ok && h.limit > 0 && len(h.series) >= h.limit {
+		label = otherLabel
+	}
+	s, ok := h.series[label]
+	if !ok {
+		s = &histogram{buckets: make([]uint64, len(h.bounds))}
+		h.series[label] = s
+	}
+	for i, bound := range h.bounds {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// escapeLabel escapes a label value for the text exposition format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatFloat writes a sample value the way Prometheus reads it.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeCounterVec writes c as the counter name, with label set to each of
+// its labels.
+func writeCounterVec(w io.Writer, name, help, label string, c *counterVec) {
+	writeHeader(w, name, "counter", help)
+	for _, value := range c.Labels() {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(value), c.Get(value))
+	}
+}
+
+// writeGauge writes a gauge without labels.
+func writeGauge(w io.Writer, name, help string, value int) {
+	writeHeader(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// write writes h as the histogram name, with label set to each of its labels.
+func (h *histogramVec) write(w io.Writer, name, help, label string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, name, "histogram", help)
+	labels := make([]string, 0, len(h.series))
+	for value := range h.series {
+		labels = append(labels, value)
+	}
+	sort.Strings(labels)
+
+	for _, value := range labels {
+		s := h.series[value]
+		value = escapeLabel(value)
+		for i, bound := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"%s\"} %d\n", name, label, value, formatFloat(bound), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n", name, label, value, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %s\n", name, label, value, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", name, label, value, s.count)
+	}
+}
+
+// nodeCounts are the sizes of the cluster shown as gauges.
+type nodeCounts struct {
+	total, healthy, dead int
+}
+
+// currentNodeCounts counts the nodes smudge knows about.
+func currentNodeCounts() nodeCounts {
+	counts := nodeCounts{healthy: len(smudge.HealthyNodes())}
+	for _, node := range smudge.AllNodes() {
+		counts.total++
+		if node.Status() == smudge.StatusDead {
+			counts.dead++
+		}
+	}
+	return counts
+}
+
+// writeMetrics writes every metric in the Prometheus text format.
+func writeMetrics(w io.Writer, nodes nodeCounts) {
+	writeCounterVec(w, "chat_messages_sent_total", "Messages broadcast, by type.", "type", sentMessages)
+	writeCounterVec(w, "chat_messages_received_total", "Messages received and accepted, by type.", "type",
+		receivedMessages)
+	writeCounterVec(w, "chat_messages_rejected_total", "Broadcasts which could not be read, by sender.", "sender",
+		rejectedMessages)
+	writeCounterVec(w, "chat_decode_failures_total", "Broadcasts which could not be read, by reason.", "reason",
+		decodeFailures)
+	writeCounterVec(w, "chat_broadcasts_too_large_total", "Messages over the smudge broadcast limit, by type.",
+		"type", oversizedBroadcasts)
+	writeCounterVec(w, "chat_rate_limit_drops_total", "Chat messages dropped by the receive limit, by sender.",
+		"sender", rateLimitDrops)
+	writeCounterVec(w, "chat_username_requests_total", "Username requests for clients with no name, by result.",
+		"result", usernameRequests)
+	writeCounterVec(w, "chat_file_stalls_total", "Shared files whose chunks stopped arriving, by sender.", "sender",
+		fileStalls)
+	writeGauge(w, "chat_nodes", "Nodes known to the cluster.", nodes.total)
+	writeGauge(w, "chat_nodes_healthy", "Nodes smudge considers healthy.", nodes.healthy)
+	writeGauge(w, "chat_nodes_dead", "Nodes smudge considers dead.", nodes.dead)
+	pingMillis.write(w, "chat_ping_milliseconds", "Round-trip times of smudge pings, by node.", "node")
+}
+
+// serveMetrics serves the metrics at /metrics on addr, and the /netinfo table
+// at /netinfo, in the background. It returns once it is listening.
+func serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, currentNodeCounts())
+	})
+	mux.HandleFunc("/netinfo", netInfoHandler)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logError("Stopped serving metrics", "addr", addr, "err", err)
+		}
+	}()
+	return nil
+}
+
+// SamplePings records the ping of each node in the ping histogram, whenever
+// smudge has heard from the node since the last heartbeat. Smudge does not
+// say when a ping completes, so this is as close as it gets.
+func SamplePings() {
+	lastHeard := make(map[string]uint32)
+	for range time.Tick(heartbeatMillis * time.Millisecond) {
+		for _, node := range smudge.AllNodes() {
+			addr := node.Address()
+			if NodeAddress(addr) == localAddress || node.PingMillis() < 0 || node.Timestamp() == lastHeard[addr] {
+				continue
+			}
+			lastHeard[addr] = node.Timestamp()
+			pingMillis.Observe(addr, float64(node.PingMillis()))
+		}
+	}
+}
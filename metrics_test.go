@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReceiveCountsFailures(t *testing.T) {
+	sender := NodeAddress("192.168.0.78:9999")
+	m := Messenger{clients: ClientList{}}
+	decode, invalid := decodeFailures.Get("decode"), decodeFailures.Get("invalid")
+	typing := receivedMessages.Get("typing")
+
+	m.receive(sender, []byte("garbage"))
+	unknown := message{Type: 99, Body: "hi"}
+	m.receive(sender, unknown.Encode())
+	ok := message{Type: messageTypeTyping, Version: clientVersion}
+	m.receive(sender, ok.Encode())
+
+	if n := decodeFailures.Get("decode") - decode; n != 1 {
+		t.Fatalf("Expected 1 decode failure but got %d", n)
+	}
+	if n := decodeFailures.Get("invalid") - invalid; n != 1 {
+		t.Fatalf("Expected 1 invalid message but got %d", n)
+	}
+	if n := receivedMessages.Get("typing") - typing; n != 1 {
+		t.Fatalf("Expected 1 typing message but got %d", n)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	rateLimitDrops.Inc(`10.0.0.9:9999 "quoted"`)
+	oversizedBroadcasts.Inc("file-offer")
+	for _, ms := range []float64{0.5, 3, 40, 40, 9000} {
+		pingMillis.Observe("10.0.0.8:9999", ms)
+	}
+
+	var b bytes.Buffer
+	writeMetrics(&b, nodeCounts{total: 4, healthy: 3, dead: 1})
+	out := b.String()
+
+	var cases = []string{
+		"# TYPE chat_messages_sent_total counter\n",
+		`chat_rate_limit_drops_total{sender="10.0.0.9:9999 \"quoted\""} 1` + "\n",
+		`chat_broadcasts_too_large_total{type="file-offer"} 1` + "\n",
+		"# HELP chat_nodes_healthy Nodes smudge considers healthy.\n# TYPE chat_nodes_healthy gauge\nchat_nodes_healthy 3\n",
+		"chat_nodes 4\n",
+		"chat_nodes_dead 1\n",
+		"# TYPE chat_ping_milliseconds histogram\n",
+		`chat_ping_milliseconds_bucket{node="10.0.0.8:9999",le="1"} 1` + "\n",
+		`chat_ping_milliseconds_bucket{node="10.0.0.8:9999",le="25"} 2` + "\n",
+		`chat_ping_milliseconds_bucket{node="10.0.0.8:9999",le="50"} 4` + "\n",
+		`chat_ping_milliseconds_bucket{node="10.0.0.8:9999",le="2500"} 4` + "\n",
+		`chat_ping_milliseconds_bucket{node="10.0.0.8:9999",le="+Inf"} 5` + "\n",
+		`chat_ping_milliseconds_sum{node="10.0.0.8:9999"} 9083.5` + "\n",
+		`chat_ping_milliseconds_count{node="10.0.0.8:9999"} 5` + "\n",
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if !strings.Contains(out, c) {
+				t.Fatalf("Expected the metrics to contain %q:\n%s", c, out)
+			}
+		})
+	}
+
+	// Every line is a comment or a sample.
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if !strings.HasPrefix(line, "# ") && !strings.HasPrefix(line, "chat_") {
+			t.Fatalf("Unexpected line %q", line)
+		}
+	}
+}
+
+func TestAddressLabelLimit(t *testing.T) {
+	counts := newAddressCounterVec()
+	pings := newHistogramVec(pingBuckets, maxAddressLabels)
+	for i := 0; i < maxAddressLabels+10; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:9999", i/256, i%256)
+		counts.Inc(addr)
+		pings.Observe(addr, 1)
+	}
+	counts.Inc("10.0.0.0:9999")
+
+	if n := len(counts.Labels()); n != maxAddressLabels+1 {
+		t.Fatalf("Expected %d labels but got %d", maxAddressLabels+1, n)
+	}
+	if n := counts.Get(otherLabel); n != 10 {
+		t.Fatalf("Expected 10 counted as other but got %d", n)
+	}
+	if n := counts.Get("10.0.0.0:9999"); n != 2 {
+		t.Fatalf("Expected a known address to keep its own count but got %d", n)
+	}
+	if s := pings.series[otherLabel]; len(pings.series) != maxAddressLabels+1 || s == nil || s.count != 10 {
+		t.Fatalf("Expected 10 pings observed as other in %d series", len(pings.series))
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jroimartin/gocui"
+)
+
+// doubleClickTime is the longest gap between two clicks on the same client for
+// them to count as a double click.
+const doubleClickTime = 500 * time.Millisecond
+
+// wheelLines is how many lines a view scrolls for each step of the mouse
+// wheel.
+const wheelLines = 3
+
+// chatLine remembers what was written on one line of the messages view, so
+// the line can be acted on from the message menu.
+type chatLine struct {
+	id     string
+	sender string
+	body   string
+
+	// plain is the line as it appears in the view, without colors.
+	plain string
+}
+
+// menuItem is one entry of a menu opened with showMenu.
+type menuItem struct {
+	label  string
+	action func(g *gocui.Gui) error
+}
+
+var (
+	// messageLines holds a chatLine for each chat message written to the
+	// messages view, in order. It is only touched from the GUI goroutine.
+	messageLines []chatLine
+
+	// lastClientClick and lastClientClickAt are used to recognize a double
+	// click in the Clients pane.
+	lastClientClick   NodeAddress
+	lastClientClickAt time.Time
+
+	// menuItems are the entries of the menu that is currently open.
+	menuItems []menuItem
+)
+
+// clickClient selects the client that was clicked. gocui has already moved
+// the cursor to the clicked line. Clicking the same client twice in a row
+// starts a direct message to it.
+func clickClient(g *gocui.Gui, v *gocui.View) error {
+	if err := focusClients(g, v); err != nil {
+		return err
+	}
+	addr, ok := selectedClient(v)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	double := addr == lastClientClick && now.Sub(lastClientClickAt) < doubleClickTime
+	lastClientClick, lastClientClickAt = addr, now
+	if double {
+		lastClientClick = ""
+		return openDirectMessage(g, v)
+	}
+	return nil
+}
+
+func wheelUp(g *gocui.Gui, v *gocui.View) error {
+	return scrollView(g, v, -wheelLines)
+}
+
+func wheelDown(g *gocui.Gui, v *gocui.View) error {
+	return scrollView(g, v, wheelLines)
+}
+
+// clickedMessage returns the chat message on the line under the cursor of the
+// messages view.
+func clickedMessage(v *gocui.View) (chatLine, bool) {
+	_, cy := v.Cursor()
+	line, err := v.Line(cy)
+	if err != nil {
+		return chatLine{}, false
+	}
+
+	// Search from the end, since recent messages are clicked most often.
+	for i := len(messageLines) - 1; i >= 0; i-- {
+		if messageLines[i].plain == line {
+			return messageLines[i], true
+		}
+	}
+	return chatLine{}, false
+}
+
+// showMessageMenu opens a menu of actions for the message that was right
+// clicked.
+func showMessageMenu(g *gocui.Gui, v *gocui.View) error {
+	msg, ok := clickedMessage(v)
+	if !ok {
+		return nil
+	}
+
+	items := []menuItem{
+		{"Reply", func(g *gocui.Gui) error {
+			return setInput(g, "/reply "+msg.id+" ")
+		}},
+		{"Show thread", func(g *gocui.Gui) error {
+			return showThread(g, msg.id)
+		}},
+		{"React 👍", func(g *gocui.Gui) error {
+			return reactTo(msg.id, "👍")
+		}},
+		{"React...", func(g *gocui.Gui) error {
+			return setInput(g, "/react "+msg.id+" ")
+		}},
+		{"Quote", func(g *gocui.Gui) error {
+			return setInput(g, fmt.Sprintf("> %s: %s ", msg.sender, msg.body))
+		}},
+		{"Copy text", func(g *gocui.Gui) error {
+			if err := copyToClipboard(msg.body); err != nil {
+				printNotice(fmt.Sprintf("Unable to copy the message: %s", err))
+			}
+			return nil
+		}},
+	}
+
+	if own, ok := chat.history.Get(msg.id); ok && own.From == localAddress && !own.Deleted {
+		items = append(items,
+			menuItem{"Edit", func(g *gocui.Gui) error {
+				return setInput(g, fmt.Sprintf("/edit %s %s", own.ID, own.Body))
+			}},
+			menuItem{"Delete", func(g *gocui.Gui) error {
+				if err := chat.DeleteMessage(own); err != nil {
+					printNotice(fmt.Sprintf("Unable to delete the message: %s", err))
+				}
+				return nil
+			}},
+		)
+	}
+
+	x0, y0, _, _, err := g.ViewPosition("messages")
+	if err != nil {
+		return err
+	}
+	cx, cy := v.Cursor()
+	return showMenu(g, "message-menu", x0+cx+1, y0+cy+1, items)
+}
+
+// showChannelMenu opens a menu of the open channels when the status bar is
+// clicked. Picking one switches to it.
+func showChannelMenu(g *gocui.Gui, v *gocui.View) error {
+	var items []menuItem
+	for _, c := range openChannels(chat.history.All(), chat.dmChannel) {
+		c := c
+		label := "  " + sanitizeLine(c.name)
+		if c.peer == activeChannel.peer {
+			label = "* " + sanitizeLine(c.name)
+		}
+		items = append(items, menuItem{label, func(g *gocui.Gui) error {
+			return switchChannel(g, c)
+		}})
+	}
+
+	// The status bar is at the bottom, so the menu opens above it.
+	x0, y0, _, _, err := g.ViewPosition("status")
+	if err != nil {
+		return err
+	}
+	cx, _ := v.Cursor()
+	return showMenu(g, "channel-menu", x0+cx, y0-len(items)-1, items)
+}
+
+// showMenu opens a small menu with its top left corner at x, y. An item is
+// picked with the arrow keys and Enter or with a click, and Esc closes the
+// menu without picking anything.
+func showMenu(g *gocui.Gui, name string, x, y int, items []menuItem) error {
+	width := 0
+	for _, item := range items {
+		if len(item.label) > width {
+			width = len(item.label)
+		}
+	}
+	width += 2
+	height := len(items) + 1
+
+	maxX, maxY := g.Size()
+	if x+width >= maxX {
+		x = maxX - width - 1
+	}
+	if y+height >= maxY {
+		y = maxY - height - 1
+	}
+	if x < 0 {
+		x = 0
+	}
+	if y < 0 {
+		y = 0
+	}
+
+	v, err := g.SetView(name, x, y, x+width, y+height)
+	if err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+
+		applyTheme(v)
+		bindings := []struct {
+			key     interface{}
+			handler func(*gocui.Gui, *gocui.View) error
+		}{
+			{gocui.KeyArrowUp, selectPrevMenuItem},
+			{gocui.KeyArrowDown, selectNextMenuItem},
+			{gocui.KeyEnter, pickMenuItem},
+			{gocui.MouseLeft, pickMenuItem},
+			{gocui.KeyEsc, closeOverlay},
+			{'q', closeOverlay},
+		}
+		for _, b := range bindings {
+			if err := g.SetKeybinding(name, b.key, gocui.ModNone, b.handler); err != nil {
+				return err
+			}
+		}
+	}
+
+	v.Highlight = true
+	v.Clear()
+	for _, item := range items {
+		fmt.Fprintln(v, item.label)
+	}
+	menuItems = items
+
+	if cv := g.CurrentView(); cv != nil && cv.Name() != name {
+		overlayReturn = cv.Name()
+	}
+	if _, err := g.SetViewOnTop(name); err != nil {
+		return err
+	}
+	if _, err := g.SetCurrentView(name); err != nil {
+		return err
+	}
+	return v.SetCursor(0, 0)
+}
+
+func selectPrevMenuItem(g *gocui.Gui, v *gocui.View) error {
+	_, cy := v.Cursor()
+	if cy == 0 {
+		return nil
+	}
+	return v.SetCursor(0, cy-1)
+}
+
+func selectNextMenuItem(g *gocui.Gui, v *gocui.View) error {
+	_, cy := v.Cursor()
+	if cy+1 >= len(menuItems) {
+		return nil
+	}
+	return v.SetCursor(0, cy+1)
+}
+
+// pickMenuItem closes the menu and runs the action of the selected item.
+func pickMenuItem(g *gocui.Gui, v *gocui.View) error {
+	_, cy := v.Cursor()
+	items := menuItems
+	if err := closeOverlay(g, v); err != nil {
+		return err
+	}
+
+	if cy >= len(items) {
+		return nil
+	}
+	return items[cy].action(g)
+}
+
+// copyToClipboard asks the terminal to put text on the system clipboard, using
+// the OSC 52 escape sequence. Terminals which do not support it ignore it.
+func copyToClipboard(text string) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+
+	_, err = fmt.Fprintf(tty, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+	return err
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+	"github.com/jroimartin/gocui"
+)
+
+// recentWindow is how far back messages are counted by origin for /netinfo.
+const recentWindow = 5 * time.Minute
+
+// netInfoRefresh is how often the /netinfo overlay is redrawn while it is
+// open.
+const netInfoRefresh = time.Second
+
+// originCounter counts the messages from each origin over the last
+// recentWindow, a minute at a time. The zero value is empty and it is safe to
+// use from several goroutines.
+type originCounter struct {
+	mu      sync.Mutex
+	minutes map[int64]map[NodeAddress]int
+}
+
+// recentOrigins counts the messages we have sent and accepted, by the client
+// they came from.
+var recentOrigins originCounter
+
+// Add counts a message from origin.
+func (c *originCounter) Add(origin NodeAddress, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	minute := now.Unix() / 60
+	if c.minutes == nil {
+		c.minutes = make(map[int64]map[NodeAddress]int)
+	}
+	if c.minutes[minute] == nil {
+		c.minutes[minute] = make(map[NodeAddress]int)
+	}
+	c.minutes[minute][origin]++
+
+	for m := range c.minutes {
+		if m <= minute-int64(recentWindow/time.Minute) {
+			delete(c.minutes, m)
+		}
+	}
+}
+
+// Counts returns the number of messages from each origin in the recentWindow
+// before now.
+func (c *originCounter) Counts(now time.Time) map[NodeAddress]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[NodeAddress]int)
+	minute := now.Unix() / 60
+	for m, origins := range c.minutes {
+		if m > minute-int64(recentWindow/time.Minute) && m <= minute {
+			for origin, n := range origins {
+				counts[origin] += n
+			}
+		}
+	}
+	return counts
+}
+
+// nodeInfo is one row of the /netinfo table.
+type nodeInfo struct {
+	addr   NodeAddress
+	name   string
+	status string
+	age    time.Duration
+	emit   int8
+	ping   int
+}
+
+// netInfo is what /netinfo and the diag subcommand show about the cluster.
+type netInfo struct {
+	listen    NodeAddress
+	heartbeat int
+	nodes     []nodeInfo
+
+	// recent counts messages by origin over the last recentWindow.
+	recent map[NodeAddress]int
+}
+
+// currentNetInfo collects what smudge and the client list know about the
+// cluster.
+func currentNetInfo(now time.Time) netInfo {
+	info := netInfo{
+		listen:    localAddress,
+		heartbeat: smudge.GetHeartbeatMillis(),
+		recent:    recentOrigins.Counts(now),
+	}
+	for _, node := range smudge.AllNodes() {
+		addr := NodeAddress(node.Address())
+		c, _ := clients.get(addr)
+		c.node = node
+		info.nodes = append(info.nodes, nodeInfo{
+			addr:   addr,
+			name:   c.GetName(),
+			status: c.Status(),
+			age:    time.Duration(node.Age()) * time.Millisecond,
+			emit:   node.EmitCounter(),
+			ping:   node.PingMillis(),
+		})
+	}
+	sort.Slice(info.nodes, func(i, j int) bool {
+		return info.nodes[i].addr < info.nodes[j].addr
+	})
+	return info
+}
+
+// Lines formats info as a table, with a line for each node.
+func (info netInfo) Lines() []string {
+	lines := []string{
+		fmt.Sprintf("Listening on %s, heartbeat every %dms", info.listen, info.heartbeat),
+		"Pending broadcasts: unknown, smudge does not expose its queue",
+		"",
+		fmt.Sprintf("%-22s %-16s %-8s %8s %4s %6s %6s", "Node", "Name", "Status", "Age", "Emit", "Ping",
+			fmt.Sprintf("Msgs/%dm", int(recentWindow/time.Minute))),
+	}
+
+	known := make(map[NodeAddress]bool)
+	for _, n := range info.nodes {
+		known[n.addr] = true
+		name := sanitizeLine(n.name)
+		if name == "" {
+			name = "-"
+		}
+		if n.addr == info.listen {
+			name += " (us)"
+		}
+		lines = append(lines, fmt.Sprintf("%-22s %-16s %-8s %8s %4d %6s %6d", n.addr, name, n.status,
+			n.age.Round(time.Millisecond), n.emit, formatPing(n.ping), info.recent[n.addr]))
+	}
+	if len(info.nodes) == 0 {
+		lines = append(lines, "(no nodes)")
+	}
+
+	// Messages repaired on behalf of clients smudge no longer knows about.
+	var others []NodeAddress
+	for origin := range info.recent {
+		if !known[origin] {
+			others = append(others, origin)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i] < others[j] })
+	for _, origin := range others {
+		lines = append(lines, fmt.Sprintf("%-22s %-16s %-8s %8s %4s %6s %6d", origin, "-", "gone", "-", "-", "-",
+			info.recent[origin]))
+	}
+	return lines
+}
+
+// cmdNetinfo opens an overlay showing the state of the cluster, kept up to
+// date until it is closed.
+func cmdNetinfo(args string) error {
+	lines := currentNetInfo(time.Now()).Lines()
+	gui.Update(func(g *gocui.Gui) error {
+		if _, err := g.View("netinfo"); err != nil {
+			go refreshNetInfo()
+		}
+		return showOverlay(g, "netinfo", "Network (live, Esc to close)", lines)
+	})
+	return nil
+}
+
+// refreshNetInfo redraws the /netinfo overlay every netInfoRefresh, and
+// returns once it has been closed.
+func refreshNetInfo() {
+	ticker := time.NewTicker(netInfoRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		open := make(chan bool, 1)
+		lines := currentNetInfo(time.Now()).Lines()
+		gui.Update(func(g *gocui.Gui) error {
+			v, err := g.View("netinfo")
+			if err != nil {
+				open <- false
+				return nil
+			}
+			open <- true
+			v.Clear()
+			for _, line := range lines {
+				fmt.Fprintln(v, line)
+			}
+			return nil
+		})
+		if !<-open {
+			return
+		}
+	}
+}
+
+// netInfoHandler serves the /netinfo table as text, for the diag
+// subcommand.
+func netInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, strings.Join(currentNetInfo(time.Now()).Lines(), "\n"))
+}
+
+// runDiag is the diag subcommand, which prints the /netinfo table of a
+// client running with -metrics-addr.
+func runDiag(args []string) error {
+	addr := "localhost:9100"
+	if len(args) > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+	if len(args) == 1 {
+		addr = args[0]
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + addr + "/netinfo")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", addr, resp.Status)
+	}
+	fmt.Print(string(body))
+	return nil
+}
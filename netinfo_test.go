@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+func TestOriginCounter(t *testing.T) {
+	alice := NodeAddress("10.0.0.1:9999")
+	bob := NodeAddress("10.0.0.2:9999")
+	start := time.Date(2026, 10, 18, 9, 0, 30, 0, time.UTC)
+
+	var c originCounter
+	c.Add(alice, start)
+	c.Add(alice, start.Add(2*time.Minute))
+	c.Add(bob, start.Add(4*time.Minute))
+
+	expected := map[NodeAddress]int{alice: 2, bob: 1}
+	if counts := c.Counts(start.Add(4 * time.Minute)); !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v but got %v", expected, counts)
+	}
+
+	// The first minute drops out of the window, and is forgotten once
+	// something else is counted.
+	expected = map[NodeAddress]int{alice: 1, bob: 1}
+	if counts := c.Counts(start.Add(5 * time.Minute)); !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v but got %v", expected, counts)
+	}
+	c.Add(bob, start.Add(5*time.Minute))
+	if len(c.minutes) != 3 {
+		t.Fatalf("Expected 3 minutes to be kept but got %d", len(c.minutes))
+	}
+}
+
+func TestNetInfoLines(t *testing.T) {
+	info := netInfo{
+		listen:    "10.0.0.1:9999",
+		heartbeat: 500,
+		nodes: []nodeInfo{
+			{addr: "10.0.0.1:9999", name: "alice", status: "online", ping: smudge.PingNoData},
+			{addr: "10.0.0.2:9999", name: "b\x1bob", status: "dead", age: 12345 * time.Millisecond, emit: 3,
+				ping: smudge.PingTimedOut},
+		},
+		recent: map[NodeAddress]int{"10.0.0.2:9999": 7, "10.0.0.3:9999": 2},
+	}
+
+	expected := []string{
+		"Listening on 10.0.0.1:9999, heartbeat every 500ms",
+		"Pending broadcasts: unknown, smudge does not expose its queue",
+		"",
+		"Node                   Name             Status        Age Emit   Ping Msgs/5m",
+		"10.0.0.1:9999          alice (us)       online         0s    0      -      0",
+		"10.0.0.2:9999          b^[ob            dead      12.345s    3    t/o      7",
+		"10.0.0.3:9999          -                gone            -    -      -      2",
+	}
+	lines := info.Lines()
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Expected:\n%s\nbut got:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/gocui"
+)
+
+// systemNoticeInterval is how often the membership changes collected since
+// the last report are written to the messages view.
+const systemNoticeInterval = 2 * time.Second
+
+// maxNamedInNotice is how many clients a system notice names before it just
+// counts them, as in "5 users joined".
+const maxNamedInNotice = 3
+
+// systemEventKind is what happened to a client, in the order the notices are
+// reported.
+type systemEventKind int
+
+const (
+	eventJoin systemEventKind = iota
+	eventTimeout
+	eventLeave
+	eventRename
+	eventKeyChange
+)
+
+// systemEvent is a change to a client which is shown as a system notice.
+type systemEvent struct {
+	kind systemEventKind
+	addr NodeAddress
+
+	// name is the name of the client when it happened. Joins are named when
+	// they are reported, since the username usually arrives later.
+	name string
+
+	// detail is the reason for a leave, the new name after a rename, or the
+	// ID of the new cluster key.
+	detail string
+}
+
+// systemEventLog collects systemEvents until they are reported. The zero
+// value is empty, and it is safe to use from several goroutines.
+type systemEventLog struct {
+	mu     sync.Mutex
+	events []systemEvent
+}
+
+// systemEvents holds the membership changes waiting to be reported.
+var systemEvents systemEventLog
+
+// showSystemNotices is unset by hide-system-notices in the configuration.
+var showSystemNotices = true
+
+// Add records e, unless system notices are hidden. A client which joins and
+// times out again before either is reported, as happens on a flapping
+// network, is not mentioned at all.
+func (l *systemEventLog) Add(e systemEvent) {
+	if !showSystemNotices {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, old := range l.events {
+		flapped := old.kind == eventJoin && e.kind == eventTimeout || old.kind == eventTimeout && e.kind == eventJoin
+		if old.addr == e.addr && flapped {
+			l.events = append(l.events[:i], l.events[i+1:]...)
+			return
+		}
+	}
+	l.events = append(l.events, e)
+}
+
+// Take returns the events recorded since it was last called.
+func (l *systemEventLog) Take() []systemEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.events
+	l.events = nil
+	return events
+}
+
+// ReportSystemNotices periodically writes the membership changes collected
+// in systemEvents to the messages view, a line for each kind of change.
+func (m *Messenger) ReportSystemNotices() {
+	c := time.Tick(systemNoticeInterval)
+	for range c {
+		events := systemEvents.Take()
+		for i, e := range events {
+			if e.kind == eventJoin {
+				client, _ := m.clients.get(e.addr)
+				events[i].name = client.GetName()
+			}
+		}
+		for _, line := range formatSystemEvents(events) {
+			printSystemNotice(line)
+		}
+	}
+}
+
+// formatSystemEvents describes events with a line for each kind of change.
+// Repeated changes to one client are merged, and more than maxNamedInNotice
+// clients are counted rather than named.
+func formatSystemEvents(events []systemEvent) []string {
+	var lines []string
+	for kind := eventJoin; kind <= eventKeyChange; kind++ {
+		var merged []systemEvent
+		index := make(map[NodeAddress]int)
+		for _, e := range events {
+			if e.kind != kind {
+				continue
+			}
+			if e.name == "" {
+				e.name = string(e.addr)
+			}
+			if i, ok := index[e.addr]; ok {
+				// Keep the name from before the first rename.
+				merged[i].detail = e.detail
+				continue
+			}
+			index[e.addr] = len(merged)
+			merged = append(merged, e)
+		}
+
+		switch {
+		case len(merged) == 1:
+			lines = append(lines, describeSystemEvent(merged[0]))
+		case len(merged) > maxNamedInNotice:
+			lines = append(lines, fmt.Sprintf("%d users %s", len(merged), systemEventVerbs[kind]))
+		case len(merged) > 1:
+			names := make([]string, len(merged))
+			for i, e := range merged {
+				names[i] = sanitizeLine(e.name)
+			}
+			list := strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+			lines = append(lines, fmt.Sprintf("%s %s", list, systemEventVerbs[kind]))
+		}
+	}
+	return lines
+}
+
+// systemEventVerbs describe what several clients did, after their names or
+// how many there were.
+var systemEventVerbs = map[systemEventKind]string{
+	eventJoin:      "joined",
+	eventTimeout:   "timed out",
+	eventLeave:     "left",
+	eventRename:    "changed their names",
+	eventKeyChange: "switched cluster keys",
+}
+
+// describeSystemEvent describes a change to a single client.
+func describeSystemEvent(e systemEvent) string {
+	name := sanitizeLine(e.name)
+	switch e.kind {
+	case eventLeave:
+		return leaveNotice(e.name, e.detail)
+	case eventRename:
+		return fmt.Sprintf("%s is now known as %s", name, sanitizeLine(e.detail))
+	case eventKeyChange:
+		return fmt.Sprintf("%s switched to cluster key %s", name, e.detail)
+	}
+	return name + " " + systemEventVerbs[e.kind]
+}
+
+// printSystemNotice adds a system notice to the transcript and writes it to
+// the messages view.
+func printSystemNotice(msg string) {
+	if gui == nil {
+		fmt.Fprintln(consoleOut, msg)
+		return
+	}
+
+	now := time.Now()
+	gui.Update(func(g *gocui.Gui) error {
+		v, err := g.View("messages")
+		if err != nil {
+			return err
+		}
+
+		transcript = append(transcript, transcriptEntry{notice: msg, system: true, time: now})
+		writeSystemNotice(v, now, msg)
+		return nil
+	})
+}
+
+// writeSystemNotice writes a system notice to the messages view v, dimmed so
+// it stands apart from the conversation.
+func writeSystemNotice(v *gocui.View, at time.Time, msg string) {
+	fmt.Fprintf(v, "%s %s\n", styleText(currentTheme.timestamp, at.Format("15:04")),
+		styleText(currentTheme.system, "— "+msg))
+}
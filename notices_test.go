@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSystemEventLog(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	carol := NodeAddress("192.168.0.12:9999")
+	var l systemEventLog
+
+	// Bob flaps, which is not worth mentioning, and carol joins.
+	l.Add(systemEvent{kind: eventJoin, addr: bob})
+	l.Add(systemEvent{kind: eventJoin, addr: carol})
+	l.Add(systemEvent{kind: eventTimeout, addr: bob, name: "bob"})
+	l.Add(systemEvent{kind: eventLeave, addr: carol, name: "carol"})
+
+	expected := []systemEvent{{kind: eventJoin, addr: carol}, {kind: eventLeave, addr: carol, name: "carol"}}
+	if events := l.Take(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected %v but got %v", expected, events)
+	}
+	if events := l.Take(); len(events) != 0 {
+		t.Fatalf("Expected nothing left but got %v", events)
+	}
+
+	showSystemNotices = false
+	defer func() { showSystemNotices = true }()
+	l.Add(systemEvent{kind: eventJoin, addr: bob})
+	if events := l.Take(); len(events) != 0 {
+		t.Fatalf("Expected hidden notices not to be kept but got %v", events)
+	}
+}
+
+func TestFormatSystemEvents(t *testing.T) {
+	join := func(addr, name string) systemEvent {
+		return systemEvent{kind: eventJoin, addr: NodeAddress(addr), name: name}
+	}
+
+	var cases = []struct {
+		events         []systemEvent
+		expectedResult []string
+	}{
+		{[]systemEvent{join("10.0.0.1:9999", "alice")}, []string{"alice joined"}},
+		{[]systemEvent{join("10.0.0.1:9999", "")}, []string{"10.0.0.1:9999 joined"}},
+		{
+			[]systemEvent{
+				{kind: eventLeave, addr: "10.0.0.3:9999", name: "carol", detail: "lunch"},
+				join("10.0.0.1:9999", "alice"),
+				{kind: eventTimeout, addr: "10.0.0.4:9999", name: "dave\x1b[2J"},
+				join("10.0.0.2:9999", "bob"),
+			},
+			[]string{"alice and bob joined", "dave^[[2J timed out", "carol left (lunch)"},
+		},
+		{
+			[]systemEvent{join("10.0.0.1:9999", "a"), join("10.0.0.2:9999", "b"), join("10.0.0.3:9999", "c")},
+			[]string{"a, b and c joined"},
+		},
+		{
+			[]systemEvent{join("10.0.0.1:9999", "a"), join("10.0.0.2:9999", "b"), join("10.0.0.3:9999", "c"),
+				join("10.0.0.4:9999", "d"), join("10.0.0.5:9999", "e")},
+			[]string{"5 users joined"},
+		},
+		{
+			// Renamed twice in a row.
+			[]systemEvent{
+				{kind: eventRename, addr: "10.0.0.1:9999", name: "alice", detail: "al"},
+				{kind: eventRename, addr: "10.0.0.1:9999", name: "al", detail: "alicia"},
+				{kind: eventKeyChange, addr: "10.0.0.2:9999", name: "bob", detail: "0a1b2c3d"},
+			},
+			[]string{"alice is now known as alicia", "bob switched to cluster key 0a1b2c3d"},
+		},
+		{nil, nil},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if result := formatSystemEvents(c.events); !reflect.DeepEqual(result, c.expectedResult) {
+				t.Fatalf("Expected %q but got %q", c.expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestReceiveKeyChange(t *testing.T) {
+	defer setClusterKeys(nil)
+	bob := NodeAddress("192.168.0.11:9999")
+	m := Messenger{clients: ClientList{bob: ChatClient{}}}
+	systemEvents.Take()
+
+	typing := message{Type: messageTypeTyping, Version: clientVersion}
+	send := func(secret string) {
+		CheckNoError(t, setClusterKeys([]string{secret}))
+		sealed, err := seal(typing.Encode())
+		CheckNoError(t, err)
+		CheckNoError(t, setClusterKeys([]string{"old secret", "new secret"}))
+		m.receive(bob, sealed)
+	}
+
+	send("old secret")
+	send("old secret")
+	if events := systemEvents.Take(); len(events) != 0 {
+		t.Fatalf("Expected no key change but got %v", events)
+	}
+
+	send("new secret")
+	events := systemEvents.Take()
+	if len(events) != 1 || events[0].kind != eventKeyChange || events[0].addr != bob {
+		t.Fatalf("Expected bob to switch keys but got %v", events)
+	}
+	if key, _ := deriveClusterKey("new secret"); events[0].detail != fmt.Sprintf("%x", key.id) {
+		t.Fatalf("Expected the ID of the new key but got %q", events[0].detail)
+	}
+
+	// Going back and forth between keys he has used is not news.
+	send("old secret")
+	send("new secret")
+	if events := systemEvents.Take(); len(events) != 0 {
+		t.Fatalf("Expected each key to be reported once but got %v", events)
+	}
+}
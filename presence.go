@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/clockworksoul/smudge"
+	"github.com/jroimartin/gocui"
+)
+
+const (
+	// maxReasonLength is the longest away or busy reason, in characters.
+	maxReasonLength = 64
+
+	// autoReplyInterval is the least time between two automatic replies to
+	// direct messages from the same client.
+	autoReplyInterval = 5 * time.Minute
+
+	// idleCheckInterval is how often we check whether to go away on our own.
+	idleCheckInterval = 30 * time.Second
+
+	// presenceAnnounceDelay is how long we wait after a client joins before
+	// telling it our presence, so a burst of joins is answered once.
+	presenceAnnounceDelay = 2 * time.Second
+)
+
+// presence is what a client has told the others about whether it is at the
+// keyboard. Every change increases Version, so an older presence arriving
+// after a newer one is ignored. Versions start from the time of the change,
+// so a client which restarts is not ignored by clients which still remember
+// its last run.
+type presence struct {
+	// State is "" when the client is available, "away" or "busy".
+	State   string `json:"state,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Version int    `json:"version"`
+}
+
+// String describes the presence, such as "away: lunch", or "available".
+func (p presence) String() string {
+	if p.State == "" {
+		return "available"
+	}
+	if p.Reason == "" {
+		return p.State
+	}
+	return fmt.Sprintf("%s: %s", p.State, sanitizeLine(p.Reason))
+}
+
+// validatePresence checks a presence received from another client.
+func validatePresence(p presence) error {
+	switch p.State {
+	case "", "away", "busy":
+	default:
+		return fmt.Errorf("unknown presence %q", sanitizeLine(p.State))
+	}
+	if utf8.RuneCountInString(p.Reason) > maxReasonLength {
+		return fmt.Errorf("presence reason is longer than %d characters", maxReasonLength)
+	}
+	if p.Version < 1 {
+		return fmt.Errorf("presence has version %d", p.Version)
+	}
+	return nil
+}
+
+var (
+	// presenceMu guards the variables below.
+	presenceMu sync.Mutex
+
+	// localPresence is our own presence.
+	localPresence presence
+
+	// autoAway is set when we went away because there was no input, so the
+	// next key press brings us back.
+	autoAway bool
+
+	// lastInput is when the user last typed in the Send box.
+	lastInput = time.Now()
+
+	// autoAwayAfter is how long without input before we go away on our own.
+	// Zero turns this off.
+	autoAwayAfter time.Duration
+
+	// autoReplied records when we last sent an automatic reply to each
+	// client.
+	autoReplied = make(map[NodeAddress]time.Time)
+
+	// presenceAnnounce is set while our presence is waiting to be sent to
+	// clients which just joined.
+	presenceAnnounce *time.Timer
+)
+
+// nextPresenceVersion returns the version of a presence replacing one at
+// version prev, changed at now.
+func nextPresenceVersion(prev int, now time.Time) int {
+	if v := int(now.Unix()); v > prev {
+		return v
+	}
+	return prev + 1
+}
+
+// currentPresence returns our own presence.
+func currentPresence() presence {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	return localPresence
+}
+
+// setLocalPresence changes our presence and tells the other clients.
+func setLocalPresence(state, reason string, auto bool) error {
+	presenceMu.Lock()
+	localPresence = presence{State: state, Reason: reason, Version: nextPresenceVersion(localPresence.Version, time.Now())}
+	autoAway = auto
+	p := localPresence
+	presenceMu.Unlock()
+
+	printStatusBar()
+	msg := message{
+		Type:     messageTypePresence,
+		Presence: map[NodeAddress]presence{localAddress: p},
+		Version:  clientVersion,
+	}
+	return broadcast(&msg)
+}
+
+// setPresence records the presence of addr if it is newer than the one we
+// know. Our own presence is only changed locally.
+func (cl ClientList) setPresence(addr NodeAddress, p presence) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	c, ok := cl[addr]
+	if !ok || addr == localAddress || p.Version <= c.presence.Version {
+		return
+	}
+	c.presence = p
+	cl[addr] = c
+}
+
+// BroadcastPresence sends our presence, if we ever set one, so a client
+// which just joined learns it. Unlike usernames, clients only send their own
+// presence, since nothing stops a client from sending someone else's.
+func (cl ClientList) BroadcastPresence() error {
+	p := currentPresence()
+	if p.Version == 0 {
+		return nil
+	}
+
+	msg := message{Type: messageTypePresence, Presence: map[NodeAddress]presence{localAddress: p},
+		Version: clientVersion}
+	return broadcast(&msg)
+}
+
+// announcePresence sends our presence shortly, unless it is already about to
+// be sent, for a client which just joined.
+func announcePresence(cl ClientList) {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	if localPresence.Version == 0 || presenceAnnounce != nil {
+		return
+	}
+
+	presenceAnnounce = time.AfterFunc(presenceAnnounceDelay, func() {
+		presenceMu.Lock()
+		presenceAnnounce = nil
+		presenceMu.Unlock()
+		if err := cl.BroadcastPresence(); err != nil {
+			logError("Failed to broadcast our presence", "err", err)
+		}
+	})
+}
+
+// receivePresence applies the presence senderAddr sent for itself. Clients
+// which relay the presences of others are not believed, but one which
+// remembers a version of ours at least as new as our own would ignore our
+// next change, so our version is moved past it.
+func (m *Messenger) receivePresence(senderAddr NodeAddress, presences map[NodeAddress]presence) {
+	for addr, p := range presences {
+		if err := validateAddress(addr); err != nil {
+			logWarn("Ignoring a presence", "from", senderAddr, "err", err)
+			continue
+		}
+		if err := validatePresence(p); err != nil {
+			logWarn("Ignoring a presence", "from", senderAddr, "err", err)
+			continue
+		}
+		if addr == localAddress {
+			if raised, ok := raisePresenceVersion(p.Version); ok {
+				msg := message{Type: messageTypePresence, Presence: map[NodeAddress]presence{localAddress: raised},
+					Version: clientVersion}
+				if err := broadcast(&msg); err != nil {
+					logError("Failed to broadcast our presence", "err", err)
+				}
+			}
+			continue
+		}
+		if addr != senderAddr {
+			logDebug("Ignoring a presence relayed by another client", "from", senderAddr, "for", addr)
+			continue
+		}
+		if node, back := returnedWith(addr, p.Version); back && node != nil {
+			// A client which left and came back straight away announces
+			// itself while its last heartbeats were still ignored.
+			m.clients.OnChange(node, smudge.StatusAlive)
+		}
+		m.clients.setPresence(addr, p)
+	}
+	printClientList(m.clients)
+}
+
+// raisePresenceVersion makes sure our presence has a newer version than seen,
+// which another client holds for us. It returns our presence and whether it
+// changed, in which case the others need to be told.
+func raisePresenceVersion(seen int) (presence, bool) {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	if seen < localPresence.Version {
+		return localPresence, false
+	}
+	localPresence.Version = seen + 1
+	return localPresence, true
+}
+
+// autoReply answers a direct message from addr with our away or busy reason,
+// at most once every autoReplyInterval.
+func (m *Messenger) autoReply(addr NodeAddress) {
+	p := currentPresence()
+	if p.State == "" {
+		return
+	}
+
+	presenceMu.Lock()
+	now := time.Now()
+	recent := now.Sub(autoReplied[addr]) < autoReplyInterval
+	if !recent {
+		autoReplied[addr] = now
+	}
+	presenceMu.Unlock()
+	if recent {
+		return
+	}
+
+	msg := message{
+		Type:    messageTypeChat,
+		Body:    p.String(),
+		To:      addr,
+		Auto:    true,
+		Version: clientVersion,
+	}
+	if err := broadcast(&msg); err != nil {
+		logError("Failed to send an automatic reply", "err", err)
+	}
+}
+
+// noteInput records that the user typed something, bringing us back if we
+// had gone away on our own.
+func noteInput() {
+	presenceMu.Lock()
+	lastInput = time.Now()
+	wasAuto := autoAway && localPresence.State != ""
+	presenceMu.Unlock()
+
+	if wasAuto {
+		if err := setLocalPresence("", "", false); err != nil {
+			logError("Failed to broadcast our presence", "err", err)
+		}
+		printNotice("You are back")
+	}
+}
+
+// WatchIdle sets us away when there has been no input for autoAwayAfter.
+func WatchIdle() {
+	for range time.Tick(idleCheckInterval) {
+		presenceMu.Lock()
+		idle := autoAwayAfter > 0 && localPresence.State == "" &&
+			time.Since(lastInput) >= autoAwayAfter
+		presenceMu.Unlock()
+
+		if idle {
+			if err := setLocalPresence("away", "idle", true); err != nil {
+				logError("Failed to broadcast our presence", "err", err)
+			}
+			printNotice("You are now away because you have been idle, type to come back")
+		}
+	}
+}
+
+// checkReason checks an away or busy reason given by the user.
+func checkReason(reason string) error {
+	if utf8.RuneCountInString(reason) > maxReasonLength {
+		return fmt.Errorf("the reason is longer than %d characters", maxReasonLength)
+	}
+	return nil
+}
+
+// cmdAway marks us as away: /away [reason]
+func cmdAway(args string) error {
+	return changePresence("away", args)
+}
+
+// cmdBusy marks us as busy: /busy [reason]
+func cmdBusy(args string) error {
+	return changePresence("busy", args)
+}
+
+// cmdBack marks us as available again.
+func cmdBack(args string) error {
+	return changePresence("", "")
+}
+
+// changePresence sets our presence from a command and confirms it.
+func changePresence(state, reason string) error {
+	if err := checkReason(reason); err != nil {
+		return err
+	}
+	if err := setLocalPresence(state, reason, false); err != nil {
+		return err
+	}
+
+	p := currentPresence()
+	if state == "" {
+		printNotice("You are available")
+	} else {
+		printNotice("You are now " + p.String())
+	}
+	return nil
+}
+
+// cmdWhois shows the details of a client: /whois <user>
+func cmdWhois(args string) error {
+	if args == "" {
+		return fmt.Errorf("usage: /whois <user>")
+	}
+	addr, ok := clients.Lookup(args)
+	if !ok {
+		return fmt.Errorf("no client named %q", args)
+	}
+
+	gui.Update(func(g *gocui.Gui) error {
+		return showOverlay(g, "client-info", "Client", clientInfoLines(addr))
+	})
+	return nil
+}
+
+// formatPresence describes the presence of a client for the Clients pane
+// and /whois.
+func formatPresence(c *ChatClient, now time.Time) string {
+	p := c.presence
+	if c.isLocal() {
+		p = currentPresence()
+	}
+	if p.State == "" && c.IsAway(now) {
+		return "idle"
+	}
+	return p.String()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePresence(t *testing.T) {
+	var cases = []struct {
+		presence    presence
+		expectError bool
+	}{
+		{presence{Version: 1}, false},
+		{presence{State: "away", Reason: "lunch", Version: 3}, false},
+		{presence{State: "busy", Version: 2}, false},
+		{presence{State: "asleep", Version: 1}, true},
+		{presence{State: "away", Reason: strings.Repeat("x", maxReasonLength+1), Version: 1}, true},
+		{presence{State: "away"}, true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			err := validatePresence(c.presence)
+			if c.expectError && err == nil {
+				t.Fatalf("Expected an error for %#v", c.presence)
+			}
+			if !c.expectError {
+				CheckNoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPresenceString(t *testing.T) {
+	var cases = []struct {
+		presence       presence
+		expectedResult string
+	}{
+		{presence{}, "available"},
+		{presence{State: "busy"}, "busy"},
+		{presence{State: "away", Reason: "lunch\x1b[31m"}, "away: lunch^[[31m"},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if result := c.presence.String(); result != c.expectedResult {
+				t.Fatalf("Expected %q but got %q", c.expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestSetPresence(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	cl := ClientList{bob: ChatClient{}, localAddress: ChatClient{}}
+
+	cl.setPresence(bob, presence{State: "away", Reason: "lunch", Version: 2})
+	// An older presence arriving late must not undo the newer one.
+	cl.setPresence(bob, presence{State: "busy", Version: 1})
+	if p := cl[bob].presence; p.State != "away" || p.Version != 2 {
+		t.Fatalf("Expected bob to be away at version 2 but got %#v", p)
+	}
+
+	cl.setPresence(bob, presence{Version: 3})
+	if p := cl[bob].presence; p.State != "" {
+		t.Fatalf("Expected bob to be back but got %#v", p)
+	}
+
+	// Only we change our own presence, and clients we do not know are
+	// not added.
+	cl.setPresence(localAddress, presence{State: "busy", Version: 10})
+	cl.setPresence("192.168.0.12:9999", presence{State: "busy", Version: 1})
+	if p := cl[localAddress].presence; p.Version != 0 {
+		t.Fatalf("Expected our presence to be left alone but got %#v", p)
+	}
+	if len(cl) != 2 {
+		t.Fatalf("Expected 2 clients but got %d", len(cl))
+	}
+}
+
+func TestReceivePresence(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	carol := NodeAddress("192.168.0.12:9999")
+	m := Messenger{clients: ClientList{bob: ChatClient{}, carol: ChatClient{}}}
+
+	// Bob may only speak for himself.
+	m.receivePresence(bob, map[NodeAddress]presence{
+		bob:   {State: "busy", Version: 2},
+		carol: {State: "away", Reason: "gone", Version: 100},
+	})
+	if c, _ := m.clients.get(bob); c.presence.State != "busy" {
+		t.Fatalf("Expected bob to be busy but got %#v", c.presence)
+	}
+	if c, _ := m.clients.get(carol); c.presence.Version != 0 {
+		t.Fatalf("Expected carol's presence to be left alone but got %#v", c.presence)
+	}
+}
+
+func TestRaisePresenceVersion(t *testing.T) {
+	defer func(p presence) { localPresence = p }(localPresence)
+	localPresence = presence{State: "away", Version: 5}
+
+	if _, ok := raisePresenceVersion(4); ok {
+		t.Fatal("Expected an older version to leave ours alone")
+	}
+	p, ok := raisePresenceVersion(7)
+	if !ok || p.State != "away" || p.Version != 8 {
+		t.Fatalf("Expected our presence to be away at version 8 but got %#v", p)
+	}
+	if p := currentPresence(); p.Version != 8 {
+		t.Fatalf("Expected version 8 but got %d", p.Version)
+	}
+}
+
+func TestNextPresenceVersion(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cases := []struct {
+		prev     int
+		expected int
+	}{
+		{0, 1000},
+		{999, 1000},
+		{1000, 1001},
+		{5000, 5001},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if v := nextPresenceVersion(c.prev, now); v != c.expected {
+				t.Fatalf("Expected %d but got %d", c.expected, v)
+			}
+		})
+	}
+}
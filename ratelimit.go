@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// floodReportInterval is how often the number of suppressed messages from
+// each flooding client is reported in the messages view.
+const floodReportInterval = 5 * time.Second
+
+// signalsPerSecond and signalBurst limit the typing broadcasts, reactions,
+// edits, digests and repair requests taken from each client. They have a
+// bucket of their own, so they neither use up what a client may say nor
+// count as suppressed messages.
+const (
+	signalsPerSecond = 5
+	signalBurst      = 20
+)
+
+// errSlowDown is returned when the user is sending messages faster than the
+// send limit allows.
+var errSlowDown = errors.New("sending too fast")
+
+// rateLimits configures how many chat messages may be sent and received. The
+// limits are token buckets: a burst of messages is allowed, after which
+// messages are only allowed at the given rate.
+type rateLimits struct {
+	SendPerSecond    float64 `json:"send-per-second"`
+	SendBurst        int     `json:"send-burst"`
+	ReceivePerSecond float64 `json:"receive-per-second"`
+	ReceiveBurst     int     `json:"receive-burst"`
+}
+
+// defaultRateLimits are used for any limit the configuration file does not
+// set.
+var defaultRateLimits = rateLimits{
+	SendPerSecond:    1,
+	SendBurst:        5,
+	ReceivePerSecond: 2,
+	ReceiveBurst:     10,
+}
+
+// withDefaults fills in the limits which are not set.
+func (l rateLimits) withDefaults() rateLimits {
+	if l.SendPerSecond <= 0 {
+		l.SendPerSecond = defaultRateLimits.SendPerSecond
+	}
+	if l.SendBurst <= 0 {
+		l.SendBurst = defaultRateLimits.SendBurst
+	}
+	if l.ReceivePerSecond <= 0 {
+		l.ReceivePerSecond = defaultRateLimits.ReceivePerSecond
+	}
+	if l.ReceiveBurst <= 0 {
+		l.ReceiveBurst = defaultRateLimits.ReceiveBurst
+	}
+	return l
+}
+
+// sendLimiter limits the chat messages we send. It is nil, meaning no limit,
+// until main sets it up.
+var sendLimiter *tokenBucket
+
+// tokenBucket allows events at a steady rate, with bursts of up to burst
+// events. It is not safe for use from several goroutines on its own.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// now returns the current time. Tests replace it with a fake clock.
+	now func() time.Time
+}
+
+// newTokenBucket creates a full tokenBucket.
+func newTokenBucket(rate float64, burst int, now func() time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now(),
+		now:    now,
+	}
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *tokenBucket) refill() {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow takes a token from the bucket if there is one, reporting whether the
+// event may go ahead.
+func (b *tokenBucket) Allow() bool {
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Wait returns how long it will be until the next token is available.
+func (b *tokenBucket) Wait() time.Duration {
+	b.refill()
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// floodGuard limits the chat messages shown from each client, counting the
+// ones it holds back so they can be reported as a single line.
+type floodGuard struct {
+	mu         sync.Mutex
+	rate       float64
+	burst      int
+	now        func() time.Time
+	buckets    map[NodeAddress]*tokenBucket
+	suppressed map[NodeAddress]int
+}
+
+// newFloodGuard creates a floodGuard allowing each client rate messages per
+// second, with bursts of up to burst messages.
+func newFloodGuard(rate float64, burst int, now func() time.Time) *floodGuard {
+	return &floodGuard{
+		rate:       rate,
+		burst:      burst,
+		now:        now,
+		buckets:    make(map[NodeAddress]*tokenBucket),
+		suppressed: make(map[NodeAddress]int),
+	}
+}
+
+// Allow reports whether a message from origin may be shown. Messages which
+// are not allowed are counted.
+func (f *floodGuard) Allow(origin NodeAddress) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.buckets[origin]
+	if !ok {
+		b = newTokenBucket(f.rate, f.burst, f.now)
+		f.buckets[origin] = b
+	}
+	if b.Allow() {
+		return true
+	}
+
+	f.suppressed[origin]++
+	rateLimitDrops.Inc(string(origin))
+	return false
+}
+
+// TakeSuppressed returns how many messages were held back from each client
+// since it was last called.
+func (f *floodGuard) TakeSuppressed() map[NodeAddress]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	suppressed := f.suppressed
+	f.suppressed = make(map[NodeAddress]int)
+	return suppressed
+}
+
+// ReportSuppressed periodically writes a line to the messages view for each
+// client whose messages were held back by the flood guard. Other traffic held
+// back is only logged, since nobody reads it.
+func (m *Messenger) ReportSuppressed() {
+	c := time.Tick(floodReportInterval)
+	for range c {
+		for addr, n := range m.flood.TakeSuppressed() {
+			sender, _ := m.clients.get(addr)
+			printNotice(fmt.Sprintf("%d messages suppressed from %s", n,
+				sanitizeLine(sender.GetName())))
+		}
+		for addr, n := range m.signalFlood.TakeSuppressed() {
+			logWarn("Dropped typing, reactions, edits and repair traffic", "from", addr, "count", n)
+		}
+		for addr, n := range m.fileFlood.TakeSuppressed() {
+			logWarn("Dropped file chunks and requests", "from", addr, "count", n)
+		}
+	}
+}
+
+// checkSendLimit returns errSlowDown if we are sending too fast.
+func checkSendLimit() error {
+	if sendLimiter != nil && !sendLimiter.Allow() {
+		return errSlowDown
+	}
+	return nil
+}
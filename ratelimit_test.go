@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestTokenBucket(t *testing.T) {
+	var cases = []struct {
+		rate  float64
+		burst int
+		// steps are the times, since the bucket was created, at which an
+		// event is attempted.
+		steps   []time.Duration
+		allowed []bool
+	}{
+		{ // A burst is allowed, then nothing until a token is earned
+			rate:    1,
+			burst:   3,
+			steps:   []time.Duration{0, 0, 0, 0, 500 * time.Millisecond, time.Second},
+			allowed: []bool{true, true, true, false, false, true},
+		},
+		{ // Tokens do not pile up past the burst while idle
+			rate:    1,
+			burst:   2,
+			steps:   []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute},
+			allowed: []bool{true, true, false, false},
+		},
+		{ // Fractional rates work
+			rate:    0.5,
+			burst:   1,
+			steps:   []time.Duration{0, time.Second, 2 * time.Second},
+			allowed: []bool{true, false, true},
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			clock := &fakeClock{t: time.Unix(1000, 0)}
+			start := clock.Now()
+			b := newTokenBucket(c.rate, c.burst, clock.Now)
+
+			for j, step := range c.steps {
+				clock.t = start.Add(step)
+				if allowed := b.Allow(); allowed != c.allowed[j] {
+					t.Fatalf("Step %d: expected allowed=%v", j, c.allowed[j])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	b := newTokenBucket(2, 1, clock.Now)
+
+	if wait := b.Wait(); wait != 0 {
+		t.Fatalf("Expected no wait with a full bucket but got %s", wait)
+	}
+	b.Allow()
+	if wait := b.Wait(); wait != 500*time.Millisecond {
+		t.Fatalf("Expected to wait 500ms but got %s", wait)
+	}
+	clock.Advance(200 * time.Millisecond)
+	if wait := b.Wait(); wait != 300*time.Millisecond {
+		t.Fatalf("Expected to wait 300ms but got %s", wait)
+	}
+}
+
+func TestFloodGuard(t *testing.T) {
+	flooder := NodeAddress("192.168.0.10:9999")
+	quiet := NodeAddress("192.168.0.11:9999")
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	f := newFloodGuard(1, 2, clock.Now)
+
+	for i := 0; i < 10; i++ {
+		f.Allow(flooder)
+	}
+	if !f.Allow(quiet) {
+		t.Fatalf("A flood from one client held back another")
+	}
+
+	suppressed := f.TakeSuppressed()
+	if suppressed[flooder] != 8 || len(suppressed) != 1 {
+		t.Fatalf("Expected 8 messages suppressed from the flooder but got %v", suppressed)
+	}
+	if suppressed := f.TakeSuppressed(); len(suppressed) != 0 {
+		t.Fatalf("Expected the suppressed counts to be reset but got %v", suppressed)
+	}
+
+	clock.Advance(time.Second)
+	if !f.Allow(flooder) {
+		t.Fatalf("Expected the flooder to be allowed again after a second")
+	}
+}
+
+func TestReceiveFloodLimit(t *testing.T) {
+	sender := NodeAddress("192.168.0.78:9999")
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	m := Messenger{
+		clients: ClientList{},
+		flood:   newFloodGuard(1, 3, clock.Now),
+	}
+
+	chat := message{Type: messageTypeChat, Body: "spam"}
+	for i := 0; i < 5; i++ {
+		m.receive(sender, chat.Encode())
+	}
+	if count := rateLimitDrops.Get(string(sender)); count != 2 {
+		t.Fatalf("Expected 2 dropped messages but got %d", count)
+	}
+
+	// Protocol messages are never held back.
+	req := message{Type: messageTypeUsernameReq, Body: "192.168.0.1:9999"}
+	m.receive(sender, req.Encode())
+	if count := rateLimitDrops.Get(string(sender)); count != 2 {
+		t.Fatalf("Expected 2 dropped messages but got %d", count)
+	}
+}
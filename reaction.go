@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxEmojiLength is the longest reaction, in bytes, that we accept.
+const maxEmojiLength = 32
+
+// maxEarlyTargets is how many messages which have not arrived yet we keep
+// reactions to, and earlyReactionWait how long we wait for one to arrive.
+const (
+	maxEarlyTargets   = 1000
+	earlyReactionWait = 10 * time.Minute
+)
+
+// maxRemovedTags is the most reaction tags one removal may name.
+const maxRemovedTags = 16
+
+// shortcodes maps the shortcodes accepted by /react to the emoji they stand
+// for. Other shortcodes are shown as written.
+var shortcodes = map[string]string{
+	":+1:":       "👍",
+	":-1:":       "👎",
+	":thumbsup:": "👍",
+	":heart:":    "❤",
+	":smile:":    "😄",
+	":laughing:": "😆",
+	":tada:":     "🎉",
+	":eyes:":     "👀",
+	":thinking:": "🤔",
+	":fire:":     "🔥",
+	":check:":    "✔",
+}
+
+// normalizeEmoji turns a shortcode into its emoji, so reactions written either
+// way are counted together.
+func normalizeEmoji(emoji string) string {
+	if e, ok := shortcodes[strings.ToLower(emoji)]; ok {
+		return e
+	}
+	return emoji
+}
+
+// validateEmoji checks that a reaction is short and has no spaces or control
+// characters in it.
+func validateEmoji(emoji string) error {
+	if emoji == "" {
+		return fmt.Errorf("reaction is empty")
+	}
+	if len(emoji) > maxEmojiLength {
+		return fmt.Errorf("reaction is longer than %d bytes", maxEmojiLength)
+	}
+	if !utf8.ValidString(emoji) {
+		return fmt.Errorf("reaction is not valid UTF-8")
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || isBidiControl(r) {
+			return fmt.Errorf("reaction contains %q", sanitizeLine(string(r)))
+		}
+	}
+	return nil
+}
+
+// reactionSet holds the reactions to one message as an observed-remove set.
+// Every add has a unique tag, and a removal names the tags its sender had
+// seen. A tag which has been removed stays removed, so adds and removals can
+// arrive in any order, or more than once, and every client ends up with the
+// same reactions.
+type reactionSet struct {
+	added map[reactionTag]string
+
+	// removed holds the removals. A removal only counts when it comes from
+	// the client which added the reaction.
+	removed map[reactionTag]bool
+}
+
+// reactionTag is a tag used by a client. Tags are chosen by their senders,
+// so the sender is part of the key, and nobody can take over another
+// client's tag.
+type reactionTag struct {
+	tag  string
+	from NodeAddress
+}
+
+// reactionCount is how many clients reacted to a message with an emoji.
+type reactionCount struct {
+	emoji string
+	count int
+	mine  bool
+}
+
+// reactionStore holds the reactions to every message, including messages
+// which have not arrived yet. The zero value is empty, and it is safe to use
+// from several goroutines.
+type reactionStore struct {
+	mu   sync.Mutex
+	sets map[string]*reactionSet
+
+	// early holds when the first reaction to each message which has not
+	// arrived came in, and earlyOrder those messages oldest first. It may
+	// name messages which have arrived since.
+	early      map[string]time.Time
+	earlyOrder []string
+}
+
+// set returns the reactionSet for target, creating it if needed. The caller
+// must hold s.mu.
+func (s *reactionStore) set(target string) *reactionSet {
+	if s.sets == nil {
+		s.sets = make(map[string]*reactionSet)
+	}
+	set, ok := s.sets[target]
+	if !ok {
+		set = &reactionSet{
+			added:   make(map[reactionTag]string),
+			removed: make(map[reactionTag]bool),
+		}
+		s.sets[target] = set
+	}
+	return set
+}
+
+// Add records that from reacted to target with emoji, using a new tag. It
+// reports whether the reactions to target changed.
+func (s *reactionStore) Add(target, tag, emoji string, from NodeAddress) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := s.set(target)
+	key := reactionTag{tag, from}
+	if _, ok := set.added[key]; ok {
+		return false
+	}
+	set.added[key] = emoji
+	return set.live(key)
+}
+
+// Remove records that from removed the reactions with the given tags from
+// target. It reports whether the reactions to target changed.
+func (s *reactionStore) Remove(target string, tags []string, from NodeAddress) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := s.set(target)
+	changed := false
+	for _, tag := range tags {
+		key := reactionTag{tag, from}
+		if set.live(key) {
+			changed = true
+		}
+		set.removed[key] = true
+	}
+	return changed
+}
+
+// live reports whether the reaction with the given tag has been added and
+// not removed.
+func (set *reactionSet) live(key reactionTag) bool {
+	_, ok := set.added[key]
+	return ok && !set.removed[key]
+}
+
+// Forget drops the reactions to target, which is no longer in the history.
+func (s *reactionStore) Forget(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sets, target)
+	delete(s.early, target)
+}
+
+// Early records that reactions to target came in at now, before target
+// itself. Reactions to messages which have not arrived within
+// earlyReactionWait are dropped, as are those to the oldest such messages
+// when there are more than maxEarlyTargets.
+func (s *reactionStore) Early(target string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.early == nil {
+		s.early = make(map[string]time.Time)
+	}
+	if _, ok := s.early[target]; !ok {
+		s.early[target] = now
+		s.earlyOrder = append(s.earlyOrder, target)
+	}
+
+	for len(s.earlyOrder) > 0 {
+		oldest := s.earlyOrder[0]
+		at, ok := s.early[oldest]
+		if ok && now.Sub(at) < earlyReactionWait && len(s.early) <= maxEarlyTargets {
+			break
+		}
+		s.earlyOrder = s.earlyOrder[1:]
+		if ok {
+			delete(s.early, oldest)
+			delete(s.sets, oldest)
+		}
+	}
+}
+
+// Arrived records that target has arrived, so its reactions are kept.
+func (s *reactionStore) Arrived(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.early, target)
+}
+
+// Tags returns the tags of from's reactions to target with emoji which have
+// not been removed.
+func (s *reactionStore) Tags(target, emoji string, from NodeAddress) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := s.set(target)
+	var tags []string
+	for key, e := range set.added {
+		if e == emoji && key.from == from && set.live(key) {
+			tags = append(tags, key.tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Counts returns how many clients reacted to target with each emoji, most
+// popular first.
+func (s *reactionStore) Counts(target string) []reactionCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, ok := s.sets[target]
+	if !ok {
+		return nil
+	}
+
+	// A client which added the same emoji twice still counts once.
+	clientsByEmoji := make(map[string]map[NodeAddress]bool)
+	for key, emoji := range set.added {
+		if !set.live(key) {
+			continue
+		}
+		if clientsByEmoji[emoji] == nil {
+			clientsByEmoji[emoji] = make(map[NodeAddress]bool)
+		}
+		clientsByEmoji[emoji][key.from] = true
+	}
+
+	counts := make([]reactionCount, 0, len(clientsByEmoji))
+	for emoji, from := range clientsByEmoji {
+		counts = append(counts, reactionCount{emoji: emoji, count: len(from), mine: from[localAddress]})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].emoji < counts[j].emoji
+	})
+	return counts
+}
+
+// formatReactions describes the reactions to a message for the line under it,
+// such as "👍 2  🎉 1". Our own reactions are marked with "*".
+func formatReactions(counts []reactionCount) string {
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		mine := ""
+		if c.mine {
+			mine = "*"
+		}
+		parts[i] = fmt.Sprintf("%s %d%s", sanitizeLine(c.emoji), c.count, mine)
+	}
+	return strings.Join(parts, "  ")
+}
+
+// React adds our reaction to the target message, or removes it if we had
+// already reacted with the same emoji.
+func (m *Messenger) React(target chatMessage, emoji string) error {
+	emoji = normalizeEmoji(emoji)
+	if err := validateEmoji(emoji); err != nil {
+		return err
+	}
+	if err := checkSendLimit(); err != nil {
+		return err
+	}
+
+	msg := message{
+		Type:    messageTypeReaction,
+		Body:    emoji,
+		Target:  m.history.WireID(target.ID),
+		Author:  m.wireAuthor(target.From),
+		Version: clientVersion,
+	}
+	if tags := m.reactions.Tags(target.ID, emoji, localAddress); len(tags) > 0 {
+		if len(tags) > maxRemovedTags {
+			tags = tags[:maxRemovedTags]
+		}
+		msg.Remove = true
+		msg.Tags = tags
+		m.reactions.Remove(target.ID, tags, localAddress)
+	} else {
+		msg.ID = newMessageID()
+		m.reactions.Add(target.ID, msg.ID, emoji, localAddress)
+	}
+	refreshMessages()
+
+	return broadcast(&msg)
+}
+
+// receiveReaction applies a reaction sent by another client.
+func (m *Messenger) receiveReaction(senderAddr NodeAddress, msg message) {
+	emoji := normalizeEmoji(msg.Body)
+	target := m.resolveRef(msg.Author, msg.Target)
+	m.reactions.Early(target, time.Now())
+
+	var changed bool
+	if msg.Remove {
+		changed = m.reactions.Remove(target, msg.Tags, senderAddr)
+	} else {
+		changed = m.reactions.Add(target, msg.ID, emoji, senderAddr)
+	}
+
+	// Reactions to messages which have not arrived are kept for a while in
+	// case they do.
+	if _, ok := m.history.Get(target); ok {
+		m.reactions.Arrived(target)
+		if changed {
+			refreshMessages()
+		}
+	}
+}
+
+// cmdReact toggles a reaction to a message: /react <N|id> <emoji>
+func cmdReact(args string) error {
+	ref, emoji := splitFirst(args)
+	if ref == "" || emoji == "" {
+		return fmt.Errorf("usage: /react <N|id> <emoji or :shortcode:>")
+	}
+
+	target, ok := chat.history.Find(ref)
+	if !ok {
+		return fmt.Errorf("no message %q", ref)
+	}
+	return chat.React(target, emoji)
+}
+
+// reactTo toggles a reaction from the message menu.
+func reactTo(id, emoji string) error {
+	target, ok := chat.history.Get(id)
+	if !ok {
+		return nil
+	}
+	if err := chat.React(target, emoji); err == errSlowDown {
+		printNotice("Slow down! Try reacting again in a moment")
+	} else if err != nil {
+		printNotice(fmt.Sprintf("Unable to react: %s", err))
+	}
+	return nil
+}
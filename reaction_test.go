@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// reactionOp is an add or a removal of a reaction, as received from a client.
+type reactionOp struct {
+	from   NodeAddress
+	remove bool
+	tag    string
+	emoji  string
+}
+
+func (op reactionOp) apply(s *reactionStore) {
+	if op.remove {
+		s.Remove("target--", []string{op.tag}, op.from)
+	} else {
+		s.Add("target--", op.tag, op.emoji, op.from)
+	}
+}
+
+func TestReactionConvergence(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	bob := NodeAddress("192.168.0.11:9999")
+	mallory := NodeAddress("192.168.0.12:9999")
+
+	ops := []reactionOp{
+		{from: alice, tag: "tag-a1--", emoji: "👍"},
+		{from: bob, tag: "tag-b1--", emoji: "👍"},
+		{from: alice, remove: true, tag: "tag-a1--"},
+		{from: alice, tag: "tag-a2--", emoji: "👍"}, // added again after removing
+		{from: bob, tag: "tag-b2--", emoji: "🎉"},
+		{from: mallory, remove: true, tag: "tag-b2--"}, // not his to remove
+		{from: bob, tag: "tag-b3--", emoji: "👍"},       // bob twice counts once
+	}
+	expected := []reactionCount{{emoji: "👍", count: 2}, {emoji: "🎉", count: 1}}
+
+	// Every order of the operations must end with the same reactions.
+	var permute func(done []reactionOp, rest []reactionOp)
+	tried := 0
+	permute = func(done []reactionOp, rest []reactionOp) {
+		if len(rest) == 0 {
+			var s reactionStore
+			for _, op := range done {
+				op.apply(&s)
+			}
+			// A gossiped operation can arrive twice.
+			done[0].apply(&s)
+
+			tried++
+			if counts := s.Counts("target--"); !reflect.DeepEqual(counts, expected) {
+				t.Fatalf("Order %v: expected %v but got %v", done, expected, counts)
+			}
+			return
+		}
+		for i := range rest {
+			next := append(append([]reactionOp{}, rest[:i]...), rest[i+1:]...)
+			permute(append(done, rest[i]), next)
+		}
+	}
+	permute(nil, ops)
+	if tried != 5040 {
+		t.Fatalf("Expected to try 5040 orders but tried %d", tried)
+	}
+}
+
+func TestReactionTags(t *testing.T) {
+	var s reactionStore
+	s.Add("target--", "tag-2---", "👍", localAddress)
+	s.Add("target--", "tag-1---", "👍", localAddress)
+	s.Add("target--", "tag-3---", "🎉", localAddress)
+	s.Add("target--", "tag-4---", "👍", "192.168.0.11:9999")
+
+	tags := s.Tags("target--", "👍", localAddress)
+	if !reflect.DeepEqual(tags, []string{"tag-1---", "tag-2---"}) {
+		t.Fatalf("Expected our two 👍 tags but got %v", tags)
+	}
+
+	if !s.Remove("target--", tags, localAddress) {
+		t.Fatalf("Expected the removal to change the reactions")
+	}
+	expected := []reactionCount{{emoji: "🎉", count: 1, mine: true}, {emoji: "👍", count: 1}}
+	if counts := s.Counts("target--"); !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v but got %v", expected, counts)
+	}
+	if formatted := formatReactions(expected); formatted != "🎉 1*  👍 1" {
+		t.Fatalf("Unexpected formatting %q", formatted)
+	}
+}
+
+func TestValidateReaction(t *testing.T) {
+	var cases = []struct {
+		message     message
+		expectError bool
+	}{
+		{message{Type: messageTypeReaction, Body: "👍", Target: "target--", ID: "tag-1---"}, false},
+		{message{Type: messageTypeReaction, Body: ":shrug:", Target: "target--", ID: "tag-1---"}, false},
+		{message{Type: messageTypeReaction, Body: "👍", Target: "target--", Remove: true, Tags: []string{"tag-1---"}}, false},
+		{message{Type: messageTypeReaction, Body: "👍", Target: "target--"}, true},
+		{message{Type: messageTypeReaction, Body: "👍", ID: "tag-1---"}, true},
+		{message{Type: messageTypeReaction, Body: "", Target: "target--", ID: "tag-1---"}, true},
+		{message{Type: messageTypeReaction, Body: "two words", Target: "target--", ID: "tag-1---"}, true},
+		{message{Type: messageTypeReaction, Body: "\x1b[31m", Target: "target--", ID: "tag-1---"}, true},
+		{message{Type: messageTypeReaction, Body: "👍", Target: "target--", Remove: true}, true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			err := c.message.validate()
+			if c.expectError && err == nil {
+				t.Fatalf("Expected an error for %#v", c.message)
+			}
+			if !c.expectError {
+				CheckNoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReactionTagsBySender(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	mallory := NodeAddress("192.168.0.66:9999")
+	var s reactionStore
+
+	// Mallory uses bob's tag, which must not take over or hide bob's reaction.
+	s.Add("target--", "tag-b1--", "👍", mallory)
+	s.Add("target--", "tag-b1--", "👍", bob)
+	s.Remove("target--", []string{"tag-b1--"}, mallory)
+
+	expected := []reactionCount{{emoji: "👍", count: 1}}
+	if counts := s.Counts("target--"); !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("Expected %v but got %v", expected, counts)
+	}
+	if tags := s.Tags("target--", "👍", bob); !reflect.DeepEqual(tags, []string{"tag-b1--"}) {
+		t.Fatalf("Expected bob's tag but got %v", tags)
+	}
+}
+
+func TestReactionToClaimedID(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	bob := NodeAddress("192.168.0.11:9999")
+	mallory := NodeAddress("192.168.0.66:9999")
+	m := Messenger{clients: ClientList{}, self: "10.0.0.4:9999"}
+
+	// Mallory took the ID of alice's message first.
+	m.history.Add(chatMessage{ID: "alice-1-", From: mallory, Body: "first"})
+	m.history.Add(chatMessage{ID: "alice-1-", From: alice, Body: "hello"})
+	aliceID := m.history.Resolve(alice, "alice-1-")
+
+	m.receiveReaction(bob, message{Type: messageTypeReaction, Body: "👍", ID: "tag-b1--", Target: "alice-1-", Author: alice})
+	if counts := m.reactions.Counts(aliceID); len(counts) != 1 {
+		t.Fatalf("Expected the reaction on alice's message but got %v", counts)
+	}
+	if counts := m.reactions.Counts("alice-1-"); len(counts) != 0 {
+		t.Fatalf("Expected no reaction on mallory's message but got %v", counts)
+	}
+	if ref := m.resolveRef(alice, "alice-1-"); ref != aliceID {
+		t.Fatalf("Expected a reply to resolve to %q but got %q", aliceID, ref)
+	}
+}
+
+func TestEarlyReactions(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	start := time.Now()
+	var s reactionStore
+
+	react := func(target string, at time.Time) {
+		s.Early(target, at)
+		s.Add(target, "tag-"+target[:4], "👍", bob)
+	}
+	react("late----", start)
+	react("arrived-", start)
+	s.Arrived("arrived-")
+
+	// Reactions to a message which does not arrive in time are dropped.
+	react("next----", start.Add(earlyReactionWait))
+	if len(s.Counts("late----")) != 0 || len(s.Counts("arrived-")) != 1 || len(s.Counts("next----")) != 1 {
+		t.Fatalf("Expected only the reactions to the late message to be dropped")
+	}
+
+	// So are the oldest when too many messages are waited for.
+	for i := 0; i < maxEarlyTargets; i++ {
+		react(fmt.Sprintf("t%07d", i), start.Add(earlyReactionWait))
+	}
+	if len(s.Counts("next----")) != 0 || len(s.Counts("t0000000")) != 1 || len(s.early) != maxEarlyTargets {
+		t.Fatalf("Expected the oldest early reactions to be dropped, with %d waiting", len(s.early))
+	}
+
+	s.Forget("arrived-")
+	if len(s.Counts("arrived-")) != 0 {
+		t.Fatalf("Expected the reactions to a forgotten message to be dropped")
+	}
+}
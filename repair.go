@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+const (
+	// digestInterval is how often we tell the other clients which room
+	// messages we have.
+	digestInterval = 10 * time.Second
+
+	// maxRepairBatch is how many missing messages are sent in answer to one
+	// repair request.
+	maxRepairBatch = 5
+
+	// repairTimeout is how long the answers to a repair request we sent are
+	// accepted.
+	repairTimeout = 2 * digestInterval
+)
+
+// sessionEpoch identifies this run of the client. Sequence numbers start
+// again from 1 when a client restarts, so they are only compared between
+// messages with the same epoch.
+var sessionEpoch = time.Now().Unix()
+
+// highWater is how far along a client's room messages we have every message,
+// as sent in a digest.
+type highWater struct {
+	Epoch int64 `json:"e"`
+	Seq   int   `json:"s"`
+}
+
+// seqStream holds the sequence numbers of the room messages from one run of
+// one client.
+type seqStream struct {
+	epoch int64
+
+	// mark is the highest sequence number such that we have seen it and
+	// every one before it, and highest is the highest we have seen at all.
+	mark    int
+	highest int
+	ids     map[int]string
+
+	// byID maps a message ID back to the sequence numbers in ids which
+	// refer to it, including those of its edits and delete.
+	byID map[string][]int
+}
+
+// seqLog tracks the sequence numbers of the room messages we have seen, so we
+// can tell which are missing. Only the latest run of each client is kept. The
+// zero value is empty, and it is safe to use from several goroutines.
+type seqLog struct {
+	mu      sync.Mutex
+	last    int
+	streams map[NodeAddress]*seqStream
+}
+
+// Next returns the sequence number for the next room message we send.
+func (l *seqLog) Next() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last++
+	return l.last
+}
+
+// stream returns the stream for origin at epoch, creating it or replacing an
+// older run if needed, or nil if epoch is older than the run we know. The
+// caller must hold l.mu.
+func (l *seqLog) stream(origin NodeAddress, epoch int64, start int) *seqStream {
+	if l.streams == nil {
+		l.streams = make(map[NodeAddress]*seqStream)
+	}
+	s, ok := l.streams[origin]
+	if ok && s.epoch == epoch {
+		return s
+	}
+	if ok && s.epoch > epoch {
+		return nil
+	}
+
+	// A client which started after us sent nothing we could have seen
+	// before, so we want all of its messages. Otherwise we only want those
+	// from when we first heard of it.
+	if epoch >= sessionEpoch {
+		start = 0
+	}
+	s = &seqStream{epoch: epoch, mark: start, highest: start, ids: make(map[int]string), byID: make(map[string][]int)}
+	l.streams[origin] = s
+	return s
+}
+
+// Saw records that the room message id is number seq from origin's run at
+// epoch.
+func (l *seqLog) Saw(origin NodeAddress, epoch int64, seq int, id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.stream(origin, epoch, seq-1)
+	if s == nil || seq <= 0 {
+		return
+	}
+	if _, ok := s.ids[seq]; ok || seq <= s.mark {
+		// Seen already, or sent before we heard of origin.
+		return
+	}
+	s.ids[seq] = id
+	s.byID[id] = append(s.byID[id], seq)
+	if seq > s.highest {
+		s.highest = seq
+	}
+	for s.ids[s.mark+1] != "" {
+		s.mark++
+	}
+}
+
+// Forget drops the sequence numbers referring to the message id, which is no
+// longer in the history, so it cannot be sent again anyway. Those after a
+// gap are kept, since the mark still has to move past them.
+func (l *seqLog) Forget(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, s := range l.streams {
+		var kept []int
+		for _, seq := range s.byID[id] {
+			if seq <= s.mark {
+				delete(s.ids, seq)
+			} else {
+				kept = append(kept, seq)
+			}
+		}
+		if len(kept) > 0 {
+			s.byID[id] = kept
+		} else {
+			delete(s.byID, id)
+		}
+	}
+}
+
+// Marks returns how far we have every message from each client.
+func (l *seqLog) Marks() map[NodeAddress]highWater {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	marks := make(map[NodeAddress]highWater, len(l.streams))
+	for origin, s := range l.streams {
+		marks[origin] = highWater{Epoch: s.epoch, Seq: s.mark}
+	}
+	return marks
+}
+
+// Behind reports whether a peer with the given mark for origin has messages
+// we lack, and if so from which sequence number we want them.
+func (l *seqLog) Behind(origin NodeAddress, theirs highWater) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.stream(origin, theirs.Epoch, theirs.Seq)
+	if s == nil || s.mark >= theirs.Seq {
+		return 0, false
+	}
+	return s.mark, true
+}
+
+// Since returns up to limit of the IDs we have of origin's messages at epoch
+// numbered after seq, by sequence number.
+func (l *seqLog) Since(origin NodeAddress, epoch int64, seq, limit int) map[int]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.streams[origin]
+	if !ok || s.epoch != epoch {
+		return nil
+	}
+	ids := make(map[int]string)
+	for n := seq + 1; n <= s.highest && len(ids) < limit; n++ {
+		if id, ok := s.ids[n]; ok {
+			ids[n] = id
+		}
+	}
+	return ids
+}
+
+// repairKey identifies a repair request we sent to peer for origin's run at
+// epoch.
+type repairKey struct {
+	peer   NodeAddress
+	origin NodeAddress
+	epoch  int64
+}
+
+// repairRequest is the range of sequence numbers a repair request asked for,
+// after since and up to until, and when it was sent.
+type repairRequest struct {
+	since, until int
+	at           time.Time
+}
+
+// repairLog holds the repair requests we sent, so only messages sent again in
+// answer to one are accepted. Anyone can claim to be sending a message again
+// on behalf of another client. The zero value is empty, and it is safe to use
+// from several goroutines.
+type repairLog struct {
+	mu    sync.Mutex
+	asked map[repairKey]repairRequest
+}
+
+// Ask records that we asked peer for origin's messages at epoch after since,
+// which peer said it has up to until.
+func (l *repairLog) Ask(peer, origin NodeAddress, epoch int64, since, until int, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.asked == nil {
+		l.asked = make(map[repairKey]repairRequest)
+	}
+	for key, req := range l.asked {
+		if now.Sub(req.at) > repairTimeout {
+			delete(l.asked, key)
+		}
+	}
+	l.asked[repairKey{peer, origin, epoch}] = repairRequest{since: since, until: until, at: now}
+}
+
+// Answers reports whether a message numbered seq in origin's run at epoch,
+// sent again by peer, answers a repair request we sent.
+func (l *repairLog) Answers(peer, origin NodeAddress, epoch int64, seq int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	req, ok := l.asked[repairKey{peer, origin, epoch}]
+	return ok && now.Sub(req.at) <= repairTimeout && seq > req.since && seq <= req.until
+}
+
+// address returns our address, which a test may change to run several
+// Messengers side by side.
+func (m *Messenger) address() NodeAddress {
+	if m.self != "" {
+		return m.self
+	}
+	return localAddress
+}
+
+// broadcast sends msg to the cluster through the Messenger's transport, which
+// is smudge unless a test replaced it.
+func (m *Messenger) broadcast(msg *message) error {
+	if m.transport == nil {
+		return broadcast(msg)
+	}
+	data, err := seal(msg.Encode())
+	if err != nil {
+		return err
+	}
+	if err := m.transport(data); err != nil {
+		return err
+	}
+	sentMessages.Inc(msg.Type.String())
+	recentOrigins.Add(m.address(), time.Now())
+	return nil
+}
+
+// digestMessages splits marks into as few digests as fit in a broadcast.
+func digestMessages(marks map[NodeAddress]highWater) ([]message, error) {
+	origins := make([]NodeAddress, 0, len(marks))
+	for origin := range marks {
+		origins = append(origins, origin)
+	}
+	sort.Slice(origins, func(i, j int) bool { return origins[i] < origins[j] })
+
+	var msgs []message
+	msg := message{Type: messageTypeDigest, Marks: map[NodeAddress]highWater{}, Version: clientVersion}
+	for _, origin := range origins {
+		msg.Marks[origin] = marks[origin]
+		data, err := seal(msg.Encode())
+		if err != nil {
+			return nil, err
+		}
+		if len(data) <= smudge.GetMaxBroadcastBytes() {
+			continue
+		}
+		if len(msg.Marks) == 1 {
+			return nil, fmt.Errorf("the mark for %s does not fit in a broadcast", origin)
+		}
+
+		// Send what fit, and start the next digest with this mark.
+		delete(msg.Marks, origin)
+		msgs = append(msgs, msg)
+		msg = message{Type: messageTypeDigest, Marks: map[NodeAddress]highWater{origin: marks[origin]},
+			Version: clientVersion}
+	}
+	if len(msg.Marks) > 0 {
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// sendDigests tells the other clients which room messages we have. Our own
+// run is included before we have sent anything, so clients hear of it before
+// a first message which could be lost.
+func (m *Messenger) sendDigests() {
+	marks := m.seqs.Marks()
+	if _, ok := marks[m.address()]; !ok {
+		marks[m.address()] = highWater{Epoch: sessionEpoch}
+	}
+	msgs, err := digestMessages(marks)
+	if err != nil {
+		logError("Failed to make a digest", "err", err)
+	}
+	for _, msg := range msgs {
+		if err := m.broadcast(&msg); err != nil {
+			logError("Failed to send a digest", "err", err)
+		}
+	}
+}
+
+// GossipDigests periodically sends our digests, so clients which missed a
+// room message can ask for it again.
+func (m *Messenger) GossipDigests() {
+	for range time.Tick(digestInterval) {
+		m.sendDigests()
+	}
+}
+
+// receiveDigest asks senderAddr for the messages it has which we lack.
+func (m *Messenger) receiveDigest(senderAddr NodeAddress, marks map[NodeAddress]highWater) {
+	for origin, theirs := range marks {
+		if err := validateAddress(origin); err != nil {
+			logWarn("Ignoring part of a digest", "from", senderAddr, "err", err)
+			continue
+		}
+		if origin == m.address() || theirs.Epoch <= 0 || theirs.Seq < 0 {
+			continue
+		}
+		since, behind := m.seqs.Behind(origin, theirs)
+		if !behind {
+			continue
+		}
+
+		logDebug("Asking for missing messages", "peer", senderAddr, "origin", origin, "after", since)
+		req := message{
+			Type:    messageTypeRepairReq,
+			To:      senderAddr,
+			Origin:  origin,
+			Epoch:   theirs.Epoch,
+			Seq:     since,
+			Version: clientVersion,
+		}
+		if err := m.broadcast(&req); err != nil {
+			logError("Failed to ask for missing messages", "err", err)
+			continue
+		}
+		m.repairs.Ask(senderAddr, origin, theirs.Epoch, since, theirs.Seq, time.Now())
+	}
+}
+
+// receiveRelayed records a room message which senderAddr sent again on
+// behalf of msg.Origin. Nothing proves that the origin sent it, so it is
+// stored as coming from senderAddr and shown as unverified, and the origin
+// cannot later edit or delete it.
+func (m *Messenger) receiveRelayed(senderAddr NodeAddress, msg message) {
+	nameOf := func(addr NodeAddress) string {
+		if c, _ := m.clients.get(addr); c.GetName() != "" {
+			return c.GetName()
+		}
+		return string(addr)
+	}
+	m.record(chatMessage{
+		ID:      msg.ID,
+		From:    senderAddr,
+		Sender:  nameOf(senderAddr),
+		Label:   fmt.Sprintf("%s (unverified, sent again by %s)", nameOf(msg.Origin), nameOf(senderAddr)),
+		Channel: roomChannel,
+		Body:    msg.Body,
+		ReplyTo: m.resolveRef(msg.Author, msg.ReplyTo),
+		Time:    time.Now(),
+	})
+	m.seqs.Saw(msg.Origin, msg.Epoch, msg.Seq, msg.ID)
+}
+
+// receiveRepairReq sends the messages asked for by another client again.
+// They are broadcast, but only the client which asked takes them, since it
+// alone can tell they answer its request. A deleted message is sent as a delete, so it fills the gap without being
+// shown. We may not have the messages from before we heard of the origin;
+// the others are sent anyway, and the rest can come from another client.
+// Messages we were sent again ourselves are not passed on, since we cannot
+// tell that the origin really sent them.
+func (m *Messenger) receiveRepairReq(req message) {
+	if req.To != m.address() {
+		return
+	}
+
+	ids := m.seqs.Since(req.Origin, req.Epoch, req.Seq, maxRepairBatch)
+	seqs := make([]int, 0, len(ids))
+	for seq := range ids {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	// Our own messages are stored as coming from localAddress.
+	from := req.Origin
+	if from == m.address() {
+		from = localAddress
+	}
+	for _, seq := range seqs {
+		stored, ok := m.history.GetFrom(from, ids[seq])
+		if !ok {
+			continue
+		}
+		msg := message{
+			Type:     messageTypeChat,
+			Body:     stored.Body,
+			ID:       ids[seq],
+			ReplyTo:  m.history.WireID(stored.ReplyTo),
+			Author:   m.wireAuthor(m.history.Author(stored.ReplyTo)),
+			Revision: stored.Revision,
+			Origin:   req.Origin,
+			Epoch:    req.Epoch,
+			Seq:      seq,
+			Version:  clientVersion,
+		}
+		if stored.Deleted {
+			msg = message{
+				Type:    messageTypeDelete,
+				Target:  ids[seq],
+				Origin:  req.Origin,
+				Epoch:   req.Epoch,
+				Seq:     seq,
+				Version: clientVersion,
+			}
+		}
+		if err := m.broadcast(&msg); err != nil {
+			logError("Failed to send a missing message again", "err", err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+// lossyNetwork connects Messengers in memory, dropping each delivery of a
+// broadcast with the given probability. Broadcasts are queued and delivered
+// by deliver, so a Messenger is never re-entered while it is sending.
+type lossyNetwork struct {
+	nodes []*Messenger
+	loss  float64
+	rand  *rand.Rand
+	queue []queuedBroadcast
+
+	sent, dropped int
+}
+
+type queuedBroadcast struct {
+	from NodeAddress
+	data []byte
+}
+
+func newLossyNetwork(n int, loss float64) *lossyNetwork {
+	net := &lossyNetwork{loss: loss, rand: rand.New(rand.NewSource(1))}
+	for i := 0; i < n; i++ {
+		m := &Messenger{clients: ClientList{}, self: NodeAddress(fmt.Sprintf("10.0.0.%d:9999", i+1))}
+		m.transport = func(data []byte) error {
+			net.queue = append(net.queue, queuedBroadcast{from: m.self, data: data})
+			return nil
+		}
+		net.nodes = append(net.nodes, m)
+	}
+	return net
+}
+
+// deliver hands out the queued broadcasts, including those sent while doing
+// so, until none are left.
+func (net *lossyNetwork) deliver() {
+	for len(net.queue) > 0 {
+		b := net.queue[0]
+		net.queue = net.queue[1:]
+		for _, node := range net.nodes {
+			if node.self == b.from {
+				continue
+			}
+			net.sent++
+			if net.rand.Float64() < net.loss {
+				net.dropped++
+				continue
+			}
+			node.receive(b.from, b.data)
+		}
+	}
+}
+
+// missing counts the room messages sent by the first node which each of the
+// others lacks, going by their high-water marks.
+func (net *lossyNetwork) missing(total int) int {
+	missing := 0
+	for _, node := range net.nodes[1:] {
+		missing += total - node.seqs.Marks()[net.nodes[0].self].Seq
+	}
+	return missing
+}
+
+func TestAntiEntropyRepairsLoss(t *testing.T) {
+	const messages = 40
+	net := newLossyNetwork(4, 0.3)
+	sender := net.nodes[0]
+
+	for i := 0; i < messages; i++ {
+		CheckNoError(t, sender.send(message{Type: messageTypeChat, Body: fmt.Sprintf("message %d", i)}, "alice"))
+	}
+	net.deliver()
+
+	// Delete a message which some node lost, so it is repaired as a delete
+	// and never shown there.
+	lost := 0
+	var deleted chatMessage
+	for _, id := range sender.seqs.Since(sender.self, sessionEpoch, 0, messages) {
+		for _, node := range net.nodes[1:] {
+			if _, ok := node.history.Get(id); !ok {
+				lost++
+				deleted, _ = sender.history.Get(id)
+			}
+		}
+	}
+	if lost == 0 {
+		t.Fatalf("Expected some of %d deliveries to be lost", messages*3)
+	}
+	sender.history.Change(deleted.ID, messageChange{from: deleted.From, delete: true})
+	del := message{Type: messageTypeDelete, Target: deleted.ID}
+	for _, node := range net.nodes[1:] {
+		node.receive(sender.self, del.Encode())
+	}
+
+	rounds := 0
+	for ; rounds < 50 && net.missing(messages) > 0; rounds++ {
+		for _, node := range net.nodes {
+			node.sendDigests()
+		}
+		net.deliver()
+	}
+	t.Logf("%d of %d room messages were lost at 30%% loss and repaired in %d rounds of digests (%d of %d deliveries dropped)",
+		lost, messages*3, rounds, net.dropped, net.sent)
+
+	if n := net.missing(messages); n > 0 {
+		t.Fatalf("Expected every message to be repaired but %d are missing", n)
+	}
+	for _, id := range sender.seqs.Since(sender.self, sessionEpoch, 0, messages) {
+		for _, node := range net.nodes[1:] {
+			_, ok := node.history.Get(id)
+			if !ok && id != deleted.ID {
+				t.Fatalf("Expected %s to have message %s", node.self, id)
+			}
+		}
+	}
+	for _, node := range net.nodes[1:] {
+		if msg, ok := node.history.Get(deleted.ID); ok && !msg.Deleted {
+			t.Fatalf("Expected %s not to show the deleted message", node.self)
+		}
+	}
+}
+
+func TestSeqLog(t *testing.T) {
+	alice := NodeAddress("10.0.0.1:9999")
+	var log seqLog
+
+	// A run which started before us is only tracked from when we hear of it.
+	old := sessionEpoch - 100
+	log.Saw(alice, old, 7, "AAAAAAA7")
+	log.Saw(alice, old, 9, "AAAAAAA9")
+	if mark := log.Marks()[alice]; mark != (highWater{Epoch: old, Seq: 7}) {
+		t.Fatalf("Expected a mark of 7 but got %#v", mark)
+	}
+	if since, behind := log.Behind(alice, highWater{Epoch: old, Seq: 9}); !behind || since != 7 {
+		t.Fatalf("Expected to want messages after 7 but got %d, %v", since, behind)
+	}
+	log.Saw(alice, old, 8, "AAAAAAA8")
+	if _, behind := log.Behind(alice, highWater{Epoch: old, Seq: 9}); behind {
+		t.Fatalf("Expected to have every message up to 9")
+	}
+	if ids := log.Since(alice, old, 7, 1); len(ids) != 1 || ids[8] != "AAAAAAA8" {
+		t.Fatalf("Expected message 8 but got %v", ids)
+	}
+	log.Forget("AAAAAAA8")
+	if ids := log.Since(alice, old, 7, 2); len(ids) != 1 || ids[9] != "AAAAAAA9" {
+		t.Fatalf("Expected message 8 to be forgotten but got %v", ids)
+	}
+
+	// A restart starts a new run, and the old one is forgotten.
+	log.Saw(alice, sessionEpoch+1, 2, "BBBBBBB2")
+	if mark := log.Marks()[alice]; mark != (highWater{Epoch: sessionEpoch + 1, Seq: 0}) {
+		t.Fatalf("Expected to want the whole new run but got %#v", mark)
+	}
+	log.Saw(alice, old, 10, "AAAAAA10")
+	if mark := log.Marks()[alice]; mark.Epoch != sessionEpoch+1 {
+		t.Fatalf("Expected the old run to stay forgotten but got %#v", mark)
+	}
+}
+
+func TestDigestMessages(t *testing.T) {
+	marks := map[NodeAddress]highWater{}
+	for i := 0; i < 50; i++ {
+		marks[NodeAddress(fmt.Sprintf("192.168.100.%d:65535", i))] = highWater{Epoch: sessionEpoch, Seq: 100000 + i}
+	}
+
+	msgs, err := digestMessages(marks)
+	CheckNoError(t, err)
+	found := 0
+	for _, msg := range msgs {
+		CheckNoError(t, msg.validate())
+		data, err := seal(msg.Encode())
+		CheckNoError(t, err)
+		if len(data) > smudge.GetMaxBroadcastBytes() {
+			t.Fatalf("Expected at most %d bytes but got %d", smudge.GetMaxBroadcastBytes(), len(data))
+		}
+		found += len(msg.Marks)
+	}
+	if found != len(marks) {
+		t.Fatalf("Expected %d marks but got %d", len(marks), found)
+	}
+}
+
+func TestReceiveRelayed(t *testing.T) {
+	alice := NodeAddress("10.0.0.1:9999")
+	bob := NodeAddress("10.0.0.2:9999")
+	mallory := NodeAddress("10.0.0.3:9999")
+	m := &Messenger{clients: ClientList{}, self: "10.0.0.4:9999", transport: func([]byte) error { return nil }}
+	relay := func(from NodeAddress, seq int, id string) {
+		msg := message{Type: messageTypeChat, Body: "hi", ID: id, Origin: alice, Epoch: sessionEpoch, Seq: seq}
+		data, err := seal(msg.Encode())
+		CheckNoError(t, err)
+		m.receive(from, data)
+	}
+
+	// Messages sent again are only accepted from the client we asked, for
+	// the messages we asked for.
+	relay(mallory, 1, "AAAAAAA1")
+	m.receiveDigest(bob, map[NodeAddress]highWater{alice: {Epoch: sessionEpoch, Seq: 2}})
+	relay(mallory, 1, "AAAAAAA1")
+	relay(bob, 3, "AAAAAAA3")
+	if _, ok := m.history.Get("AAAAAAA1"); ok {
+		t.Fatalf("Expected a message we did not ask mallory for to be rejected")
+	}
+	if _, ok := m.history.Get("AAAAAAA3"); ok {
+		t.Fatalf("Expected a message past what we asked bob for to be rejected")
+	}
+
+	// Those accepted fill the gap, but are not taken to come from alice.
+	relay(bob, 1, "AAAAAAA1")
+	msg, ok := m.history.Get("AAAAAAA1")
+	if !ok || msg.From != bob || !strings.Contains(msg.Label, "unverified") {
+		t.Fatalf("Expected an unverified message from bob but got %#v", msg)
+	}
+	if mark := m.seqs.Marks()[alice]; mark.Seq != 1 {
+		t.Fatalf("Expected a mark of 1 but got %#v", mark)
+	}
+
+	// A delete sent again fills the gap without deleting anything.
+	del := message{Type: messageTypeDelete, Target: "AAAAAAA1", Origin: alice, Epoch: sessionEpoch, Seq: 2}
+	data, err := seal(del.Encode())
+	CheckNoError(t, err)
+	m.receive(bob, data)
+	if msg, _ := m.history.Get("AAAAAAA1"); msg.Deleted {
+		t.Fatalf("Expected the message to stay")
+	}
+	if mark := m.seqs.Marks()[alice]; mark.Seq != 2 {
+		t.Fatalf("Expected a mark of 2 but got %#v", mark)
+	}
+}
+
+func TestForgetEvicted(t *testing.T) {
+	alice := NodeAddress("10.0.0.1:9999")
+	bob := NodeAddress("10.0.0.2:9999")
+	m := &Messenger{clients: ClientList{}, self: "10.0.0.4:9999"}
+	m.history.limit = 1
+
+	m.deliveries.Sent(message{Type: messageTypeChat, ID: "AAAAAAAA", To: bob}, time.Now())
+	m.record(chatMessage{ID: "AAAAAAAA", From: localAddress, To: bob, Body: "hi bob"})
+	m.seqs.Saw(alice, sessionEpoch+1, 1, "BBBBBBBB")
+	m.record(chatMessage{ID: "BBBBBBBB", From: alice, Body: "hello"})
+	m.reactions.Add("BBBBBBBB", "tag-1---", "👍", bob)
+	if _, ok := m.deliveries.State("AAAAAAAA"); ok {
+		t.Fatalf("Expected the forgotten direct message to be no longer tracked")
+	}
+
+	m.record(chatMessage{ID: "CCCCCCCC", From: alice, Body: "again"})
+	if ids := m.seqs.Since(alice, sessionEpoch+1, 0, maxRepairBatch); len(ids) != 0 {
+		t.Fatalf("Expected the sequence number of the forgotten message to be dropped but got %v", ids)
+	}
+	if counts := m.reactions.Counts("BBBBBBBB"); len(counts) != 0 {
+		t.Fatalf("Expected the reactions to the forgotten message to be dropped but got %v", counts)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// snippetLength is how many characters of a parent message are quoted above a
+// reply.
+const snippetLength = 40
+
+// replySnippet describes the parent of a reply for the line above it, or says
+// that the parent has not arrived yet.
+func replySnippet(parentID string) string {
+	parent, ok := chat.history.Get(parentID)
+	if !ok {
+		return "↱ reply to a message not received yet"
+	}
+	return fmt.Sprintf("↱ %s: %s", sanitizeLine(parent.Sender), snippet(parent.Body))
+}
+
+// snippet shortens a message body to the start of its first line.
+func snippet(body string) string {
+	line := strings.SplitN(strings.TrimSpace(body), "\n", 2)[0]
+	line = sanitizeLine(line)
+	if r := []rune(line); len(r) > snippetLength {
+		return string(r[:snippetLength-1]) + "…"
+	}
+	return line
+}
+
+// cmdReply replies to a message: /reply <N|id> <text>, where N counts back
+// from the most recent message.
+func cmdReply(args string) error {
+	ref, text := splitFirst(args)
+	if ref == "" || text == "" {
+		return fmt.Errorf("usage: /reply <N|id> <text>")
+	}
+
+	parent, ok := chat.history.Find(ref)
+	if !ok {
+		return fmt.Errorf("no message %q", ref)
+	}
+	return chat.SendReply(parent, text)
+}
+
+// cmdThread shows a message and all of its replies: /thread [N|id]
+func cmdThread(args string) error {
+	ref := args
+	if ref == "" {
+		ref = "1"
+	}
+
+	msg, ok := chat.history.Find(ref)
+	if !ok {
+		return fmt.Errorf("no message %q", ref)
+	}
+
+	// Show the top of the thread the message is in.
+	msg = threadRoot(&chat.history, msg)
+	gui.Update(func(g *gocui.Gui) error {
+		return showThread(g, msg.ID)
+	})
+	return nil
+}
+
+// threadRoot follows the replies up from msg to the first message of its
+// thread. Other clients choose what their messages reply to, so replies may
+// go round in a circle; the walk stops when it comes back to a message.
+func threadRoot(store *messageStore, msg chatMessage) chatMessage {
+	seen := map[string]bool{msg.ID: true}
+	for msg.ReplyTo != "" && !seen[msg.ReplyTo] {
+		parent, ok := store.Get(msg.ReplyTo)
+		if !ok {
+			break
+		}
+		seen[parent.ID] = true
+		msg = parent
+	}
+	return msg
+}
+
+// showThread opens an overlay listing the message with the given ID followed
+// by its replies, in the order they arrived.
+func showThread(g *gocui.Gui, id string) error {
+	var lines []string
+	if parent, ok := chat.history.Get(id); ok {
+		lines = append(lines, threadLines(parent, "")...)
+		if parent.ReplyTo != "" {
+			lines = append([]string{"(" + replySnippet(parent.ReplyTo) + ")"}, lines...)
+		}
+	} else {
+		lines = append(lines, "(message not received yet)")
+	}
+
+	replies := chat.history.Thread(id)
+	for _, reply := range replies {
+		lines = append(lines, threadLines(reply, "  ")...)
+	}
+	if len(replies) == 0 {
+		lines = append(lines, "", "No replies yet")
+	}
+
+	return showOverlay(g, "thread", "Thread (Esc to close)", lines)
+}
+
+// threadLines formats a message for the thread overlay, without colors.
+func threadLines(msg chatMessage, indent string) []string {
+	body := strings.Split(sanitizeText(msg.Body), "\n")
+	lines := []string{fmt.Sprintf("%s%s %s: %s", indent, msg.Time.Format("15:04"),
+		sanitizeLine(msg.Label), body[0])}
+	for _, line := range body[1:] {
+		lines = append(lines, indent+continuationIndent+line)
+	}
+	return lines
+}
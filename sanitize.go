@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxUsernameLength is the longest username, in characters, that we accept
+// from ourselves or from other clients.
+const maxUsernameLength = 24
+
+// Everything another client sends us is untrusted. gocui interprets escape
+// sequences written to its views, so a peer could recolor or garble our screen,
+// and an embedded newline or bidi override could make a line look like it came
+// from somebody else. Every peer-supplied string passes through one of the
+// functions below before it is shown.
+
+// sanitizeText makes a multi-line text, such as a message body, safe to
+// display. Newlines are kept, tabs become spaces, and every other control
+// character or bidi control is replaced with a visible escape like "^[" or
+// "<U+202E>". Invalid UTF-8 becomes U+FFFD.
+func sanitizeText(s string) string {
+	return sanitize(s, true)
+}
+
+// sanitizeLine is like sanitizeText, but also escapes newlines, for strings
+// which must stay on one line such as names.
+func sanitizeLine(s string) string {
+	return sanitize(s, false)
+}
+
+func sanitize(s string, multiline bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == utf8.RuneError && !isEncodedRuneError(s[i:]):
+			b.WriteRune(utf8.RuneError)
+		case r == '\n' && multiline:
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case r < 0x20:
+			b.WriteByte('^')
+			b.WriteByte(byte(r) + 0x40)
+		case r == 0x7f:
+			b.WriteString("^?")
+		case unicode.IsControl(r) || isBidiControl(r):
+			fmt.Fprintf(&b, "<U+%04X>", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// isEncodedRuneError reports whether s starts with a real, correctly encoded
+// U+FFFD rather than an invalid byte.
+func isEncodedRuneError(s string) bool {
+	return strings.HasPrefix(s, string(utf8.RuneError))
+}
+
+// isBidiControl reports whether r changes the direction of the text around it,
+// which can make a line display in a different order than it was written.
+func isBidiControl(r rune) bool {
+	switch {
+	case r == 0x061c, r == 0x200e, r == 0x200f:
+		return true
+	case r >= 0x202a && r <= 0x202e:
+		return true
+	case r >= 0x2066 && r <= 0x2069:
+		return true
+	}
+	return false
+}
+
+// validateUsername checks that name is short enough and only uses letters,
+// digits, '.', '_' and '-'. Keeping spaces and punctuation out of usernames
+// means nobody can pose as "alice: hi" or squeeze a second name into a line.
+func validateUsername(name string) error {
+	if name == "" {
+		return fmt.Errorf("username is empty")
+	}
+	if utf8.RuneCountInString(name) > maxUsernameLength {
+		return fmt.Errorf("username is longer than %d characters", maxUsernameLength)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("._-", r) {
+			return fmt.Errorf("username contains %q", sanitizeLine(string(r)))
+		}
+	}
+	return nil
+}
+
+// validateAddress checks that addr looks like the "ip:port" address smudge
+// uses for a node.
+func validateAddress(addr NodeAddress) error {
+	host, _, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not an IP address", sanitizeLine(host))
+	}
+	return nil
+}
+
+// sanitizeUsernames returns the entries of a username list received from
+// another client which have a valid address and username. The rejected
+// entries are described in problems.
+func sanitizeUsernames(usernames map[NodeAddress]string) (map[NodeAddress]string, []string) {
+	valid := make(map[NodeAddress]string, len(usernames))
+	var problems []string
+	for addr, name := range usernames {
+		if err := validateAddress(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("bad address %s: %s", sanitizeLine(string(addr)), err))
+			continue
+		}
+		if err := validateUsername(name); err != nil {
+			problems = append(problems, fmt.Sprintf("bad username for %s: %s", addr, err))
+			continue
+		}
+		valid[addr] = name
+	}
+	return valid, problems
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestSanitizeText(t *testing.T) {
+	var cases = []struct {
+		text         string
+		expectedText string
+		expectedLine string
+	}{
+		{"plain text", "plain text", "plain text"},
+		{"\x1b[31mred\x1b[0m", "^[[31mred^[[0m", "^[[31mred^[[0m"},
+		{"two\nlines", "two\nlines", "two^Jlines"},
+		{"a\tb", "a    b", "a    b"},
+		{"bell\a del\x7f c1\u009b", "bell^G del^? c1<U+009B>", "bell^G del^? c1<U+009B>"},
+		{"evil‮txt.exe", "evil<U+202E>txt.exe", "evil<U+202E>txt.exe"},
+		{"bad \xff byte", "bad � byte", "bad � byte"},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if result := sanitizeText(c.text); result != c.expectedText {
+				t.Fatalf("Expected %q but got %q", c.expectedText, result)
+			}
+			if result := sanitizeLine(c.text); result != c.expectedLine {
+				t.Fatalf("Expected %q but got %q", c.expectedLine, result)
+			}
+		})
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	var cases = []struct {
+		name        string
+		expectError bool
+	}{
+		{"alice", false},
+		{"bob_the-builder.2", false},
+		{"Zoë", false},
+		{"", true},
+		{"alice: hi", true},
+		{"new\nline", true},
+		{strings.Repeat("a", maxUsernameLength), false},
+		{strings.Repeat("a", maxUsernameLength+1), true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			err := validateUsername(c.name)
+			if c.expectError && err == nil {
+				t.Fatalf("Expected an error for %q", c.name)
+			}
+			if !c.expectError {
+				CheckNoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSanitizeUsernames(t *testing.T) {
+	usernames := map[NodeAddress]string{
+		NodeAddress("127.0.0.1:9999"):   "tester",
+		NodeAddress("127.0.0.1:9998"):   "bad name",
+		NodeAddress("not-an-address"):   "tester2",
+		NodeAddress("example.com:9997"): "tester3",
+	}
+	expectedResult := map[NodeAddress]string{
+		NodeAddress("127.0.0.1:9999"): "tester",
+	}
+
+	result, problems := sanitizeUsernames(usernames)
+	if !reflect.DeepEqual(result, expectedResult) {
+		t.Fatalf("Expected %v but got %v", expectedResult, result)
+	}
+	if len(problems) != 3 {
+		t.Fatalf("Expected 3 problems but got %v", problems)
+	}
+}
+
+// checkSanitized fails the test if s could still affect the terminal.
+func checkSanitized(t *testing.T, s string, multiline bool) {
+	if !utf8.ValidString(s) {
+		t.Fatalf("%q is not valid UTF-8", s)
+	}
+	for _, r := range s {
+		if r == '\n' && multiline {
+			continue
+		}
+		if unicode.IsControl(r) || isBidiControl(r) {
+			t.Fatalf("%q still contains %U", s, r)
+		}
+	}
+}
+
+func FuzzSanitizeText(f *testing.F) {
+	for _, seed := range []string{"plain", "\x1b[2J\x1b[H", "alice: hi\nbob: bye", "‮⁦x", "\xff\xfe", "\t\r\x00"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		text := sanitizeText(s)
+		checkSanitized(t, text, true)
+		if again := sanitizeText(text); again != text {
+			t.Fatalf("Sanitizing %q twice gave %q", text, again)
+		}
+
+		line := sanitizeLine(s)
+		checkSanitized(t, line, false)
+		if strings.Count(text, "\n") != strings.Count(s, "\n") {
+			t.Fatalf("Expected the newlines of %q to be kept in %q", s, text)
+		}
+	})
+}
+
+func FuzzValidateUsername(f *testing.F) {
+	for _, seed := range []string{"alice", "alice: hi", "Zoë", "‮ecila", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		if validateUsername(name) != nil {
+			return
+		}
+		if sanitizeLine(name) != name {
+			t.Fatalf("Valid username %q changes when sanitized", name)
+		}
+		if strings.ContainsAny(name, " :\n") || utf8.RuneCountInString(name) > maxUsernameLength {
+			t.Fatalf("Username %q should not be valid", name)
+		}
+	})
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jroimartin/gocui"
+)
+
+// searchContext is how many characters around the first match are shown for
+// each search result.
+const searchContext = 30
+
+// searchUsage describes the arguments shared by /search and the search
+// subcommand.
+const searchUsage = `<words> ["a phrase"] [from:user] [in:room|@user] [before:date] [after:2h]`
+
+// searchQuery is a parsed search. A message matches when it contains every
+// word and phrase and passes every filter.
+type searchQuery struct {
+	words   []string
+	phrases []string
+
+	// from, channel, before and after are filters, left empty or zero when
+	// not given.
+	from    string
+	channel string
+	before  time.Time
+	after   time.Time
+}
+
+// searchWords splits text into the lowercase words kept in the search index.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// splitQuoted splits s at spaces which are not inside double quotes. Quotes
+// are removed, and quoted reports whether a part started with one.
+func splitQuoted(s string) (parts []string, quoted []bool, err error) {
+	var b strings.Builder
+	inQuote, started, startedQuoted := false, false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			if !started {
+				startedQuoted = true
+			}
+			inQuote = !inQuote
+			started = true
+		case unicode.IsSpace(r) && !inQuote:
+			if started {
+				parts = append(parts, b.String())
+				quoted = append(quoted, startedQuoted)
+			}
+			b.Reset()
+			started, startedQuoted = false, false
+		default:
+			b.WriteRune(r)
+			started = true
+		}
+	}
+	if inQuote {
+		return nil, nil, fmt.Errorf("missing closing quote")
+	}
+	if started {
+		parts = append(parts, b.String())
+		quoted = append(quoted, startedQuoted)
+	}
+	return parts, quoted, nil
+}
+
+// parseSearchQuery reads the terms of /search and the search subcommand.
+// Times given to before: and after: are read like --since of /export.
+func parseSearchQuery(s string, now time.Time) (searchQuery, error) {
+	var q searchQuery
+	parts, quoted, err := splitQuoted(s)
+	if err != nil {
+		return q, err
+	}
+
+	for i, part := range parts {
+		if quoted[i] {
+			if words := searchWords(part); len(words) > 0 {
+				q.phrases = append(q.phrases, strings.Join(words, " "))
+				q.words = append(q.words, words...)
+			}
+			continue
+		}
+
+		key, value := "", part
+		if n := strings.Index(part, ":"); n > 0 {
+			key, value = strings.ToLower(part[:n]), part[n+1:]
+		}
+		if value == "" && key != "" {
+			return q, fmt.Errorf("%s: needs a value", key)
+		}
+		switch key {
+		case "from":
+			q.from = strings.ToLower(strings.TrimPrefix(value, "@"))
+		case "in":
+			q.channel = normalizeChannel(value)
+		case "before", "after":
+			t, err := parseSince(value, now)
+			if err != nil {
+				return q, err
+			}
+			if key == "before" {
+				q.before = t
+			} else {
+				q.after = t
+			}
+		default:
+			// Anything else, such as a link, is searched for as words.
+			q.words = append(q.words, searchWords(part)...)
+		}
+	}
+
+	if len(q.words) == 0 && q.from == "" && q.channel == "" && q.before.IsZero() && q.after.IsZero() {
+		return q, fmt.Errorf("usage: %s", searchUsage)
+	}
+	return q, nil
+}
+
+// matches reports whether msg passes the filters and contains the phrases of
+// q. The words are checked with the index.
+func (q searchQuery) matches(msg *chatMessage) bool {
+	if msg.Deleted {
+		return false
+	}
+	if q.from != "" && strings.ToLower(msg.Sender) != q.from && string(msg.From) != q.from {
+		return false
+	}
+	if q.channel != "" && strings.ToLower(msg.Channel) != q.channel {
+		return false
+	}
+	if !q.before.IsZero() && !msg.Time.Before(q.before) {
+		return false
+	}
+	if !q.after.IsZero() && msg.Time.Before(q.after) {
+		return false
+	}
+	if len(q.phrases) > 0 {
+		body := " " + strings.Join(searchWords(msg.Body), " ") + " "
+		for _, phrase := range q.phrases {
+			if !strings.Contains(body, " "+phrase+" ") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// indexMessage adds the words of msg to the search index. The caller must
+// hold s.mu.
+func (s *messageStore) indexMessage(msg *chatMessage) {
+	if msg.Deleted {
+		return
+	}
+	if s.index == nil {
+		s.index = make(map[string]map[string]bool)
+	}
+	for _, word := range searchWords(msg.Body) {
+		if s.index[word] == nil {
+			s.index[word] = make(map[string]bool)
+		}
+		s.index[word][msg.ID] = true
+	}
+}
+
+// unindexMessage removes the words of msg from the search index, before its
+// body changes. The caller must hold s.mu.
+func (s *messageStore) unindexMessage(msg *chatMessage) {
+	for _, word := range searchWords(msg.Body) {
+		delete(s.index[word], msg.ID)
+		if len(s.index[word]) == 0 {
+			delete(s.index, word)
+		}
+	}
+}
+
+// Search returns the stored messages matching q, newest first.
+func (s *messageStore) Search(q searchQuery) []chatMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Start from the rarest word, so as few messages as possible are
+	// checked. Without words, every message is.
+	var candidates []string
+	if len(q.words) == 0 {
+		candidates = s.order
+	} else {
+		rarest := s.index[q.words[0]]
+		for _, word := range q.words[1:] {
+			if len(s.index[word]) < len(rarest) {
+				rarest = s.index[word]
+			}
+		}
+		for id := range rarest {
+			candidates = append(candidates, id)
+		}
+	}
+
+	var results []chatMessage
+	for _, id := range candidates {
+		msg := s.messages[id]
+		if !s.hasWords(id, q.words) || !q.matches(msg) {
+			continue
+		}
+		results = append(results, *msg)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Time.Equal(results[j].Time) {
+			return results[i].ID > results[j].ID
+		}
+		return results[i].Time.After(results[j].Time)
+	})
+	return results
+}
+
+// hasWords reports whether the message with the given ID contains every one
+// of words. The caller must hold s.mu.
+func (s *messageStore) hasWords(id string, words []string) bool {
+	for _, word := range words {
+		if !s.index[word][id] {
+			return false
+		}
+	}
+	return true
+}
+
+// searchSnippet returns the part of body around the first word of q found in
+// it, on one line.
+func searchSnippet(body string, q searchQuery) string {
+	text := []rune(strings.Join(strings.Fields(sanitizeText(body)), " "))
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	start := 0
+	terms := append(append([]string(nil), q.phrases...), q.words...)
+	for _, term := range terms {
+		if n := strings.Index(string(lower), term); n >= 0 {
+			start = utf8.RuneCountInString(string(lower)[:n])
+			break
+		}
+	}
+
+	from := start - searchContext
+	to := start + searchContext
+	prefix, suffix := "…", "…"
+	if from <= 0 {
+		from, prefix = 0, ""
+	}
+	if to >= len(text) {
+		to, suffix = len(text), ""
+	}
+	return prefix + string(text[from:to]) + suffix
+}
+
+// formatSearchResult describes one search result on one line.
+func formatSearchResult(msg chatMessage, q searchQuery) string {
+	return fmt.Sprintf("%s %s %s: %s", msg.Time.Format("2006-01-02 15:04"), msg.Channel,
+		sanitizeLine(msg.Sender), searchSnippet(msg.Body, q))
+}
+
+// searchMessages returns the messages in the store matching q, leaving out
+// those from ignored users.
+func searchMessages(store *messageStore, q searchQuery) []chatMessage {
+	var results []chatMessage
+	for _, msg := range store.Search(q) {
+		if !ignored.Has(clientIdentity(msg.From)) {
+			results = append(results, msg)
+		}
+	}
+	return results
+}
+
+// cmdSearch lists the messages matching the search in an overlay: /search
+// <words> ["a phrase"] [from:user] [in:channel] [before:time] [after:time]
+func cmdSearch(args string) error {
+	q, err := parseSearchQuery(args, time.Now())
+	if err != nil {
+		return err
+	}
+
+	results := searchMessages(&chat.history, q)
+	if len(results) == 0 {
+		printNotice(fmt.Sprintf("No messages match %s", sanitizeLine(args)))
+		return nil
+	}
+	gui.Update(func(g *gocui.Gui) error {
+		return showSearchResults(g, results, q)
+	})
+	return nil
+}
+
+// showSearchResults opens a menu of search results. Picking one scrolls the
+// messages view to it, or shows it in the thread overlay if it is from before
+// the messages view was started.
+func showSearchResults(g *gocui.Gui, results []chatMessage, q searchQuery) error {
+	maxX, maxY := g.Size()
+	title := fmt.Sprintf("%d results", len(results))
+	if len(results) > maxY-4 && maxY > 4 {
+		results = results[:maxY-4]
+		title = fmt.Sprintf("%d of %s", len(results), title)
+	}
+
+	items := make([]menuItem, len(results))
+	width := 0
+	for i, msg := range results {
+		id := msg.ID
+		label := []rune(formatSearchResult(msg, q))
+		if len(label) > maxX-4 && maxX > 5 {
+			label = append(label[:maxX-5], '…')
+		}
+		items[i] = menuItem{string(label), func(g *gocui.Gui) error {
+			return scrollToMessage(g, id)
+		}}
+		if len(label) > width {
+			width = len(label)
+		}
+	}
+
+	if err := showMenu(g, "search", (maxX-width)/2, (maxY-len(items))/2, items); err != nil {
+		return err
+	}
+	v, err := g.View("search")
+	if err != nil {
+		return err
+	}
+	v.Title = title + " (Enter to show, Esc to close)"
+	return nil
+}
+
+// scrollToMessage scrolls the messages view so the message with the given ID
+// is near the top.
+func scrollToMessage(g *gocui.Gui, id string) error {
+	v, err := g.View("messages")
+	if err != nil {
+		return err
+	}
+	line, ok := messageViewLine(v, id)
+	if !ok {
+		return showThread(g, id)
+	}
+
+	// Leave a couple of lines above it, such as the message it replies to.
+	_, oy := v.Origin()
+	return scrollView(g, v, line-2-oy)
+}
+
+// messageViewLine returns the line of the messages view v, counting wrapped
+// lines, on which the message with the given ID starts.
+func messageViewLine(v *gocui.View, id string) (int, bool) {
+	maxX, _ := v.Size()
+	if maxX <= 0 {
+		return 0, false
+	}
+
+	// messageLines lists the first line of each message in the order they
+	// were written, so walk both together.
+	next, line := 0, 0
+	for _, text := range strings.Split(strings.TrimSuffix(v.Buffer(), "\n"), "\n") {
+		if next < len(messageLines) && strings.TrimRight(text, " ") == strings.TrimRight(messageLines[next].plain, " ") {
+			if messageLines[next].id == id {
+				return line, true
+			}
+			next++
+		}
+
+		// Count wrapped lines the way gocui does, which adds an empty line
+		// after one exactly as wide as the view.
+		if n := len([]rune(text)); n < maxX {
+			line++
+		} else {
+			line += n/maxX + 1
+		}
+	}
+	return 0, false
+}
+
+// runSearch is the search subcommand, which searches the saved history
+// without starting the chat.
+func runSearch(args []string) error {
+	dir := dataDir
+	var terms []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--data-dir" || args[i] == "-data-dir" {
+			if i+1 == len(args) {
+				return fmt.Errorf("%s needs a value", args[i])
+			}
+			i++
+			dir = args[i]
+			continue
+		}
+		terms = append(terms, args[i])
+	}
+
+	// The shell has usually removed the quotes, so quote anything with a space
+	// again.
+	for i, term := range terms {
+		if strings.ContainsAny(term, " \t") && !strings.Contains(term, `"`) {
+			if n := strings.Index(term, ":"); n > 0 && !strings.ContainsAny(term[:n], " \t") {
+				terms[i] = term[:n+1] + `"` + term[n+1:] + `"`
+			} else {
+				terms[i] = `"` + term + `"`
+			}
+		}
+	}
+	q, err := parseSearchQuery(strings.Join(terms, " "), time.Now())
+	if err != nil {
+		return err
+	}
+
+	if ignored, err = loadIgnoreList(dir); err != nil {
+		return err
+	}
+	store, err := readHistory(filepath.Join(dir, historyFile))
+	if err != nil {
+		return err
+	}
+	for _, msg := range searchMessages(store, q) {
+		fmt.Printf("%s %-6s %s %s: %s\n", msg.Time.Format("2006-01-02 15:04"), msg.Channel, msg.ID,
+			sanitizeLine(msg.Sender), strings.Join(strings.Fields(sanitizeText(msg.Body)), " "))
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var cases = []struct {
+		query       string
+		expected    searchQuery
+		expectError bool
+	}{
+		{"Rollback DB", searchQuery{words: []string{"rollback", "db"}}, false},
+		{`"the db is down" from:Alice`, searchQuery{words: []string{"the", "db", "is", "down"},
+			phrases: []string{"the db is down"}, from: "alice"}, false},
+		{`in:#Room from:"@Mary Ann" after:2h`, searchQuery{channel: "room", from: "mary ann",
+			after: now.Add(-2 * time.Hour)}, false},
+		{"deploy before:2026-10-01 in:bob", searchQuery{words: []string{"deploy"}, channel: "@bob",
+			before: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{"https://example.com/x", searchQuery{words: []string{"https", "example", "com", "x"}}, false},
+		{"", searchQuery{}, true},
+		{`"unfinished`, searchQuery{}, true},
+		{"from:", searchQuery{}, true},
+		{"db after:lunchtime", searchQuery{}, true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			q, err := parseSearchQuery(c.query, now)
+			if c.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error for %q", c.query)
+				}
+				return
+			}
+			CheckNoError(t, err)
+			if !reflect.DeepEqual(q, c.expected) {
+				t.Fatalf("Expected %#v but got %#v", c.expected, q)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search")
+	CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The index is built as the history is read back, edits and deletes
+	// included.
+	store, err := readHistory(writeTestHistory(t, dir))
+	CheckNoError(t, err)
+	store.Add(chatMessage{ID: "EEEEEEEE", From: "192.168.0.11:9999", Sender: "bob", Channel: "@alice",
+		Body: "Is the DB down again?", Time: time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)})
+
+	var cases = []struct {
+		query    string
+		expected []string
+	}{
+		{"db", []string{"EEEEEEEE", "AAAAAAAA"}},
+		{"DB down", []string{"EEEEEEEE", "AAAAAAAA"}},
+		{`"db is down"`, []string{"AAAAAAAA"}},
+		{"db from:bob", []string{"EEEEEEEE"}},
+		{"db in:room", []string{"AAAAAAAA"}},
+		{"db after:2026-10-18T09:30:00Z", []string{"EEEEEEEE"}},
+		{"db before:2026-10-18T09:30:00Z", []string{"AAAAAAAA"}},
+		{"rolled", []string{"BBBBBBBB"}},
+		{"from:mallory", []string{"CCCCCCCC"}},
+		{"from:192.168.0.66:9999", []string{"CCCCCCCC"}},
+
+		// Replaced by an edit, deleted, or never said.
+		{"rolling", nil},
+		{"hijacked", nil},
+		{"oops", nil},
+		{"db nothing", nil},
+	}
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			q, err := parseSearchQuery(c.query, now)
+			CheckNoError(t, err)
+			var ids []string
+			for _, msg := range store.Search(q) {
+				ids = append(ids, msg.ID)
+			}
+			if !reflect.DeepEqual(ids, c.expected) {
+				t.Fatalf("Expected %v but got %v", c.expected, ids)
+			}
+		})
+	}
+
+	if len(store.index["rolling"]) != 0 || len(store.index["oops"]) != 0 {
+		t.Fatalf("Expected edited and deleted words to leave the index")
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	body := strings.Repeat("padding ", 10) + "the Database\nis down " + strings.Repeat("again ", 10)
+	q := searchQuery{words: []string{"database"}}
+	snippet := searchSnippet(body, q)
+	expected := "…g padding padding padding the Database is down again again a…"
+	if snippet != expected {
+		t.Fatalf("Expected %q but got %q", expected, snippet)
+	}
+	if got := searchSnippet("short one", q); got != "short one" {
+		t.Fatalf("Expected the whole of a short body but got %q", got)
+	}
+}
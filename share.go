@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jroimartin/gocui"
+)
+
+const (
+	// maxFileSize is the largest file /send shares. Every byte is gossiped
+	// through the whole cluster a few bytes at a time, so this is meant for
+	// snippets, logs and configuration files rather than anything big.
+	maxFileSize = 64 << 10
+
+	// fileChunkSize is how many bytes of a file go in one broadcast, chosen
+	// so a sealed chunk fits in smudge.DefaultMaxBroadcastBytes.
+	fileChunkSize = 96
+
+	// maxFileNameLength is the longest file name, in characters, in an offer.
+	maxFileNameLength = 64
+
+	// chunkInterval is how long we wait between sending two chunks, so a
+	// file does not crowd out the chat.
+	chunkInterval = 50 * time.Millisecond
+
+	// resumeAfter is how long an incomplete file may go without a chunk
+	// before we ask its sender for the missing ones.
+	resumeAfter = 10 * time.Second
+
+	// maxResumeRequests is how many times in a row we ask for the missing
+	// chunks of a file without getting any before giving up.
+	maxResumeRequests = 10
+
+	// maxMissingPerRequest is how many missing chunks one resume request
+	// names.
+	maxMissingPerRequest = 24
+
+	// maxIncomingFiles and maxOutgoingFiles limit how many files are held in
+	// memory. The oldest are forgotten first.
+	maxIncomingFiles = 16
+	maxOutgoingFiles = 8
+
+	// maxQueuedForRequester is how many chunks may wait to be sent again
+	// for one client, so resume requests cannot fill the queue.
+	maxQueuedForRequester = 2 * maxMissingPerRequest
+
+	// fileTrafficPerSecond and fileTrafficBurst limit the chunks and resume
+	// requests taken from each client, allowing for a little more than a
+	// sender sends every chunkInterval.
+	fileTrafficPerSecond = 2 * float64(time.Second/chunkInterval)
+	fileTrafficBurst     = 100
+)
+
+// chunkCount returns how many chunks a file of the given size is sent in.
+func chunkCount(size int64) int {
+	return int((size + fileChunkSize - 1) / fileChunkSize)
+}
+
+// chunkLength returns the length of chunk n, counting from 1, of a file of
+// the given size.
+func chunkLength(size int64, n int) int {
+	if n == chunkCount(size) && size%fileChunkSize != 0 {
+		return int(size % fileChunkSize)
+	}
+	return fileChunkSize
+}
+
+// validateFileName checks the name of a file offered by another client. It
+// must be a plain name, so saving it cannot be tricked into another
+// directory.
+func validateFileName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("file name %q is not allowed", sanitizeLine(name))
+	}
+	if utf8.RuneCountInString(name) > maxFileNameLength {
+		return fmt.Errorf("file name is longer than %d characters", maxFileNameLength)
+	}
+	if strings.ContainsAny(name, `/\`) || sanitizeLine(name) != name {
+		return fmt.Errorf("file name %q is not allowed", sanitizeLine(name))
+	}
+	return nil
+}
+
+// formatSize describes a number of bytes, such as "512 B" or "2.5 KB".
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f KB", float64(size)/1024)
+}
+
+// sharedFile is a file we are sending or receiving.
+type sharedFile struct {
+	id string
+
+	// wireID is the ID the sender gave the file. It differs from id when
+	// another client already offered a file with that ID.
+	wireID string
+
+	name   string
+	from   NodeAddress
+	to     NodeAddress
+	size   int64
+	hash   []byte
+	time   time.Time
+	number int
+
+	// chunks holds the chunks received so far, or every chunk of a file we
+	// send, and received counts them.
+	chunks   [][]byte
+	received int
+
+	// sent counts the chunks of a file we send which have been broadcast.
+	sent int
+
+	verified bool
+	corrupt  bool
+
+	// lastChunk is when the last chunk arrived, and requests how many resume
+	// requests have been sent since.
+	lastChunk time.Time
+	requests  int
+}
+
+// outgoing reports whether we are the sender of f.
+func (f *sharedFile) outgoing() bool {
+	return f.number == 0
+}
+
+// done reports whether nothing more is expected for f.
+func (f *sharedFile) done() bool {
+	if f.outgoing() {
+		return f.sent >= len(f.chunks)
+	}
+	return f.verified || f.requests >= maxResumeRequests
+}
+
+// progress returns how far along f is, from 0 to 100.
+func (f *sharedFile) progress() int {
+	count := f.received
+	if f.outgoing() {
+		count = f.sent
+	}
+	if count > len(f.chunks) {
+		count = len(f.chunks)
+	}
+	return count * 100 / len(f.chunks)
+}
+
+// formatFile describes a shared file for its line in the messages view.
+func formatFile(f sharedFile, sender string) string {
+	desc := fmt.Sprintf("📎 %s (%s)", sanitizeLine(f.name), formatSize(f.size))
+	if !f.outgoing() {
+		desc = fmt.Sprintf("📎 [%d] %s (%s)", f.number, sanitizeLine(f.name), formatSize(f.size))
+	}
+
+	var state string
+	switch {
+	case f.outgoing() && f.done():
+		state = "sent"
+	case f.outgoing():
+		state = fmt.Sprintf("sending %d%%", f.progress())
+	case f.verified:
+		state = fmt.Sprintf("ready, /save %d <path>", f.number)
+	case f.corrupt:
+		state = "failed verification, retrying"
+	case f.done():
+		state = fmt.Sprintf("incomplete at %d%%", f.progress())
+	default:
+		state = fmt.Sprintf("receiving %d%%", f.progress())
+	}
+	return fmt.Sprintf("%s %s: %s — %s", f.time.Format("15:04"), sanitizeLine(sender), desc, state)
+}
+
+// chunkRef names one chunk of a file we send, and the client which asked for
+// it again, if any.
+type chunkRef struct {
+	file      string
+	chunk     int
+	requester NodeAddress
+}
+
+// fileKey identifies a file by its sender and the ID the sender gave it, since
+// nothing stops two clients from offering files with the same ID.
+type fileKey struct {
+	from NodeAddress
+	id   string
+}
+
+// fileTransfers holds the files we are sending and receiving. The zero value
+// is empty, and it is safe to use from several goroutines.
+type fileTransfers struct {
+	mu    sync.Mutex
+	files map[string]*sharedFile
+	order []string
+
+	// aliases maps the files stored under another ID than their sender
+	// gave them to the ID they are stored under.
+	aliases map[fileKey]string
+
+	// incoming counts the files received, to number them for /save.
+	incoming int
+
+	// queue holds the chunks waiting to be sent, in order.
+	queue []chunkRef
+}
+
+// add stores f, forgetting the oldest file of the same direction if there are
+// too many. The caller must hold t.mu.
+func (t *fileTransfers) add(f *sharedFile) {
+	if t.files == nil {
+		t.files = make(map[string]*sharedFile)
+	}
+
+	limit, count := maxOutgoingFiles, 0
+	if !f.outgoing() {
+		limit = maxIncomingFiles
+	}
+	for _, id := range t.order {
+		if t.files[id].outgoing() == f.outgoing() {
+			count++
+		}
+	}
+	for i := 0; count >= limit && i < len(t.order); i++ {
+		if old := t.files[t.order[i]]; old.outgoing() == f.outgoing() {
+			delete(t.aliases, fileKey{old.from, old.wireID})
+			delete(t.files, t.order[i])
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			count--
+			i--
+		}
+	}
+
+	t.files[f.id] = f
+	t.order = append(t.order, f.id)
+}
+
+// lookup returns the file from offered with the given ID. The caller must
+// hold t.mu.
+func (t *fileTransfers) lookup(from NodeAddress, id string) (*sharedFile, bool) {
+	if alias, ok := t.aliases[fileKey{from, id}]; ok {
+		id = alias
+	}
+	f, ok := t.files[id]
+	return f, ok && f.from == from
+}
+
+// Resolve returns the ID under which the file from offered with the given ID
+// is stored.
+func (t *fileTransfers) Resolve(from NodeAddress, id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if alias, ok := t.aliases[fileKey{from, id}]; ok {
+		return alias
+	}
+	return id
+}
+
+// Share stores a file we send and queues all of its chunks.
+func (t *fileTransfers) Share(f *sharedFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f.wireID = f.id
+	t.add(f)
+	for n := 1; n <= len(f.chunks); n++ {
+		t.queue = append(t.queue, chunkRef{file: f.id, chunk: n})
+	}
+}
+
+// Offer stores a file offered by another client, numbering it for /save. It
+// reports false if the offer was already known. A file whose ID another
+// client already used is stored under a new one.
+func (t *fileTransfers) Offer(f *sharedFile) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.lookup(f.from, f.id); ok {
+		return false
+	}
+	f.wireID = f.id
+	if _, ok := t.files[f.id]; ok {
+		for ok {
+			f.id = newMessageID()
+			_, ok = t.files[f.id]
+		}
+		if t.aliases == nil {
+			t.aliases = make(map[fileKey]string)
+		}
+		t.aliases[fileKey{f.from, f.wireID}] = f.id
+	}
+	t.incoming++
+	f.number = t.incoming
+	f.chunks = make([][]byte, chunkCount(f.size))
+	t.add(f)
+	return true
+}
+
+// Chunk stores chunk n of the file from offered with the given ID. It reports
+// whether the file changed enough to be redrawn.
+func (t *fileTransfers) Chunk(id string, from NodeAddress, n int, data []byte, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.lookup(from, id)
+	if !ok || f.outgoing() || f.verified {
+		return false
+	}
+	if n < 1 || n > len(f.chunks) || len(data) != chunkLength(f.size, n) || f.chunks[n-1] != nil {
+		return false
+	}
+
+	before := f.progress()
+	f.chunks[n-1] = data
+	f.received++
+	f.lastChunk = now
+	f.requests = 0
+	if f.received < len(f.chunks) {
+		return f.progress()/10 != before/10
+	}
+
+	sum := sha256.Sum256(bytes.Join(f.chunks, nil))
+	if bytes.Equal(sum[:], f.hash) {
+		f.verified = true
+		f.corrupt = false
+		return true
+	}
+
+	// Start again, and ask for every chunk when the file stalls.
+	f.corrupt = true
+	f.chunks = make([][]byte, len(f.chunks))
+	f.received = 0
+	return true
+}
+
+// Next takes the next chunk to send off the queue.
+func (t *fileTransfers) Next() (message, *sharedFile, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.queue) > 0 {
+		ref := t.queue[0]
+		t.queue = t.queue[1:]
+		f, ok := t.files[ref.file]
+		if !ok {
+			continue
+		}
+		if f.sent < len(f.chunks) {
+			f.sent++
+		}
+		snapshot := *f
+		return message{
+			Type:    messageTypeFileChunk,
+			File:    f.id,
+			Chunk:   ref.chunk,
+			Data:    f.chunks[ref.chunk-1],
+			Version: clientVersion,
+		}, &snapshot, true
+	}
+	return message{}, nil, false
+}
+
+// Resend queues the given chunks of a file we sent again, for the client at
+// from. A file sent to one client is only sent again for that client, and no
+// client has more than maxQueuedForRequester chunks waiting.
+func (t *fileTransfers) Resend(id string, from NodeAddress, chunks []int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.files[id]
+	if !ok || !f.outgoing() || f.to != "" && f.to != from {
+		return
+	}
+	queued := make(map[chunkRef]bool)
+	waiting := 0
+	for _, ref := range t.queue {
+		queued[chunkRef{file: ref.file, chunk: ref.chunk}] = true
+		if ref.requester == from {
+			waiting++
+		}
+	}
+	for _, n := range chunks {
+		ref := chunkRef{file: id, chunk: n}
+		if waiting >= maxQueuedForRequester {
+			logDebug("Not sending more chunks again", "file", f.name, "for", from)
+			return
+		}
+		if n >= 1 && n <= len(f.chunks) && !queued[ref] {
+			queued[ref] = true
+			ref.requester = from
+			t.queue = append(t.queue, ref)
+			waiting++
+		}
+	}
+}
+
+// Stalled returns a resume request for each incomplete file which has gone
+// resumeAfter without a chunk, naming its first missing chunks.
+func (t *fileTransfers) Stalled(now time.Time) []message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var reqs []message
+	for _, id := range t.order {
+		f := t.files[id]
+		if f.outgoing() || f.done() || now.Sub(f.lastChunk) < resumeAfter {
+			continue
+		}
+
+		var missing []int
+		for n, chunk := range f.chunks {
+			if chunk == nil && len(missing) < maxMissingPerRequest {
+				missing = append(missing, n+1)
+			}
+		}
+		f.requests++
+		f.lastChunk = now
+		reqs = append(reqs, message{
+			Type:    messageTypeFileReq,
+			To:      f.from,
+			File:    f.wireID,
+			Missing: missing,
+			Version: clientVersion,
+		})
+	}
+	return reqs
+}
+
+// Get returns a copy of the file with the given ID.
+func (t *fileTransfers) Get(id string) (sharedFile, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.files[id]
+	if !ok {
+		return sharedFile{}, false
+	}
+	return *f, true
+}
+
+// Find returns the received file with the given number.
+func (t *fileTransfers) Find(number int) (sharedFile, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, f := range t.files {
+		if f.number == number {
+			return *f, true
+		}
+	}
+	return sharedFile{}, false
+}
+
+// ShareFile offers data as a file called name, to the client at to or to the
+// room if to is empty, and queues its chunks.
+func (m *Messenger) ShareFile(name string, data []byte, to NodeAddress) (sharedFile, error) {
+	if len(data) == 0 {
+		return sharedFile{}, fmt.Errorf("%s is empty", name)
+	}
+	if len(data) > maxFileSize {
+		return sharedFile{}, fmt.Errorf("%s is larger than %s", name, formatSize(maxFileSize))
+	}
+	if err := validateFileName(name); err != nil {
+		return sharedFile{}, err
+	}
+	if err := checkSendLimit(); err != nil {
+		return sharedFile{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	f := &sharedFile{
+		id:   newMessageID(),
+		name: name,
+		from: m.address(),
+		to:   to,
+		size: int64(len(data)),
+		hash: sum[:],
+		time: time.Now(),
+	}
+	for start := 0; start < len(data); start += fileChunkSize {
+		end := start + fileChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		f.chunks = append(f.chunks, data[start:end])
+	}
+
+	offer := message{
+		Type:    messageTypeFileOffer,
+		Body:    name,
+		File:    f.id,
+		To:      to,
+		Size:    f.size,
+		Hash:    base64.RawStdEncoding.EncodeToString(f.hash),
+		Version: clientVersion,
+	}
+	if err := m.broadcast(&offer); err != nil {
+		return sharedFile{}, err
+	}
+	m.files.Share(f)
+	printFileEntry(f.id)
+	return *f, nil
+}
+
+// receiveFileOffer starts receiving a file offered by senderAddr.
+func (m *Messenger) receiveFileOffer(senderAddr NodeAddress, msg message) {
+	if msg.To != "" && msg.To != m.address() {
+		return
+	}
+	hash, _ := base64.RawStdEncoding.DecodeString(msg.Hash)
+	f := &sharedFile{
+		id:        msg.File,
+		name:      msg.Body,
+		from:      senderAddr,
+		to:        msg.To,
+		size:      msg.Size,
+		hash:      hash,
+		time:      time.Now(),
+		lastChunk: time.Now(),
+	}
+	if m.files.Offer(f) {
+		printFileEntry(f.id)
+	}
+}
+
+// receiveFileChunk stores a chunk of a file we are receiving.
+func (m *Messenger) receiveFileChunk(senderAddr NodeAddress, msg message) {
+	if !m.files.Chunk(msg.File, senderAddr, msg.Chunk, msg.Data, time.Now()) {
+		return
+	}
+	if f, ok := m.files.Get(m.files.Resolve(senderAddr, msg.File)); ok && f.corrupt {
+		logWarn("A shared file failed verification", "file", f.name, "from", senderAddr)
+	}
+	refreshMessages()
+}
+
+// sendNextChunk broadcasts the next queued chunk, if there is one.
+func (m *Messenger) sendNextChunk() {
+	chunk, f, ok := m.files.Next()
+	if !ok {
+		return
+	}
+	if err := m.broadcast(&chunk); err != nil {
+		logError("Failed to send a chunk of a file", "file", f.name, "err", err)
+	}
+	// Redraw every ten percent rather than for every chunk.
+	before := (f.sent - 1) * 100 / len(f.chunks)
+	if f.progress()/10 != before/10 || f.done() {
+		refreshMessages()
+	}
+}
+
+// requestMissing asks the senders of stalled files for their missing chunks.
+func (m *Messenger) requestMissing(now time.Time) {
+	for _, req := range m.files.Stalled(now) {
+		fileStalls.Inc(string(req.To))
+		if err := m.broadcast(&req); err != nil {
+			logError("Failed to ask for the rest of a file", "err", err)
+		}
+	}
+}
+
+// SendFiles sends the chunks of the files we share, one every chunkInterval,
+// and asks for the missing chunks of files which stopped arriving.
+func (m *Messenger) SendFiles() {
+	chunks := time.Tick(chunkInterval)
+	stalls := time.Tick(resumeAfter / 2)
+	for {
+		select {
+		case <-chunks:
+			m.sendNextChunk()
+		case now := <-stalls:
+			m.requestMissing(now)
+		}
+	}
+}
+
+// printFileEntry adds a shared file to the messages view.
+func printFileEntry(id string) {
+	if gui == nil {
+		return
+	}
+
+	gui.Update(func(g *gocui.Gui) error {
+		v, err := g.View("messages")
+		if err != nil {
+			return err
+		}
+		transcript = append(transcript, transcriptEntry{file: id})
+		writeFileEntry(v, id)
+
+		if messagesHidden(g) {
+			unreadCount++
+			return drawStatusBar(g, currentClusterStatus())
+		}
+		return nil
+	})
+}
+
+// writeFileEntry writes the line of a shared file to the messages view v.
+func writeFileEntry(v *gocui.View, id string) {
+	f, ok := chat.files.Get(id)
+	if !ok {
+		return
+	}
+	sender := localUsername
+	if !f.outgoing() {
+		c, _ := chat.clients.get(f.from)
+		sender = c.GetName()
+		if f.to != "" {
+			sender = "[DM] " + sender
+		}
+	}
+	fmt.Fprintln(v, styleText(currentTheme.timestamp, formatFile(f, sender)))
+}
+
+// cmdSend shares a file with the room, or with one user: /send [@user] <path>
+func cmdSend(args string) error {
+	if args == "" {
+		return fmt.Errorf("usage: /send [@user] <path>")
+	}
+
+	var to NodeAddress
+	if strings.HasPrefix(args, "@") {
+		var user string
+		user, args = splitFirst(args)
+		addr, ok := clients.Lookup(strings.TrimPrefix(user, "@"))
+		if !ok {
+			return fmt.Errorf("no client named %q", strings.TrimPrefix(user, "@"))
+		}
+		to = addr
+	}
+
+	path := args
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxFileSize {
+		return fmt.Errorf("%s is larger than %s", path, formatSize(maxFileSize))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = chat.ShareFile(filepath.Base(path), data, to)
+	return err
+}
+
+// cmdSave writes a received file to disk: /save N <path>. An existing file is
+// never overwritten.
+func cmdSave(args string) error {
+	ref, path := splitFirst(args)
+	n, err := strconv.Atoi(ref)
+	if err != nil || path == "" {
+		return fmt.Errorf("usage: /save N <path>")
+	}
+
+	f, ok := chat.files.Find(n)
+	if !ok {
+		return fmt.Errorf("no file %d", n)
+	}
+	if err := saveFile(f, path); err != nil {
+		return err
+	}
+	printNotice(fmt.Sprintf("Saved %s to %s", sanitizeLine(f.name), path))
+	return nil
+}
+
+// saveFile writes a verified file to path, which may name a directory to save
+// it into under its own name.
+func saveFile(f sharedFile, path string) error {
+	if !f.verified {
+		return fmt.Errorf("%s is only %d%% received", sanitizeLine(f.name), f.progress())
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, f.name)
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(bytes.Join(f.chunks, nil)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
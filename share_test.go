@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+func TestFileMessageSize(t *testing.T) {
+	defer setClusterKeys(nil)
+
+	longest := NodeAddress("[" + strings.Repeat("ffff:", 7) + "ffff]:65535")
+	msgs := []message{
+		{
+			Type:    messageTypeFileChunk,
+			File:    newMessageID(),
+			Chunk:   chunkCount(maxFileSize),
+			Data:    bytes.Repeat([]byte{0xff}, fileChunkSize),
+			Version: clientVersion,
+		},
+		{
+			Type:    messageTypeFileOffer,
+			Body:    strings.Repeat("é", maxFileNameLength),
+			File:    newMessageID(),
+			To:      longest,
+			Size:    maxFileSize,
+			Hash:    strings.Repeat("A", 43),
+			Version: clientVersion,
+		},
+		{
+			Type:    messageTypeFileReq,
+			To:      longest,
+			File:    newMessageID(),
+			Missing: make([]int, maxMissingPerRequest),
+			Version: clientVersion,
+		},
+	}
+	for i := range msgs[2].Missing {
+		msgs[2].Missing[i] = chunkCount(maxFileSize) - i
+	}
+
+	CheckNoError(t, setClusterKeys([]string{"correct horse battery staple"}))
+	for i, msg := range msgs {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			CheckNoError(t, msg.validate())
+			data, err := seal(msg.Encode())
+			CheckNoError(t, err)
+			if len(data) > smudge.GetMaxBroadcastBytes() {
+				t.Fatalf("Expected at most %d bytes but got %d", smudge.GetMaxBroadcastBytes(), len(data))
+			}
+		})
+	}
+}
+
+func TestValidateFileName(t *testing.T) {
+	var cases = []struct {
+		name        string
+		expectError bool
+	}{
+		{"notes.txt", false},
+		{"crash log.txt", false},
+		{"", true},
+		{"..", true},
+		{"../../.bashrc", true},
+		{`C:\Windows\win.ini`, true},
+		{"evil\x1b[2J.txt", true},
+		{strings.Repeat("a", maxFileNameLength+1), true},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			err := validateFileName(c.name)
+			if c.expectError && err == nil {
+				t.Fatalf("Expected an error for %q", c.name)
+			}
+			if !c.expectError {
+				CheckNoError(t, err)
+			}
+		})
+	}
+}
+
+func TestShareFile(t *testing.T) {
+	net := newLossyNetwork(3, 0.2)
+	sender := net.nodes[0]
+
+	data := make([]byte, 5000)
+	rand.New(rand.NewSource(2)).Read(data)
+	shared, err := sender.ShareFile("dump.bin", data, "")
+	CheckNoError(t, err)
+	net.deliver()
+
+	// The offer may have been lost too, so send it without loss.
+	offer := message{Type: messageTypeFileOffer, Body: shared.name, File: shared.id, Size: shared.size,
+		Hash: base64.RawStdEncoding.EncodeToString(shared.hash)}
+	for _, node := range net.nodes[1:] {
+		node.receive(sender.self, offer.Encode())
+	}
+
+	for i := 0; i < chunkCount(int64(len(data))); i++ {
+		sender.sendNextChunk()
+		net.deliver()
+	}
+	for _, node := range net.nodes[1:] {
+		if f, _ := node.files.Get(shared.id); f.verified {
+			t.Fatalf("Expected %s to be missing chunks", node.self)
+		}
+	}
+
+	// Stalled files ask for their missing chunks until they are complete.
+	now := time.Now()
+	for round := 0; round < 20; round++ {
+		now = now.Add(resumeAfter)
+		for _, node := range net.nodes[1:] {
+			node.requestMissing(now)
+		}
+		net.deliver()
+		// Each client asks for up to maxMissingPerRequest chunks.
+		for i := 0; i < 2*maxMissingPerRequest; i++ {
+			sender.sendNextChunk()
+			net.deliver()
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "share")
+	CheckNoError(t, err)
+	defer os.RemoveAll(dir)
+	for i, node := range net.nodes[1:] {
+		f, ok := node.files.Find(1)
+		if !ok || !f.verified {
+			t.Fatalf("Expected %s to have the whole file but got %d%%", node.self, f.progress())
+		}
+		path := filepath.Join(dir, fmt.Sprintf("copy%d", i))
+		CheckNoError(t, saveFile(f, path))
+		saved, err := ioutil.ReadFile(path)
+		CheckNoError(t, err)
+		if !bytes.Equal(saved, data) {
+			t.Fatalf("Expected the saved file to match the one sent")
+		}
+		if err := saveFile(f, path); err == nil {
+			t.Fatalf("Expected saving over an existing file to fail")
+		}
+	}
+}
+
+func TestFileChunkChecks(t *testing.T) {
+	alice := NodeAddress("10.0.0.1:9999")
+	data := []byte(strings.Repeat("x", fileChunkSize+10))
+	f := &sharedFile{id: "AAAAAAAA", name: "x.txt", from: alice, size: int64(len(data)),
+		hash: make([]byte, 32), lastChunk: time.Unix(1000, 0)}
+
+	var files fileTransfers
+	if !files.Offer(f) || files.Offer(f) {
+		t.Fatalf("Expected only the first offer to be added")
+	}
+	now := time.Unix(1001, 0)
+	if files.Chunk("AAAAAAAA", "10.0.0.2:9999", 1, data[:fileChunkSize], now) {
+		t.Fatalf("Expected a chunk from another client to be ignored")
+	}
+	if files.Chunk("AAAAAAAA", alice, 2, data[:fileChunkSize], now) {
+		t.Fatalf("Expected a last chunk of the wrong length to be ignored")
+	}
+	files.Chunk("AAAAAAAA", alice, 1, data[:fileChunkSize], now)
+	files.Chunk("AAAAAAAA", alice, 2, data[fileChunkSize:], now)
+
+	// The hash does not match, so the file starts again.
+	got, _ := files.Get("AAAAAAAA")
+	if got.verified || !got.corrupt || got.received != 0 {
+		t.Fatalf("Expected the file to fail verification but got %#v", got)
+	}
+	reqs := files.Stalled(now.Add(resumeAfter))
+	if len(reqs) != 1 || fmt.Sprint(reqs[0].Missing) != "[1 2]" || reqs[0].To != alice {
+		t.Fatalf("Expected a request for both chunks from alice but got %#v", reqs)
+	}
+}
+
+func TestFileIDClaimedByAnother(t *testing.T) {
+	alice := NodeAddress("10.0.0.1:9999")
+	mallory := NodeAddress("10.0.0.3:9999")
+	data := []byte("hello")
+	sum := sha256.Sum256(data)
+
+	var files fileTransfers
+	files.Offer(&sharedFile{id: "AAAAAAAA", name: "x.txt", from: mallory, size: 5, hash: make([]byte, 32)})
+	if !files.Offer(&sharedFile{id: "AAAAAAAA", name: "x.txt", from: alice, size: 5, hash: sum[:]}) {
+		t.Fatalf("Expected alice's offer to be added beside mallory's")
+	}
+
+	now := time.Unix(1000, 0)
+	files.Chunk("AAAAAAAA", alice, 1, data, now)
+	id := files.Resolve(alice, "AAAAAAAA")
+	f, ok := files.Get(id)
+	if id == "AAAAAAAA" || !ok || f.from != alice || !f.verified {
+		t.Fatalf("Expected alice's file to arrive under its own ID but got %#v", f)
+	}
+	if f, _ := files.Get("AAAAAAAA"); f.from != mallory || f.received != 0 {
+		t.Fatalf("Expected mallory's file to be left alone but got %#v", f)
+	}
+}
+
+func TestResendLimit(t *testing.T) {
+	bob := NodeAddress("10.0.0.2:9999")
+	carol := NodeAddress("10.0.0.3:9999")
+	f := &sharedFile{id: "AAAAAAAA", name: "x.txt", chunks: make([][]byte, 3*maxQueuedForRequester)}
+
+	var files fileTransfers
+	files.Share(f)
+	files.queue = nil
+	all := make([]int, len(f.chunks))
+	for i := range all {
+		all[i] = i + 1
+	}
+	files.Resend("AAAAAAAA", bob, all)
+	files.Resend("AAAAAAAA", bob, all)
+	if len(files.queue) != maxQueuedForRequester {
+		t.Fatalf("Expected %d chunks queued for bob but got %d", maxQueuedForRequester, len(files.queue))
+	}
+
+	// Others still get theirs, without repeating those already queued.
+	files.Resend("AAAAAAAA", carol, all)
+	if len(files.queue) != 2*maxQueuedForRequester {
+		t.Fatalf("Expected %d chunks queued but got %d", 2*maxQueuedForRequester, len(files.queue))
+	}
+}
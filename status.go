@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+// clusterStatus is the information shown in the status bar at the bottom of
+// the UI.
+type clusterStatus struct {
+	username string
+	address  NodeAddress
+
+	// healthy and total count the nodes smudge knows about, including
+	// ourselves. peers counts the healthy nodes other than ourselves.
+	healthy, total, peers int
+
+	heartbeatMillis int
+
+	// unread counts the chat messages which arrived while the messages view
+	// was covered or not focused.
+	unread int
+
+	// channel is the channel typed messages are sent to.
+	channel string
+
+	// typing holds the names of the clients which are typing a message.
+	typing []string
+
+	// presence is our own presence, such as "away: lunch", or "" when we
+	// are available.
+	presence string
+}
+
+// currentClusterStatus collects the cluster size from smudge and who is
+// typing. The unread count and the channel are only known to the GUI, so
+// they are left for the caller to fill in.
+func currentClusterStatus() clusterStatus {
+	healthy := smudge.HealthyNodes()
+	peers := 0
+	for _, node := range healthy {
+		if NodeAddress(node.Address()) != localAddress {
+			peers++
+		}
+	}
+
+	status := clusterStatus{
+		username:        localUsername,
+		address:         localAddress,
+		healthy:         len(healthy),
+		total:           len(smudge.AllNodes()),
+		peers:           peers,
+		heartbeatMillis: smudge.GetHeartbeatMillis(),
+	}
+	if chat != nil {
+		status.typing = chat.TypingNames(time.Now())
+	}
+	if p := currentPresence(); p.State != "" {
+		status.presence = p.String()
+	}
+	return status
+}
+
+// String formats the status as a single line of the status bar.
+func (s clusterStatus) String() string {
+	user := fmt.Sprintf("%s@%s", s.username, s.address)
+	if s.presence != "" {
+		user += fmt.Sprintf(" (%s)", s.presence)
+	}
+	parts := []string{
+		user,
+		fmt.Sprintf("%d/%d nodes healthy", s.healthy, s.total),
+		fmt.Sprintf("heartbeat %dms", s.heartbeatMillis),
+	}
+	if s.peers == 0 && s.total > 1 {
+		// smudge keeps pinging dead nodes with a backoff until it forgets
+		// them, so we may still reconnect on our own.
+		parts = append(parts, "disconnected — retrying")
+	} else if s.peers == 0 {
+		parts = append(parts, "waiting for other clients")
+	}
+	if s.channel != "" {
+		parts = append(parts, "in "+sanitizeLine(s.channel))
+	}
+	if s.unread > 0 {
+		parts = append(parts, fmt.Sprintf("%d unread", s.unread))
+	}
+	if len(s.typing) > 0 {
+		parts = append(parts, formatTyping(s.typing))
+	}
+	parts = append(parts, "/help")
+
+	return strings.Join(parts, " │ ")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClusterStatusString(t *testing.T) {
+	var cases = []struct {
+		status         clusterStatus
+		expectedResult string
+	}{
+		{ // When we are connected and have read everything
+			status: clusterStatus{
+				username:        "tester",
+				address:         "127.0.0.1:9999",
+				healthy:         3,
+				total:           4,
+				peers:           2,
+				heartbeatMillis: 500,
+			},
+			expectedResult: "tester@127.0.0.1:9999 │ 3/4 nodes healthy │ heartbeat 500ms │ /help",
+		},
+		{ // When no other client is reachable
+			status: clusterStatus{
+				username:        "tester",
+				address:         "127.0.0.1:9999",
+				healthy:         1,
+				total:           2,
+				heartbeatMillis: 500,
+			},
+			expectedResult: "tester@127.0.0.1:9999 │ 1/2 nodes healthy │ heartbeat 500ms │ disconnected — retrying │ /help",
+		},
+		{ // When we are the first client in the cluster
+			status: clusterStatus{
+				username:        "tester",
+				address:         "127.0.0.1:9999",
+				healthy:         1,
+				total:           1,
+				heartbeatMillis: 500,
+			},
+			expectedResult: "tester@127.0.0.1:9999 │ 1/1 nodes healthy │ heartbeat 500ms │ waiting for other clients │ /help",
+		},
+		{ // When messages arrived while we were looking elsewhere
+			status: clusterStatus{
+				username:        "tester",
+				address:         "127.0.0.1:9999",
+				healthy:         2,
+				total:           2,
+				peers:           1,
+				heartbeatMillis: 250,
+				unread:          4,
+			},
+			expectedResult: "tester@127.0.0.1:9999 │ 2/2 nodes healthy │ heartbeat 250ms │ 4 unread │ /help",
+		},
+		{ // When other clients are typing
+			status: clusterStatus{
+				username:        "tester",
+				address:         "127.0.0.1:9999",
+				healthy:         3,
+				total:           3,
+				peers:           2,
+				heartbeatMillis: 500,
+				typing:          []string{"alice", "bob"},
+			},
+			expectedResult: "tester@127.0.0.1:9999 │ 3/3 nodes healthy │ heartbeat 500ms │ alice, bob are typing… │ /help",
+		},
+		{ // When we are away
+			status: clusterStatus{
+				username:        "tester",
+				address:         "127.0.0.1:9999",
+				healthy:         2,
+				total:           2,
+				peers:           1,
+				heartbeatMillis: 500,
+				presence:        "away: lunch",
+			},
+			expectedResult: "tester@127.0.0.1:9999 (away: lunch) │ 2/2 nodes healthy │ heartbeat 500ms │ /help",
+		},
+		{ // When sending direct messages with unread messages waiting
+			status: clusterStatus{
+				username:        "tester",
+				address:         "127.0.0.1:9999",
+				healthy:         2,
+				total:           2,
+				peers:           1,
+				heartbeatMillis: 500,
+				channel:         "@bob",
+				unread:          3,
+			},
+			expectedResult: "tester@127.0.0.1:9999 │ 2/2 nodes healthy │ heartbeat 500ms │ in @bob │ 3 unread │ /help",
+		},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			result := c.status.String()
+			if result != c.expectedResult {
+				t.Fatalf("Expected %q but got %q", c.expectedResult, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/gocui"
+)
+
+const (
+	// typingInterval is the least time between two typing broadcasts while
+	// the user keeps typing.
+	typingInterval = 3 * time.Second
+
+	// typingTimeout is how long a client is shown as typing after its last
+	// typing broadcast.
+	typingTimeout = 6 * time.Second
+)
+
+var (
+	// sendTyping is cleared by the no-typing privacy setting, so other
+	// clients are not told when we are typing.
+	sendTyping = true
+
+	// lastTypingSent is when we last broadcast that we are typing. It is only
+	// touched from the GUI goroutine.
+	lastTypingSent time.Time
+)
+
+// typingTracker remembers when each client last said it was typing. The zero
+// value is empty, and it is safe to use from several goroutines.
+type typingTracker struct {
+	mu   sync.Mutex
+	seen map[NodeAddress]time.Time
+
+	// expiry fires typingTimeout after the last typing broadcast, once
+	// everyone shown as typing has stopped.
+	expiry *time.Timer
+}
+
+// Saw records that addr was typing at now.
+func (t *typingTracker) Saw(addr NodeAddress, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.seen == nil {
+		t.seen = make(map[NodeAddress]time.Time)
+	}
+	t.seen[addr] = now
+}
+
+// Stop forgets that addr was typing, because its message arrived.
+func (t *typingTracker) Stop(addr NodeAddress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.seen, addr)
+}
+
+// resetExpiry calls expired typingTimeout from now, instead of when it was
+// going to. A single timer is used however many typing broadcasts arrive.
+func (t *typingTracker) resetExpiry(expired func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.expiry == nil {
+		t.expiry = time.AfterFunc(typingTimeout, expired)
+		return
+	}
+	t.expiry.Reset(typingTimeout)
+}
+
+// Active returns the clients which were typing within typingTimeout of now,
+// sorted by address.
+func (t *typingTracker) Active(now time.Time) []NodeAddress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var active []NodeAddress
+	for addr, at := range t.seen {
+		if now.Sub(at) < typingTimeout {
+			active = append(active, addr)
+		} else {
+			delete(t.seen, addr)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i] < active[j] })
+	return active
+}
+
+// TypingNames returns the names of the clients which are typing, sorted.
+func (m *Messenger) TypingNames(now time.Time) []string {
+	var names []string
+	for _, addr := range m.typing.Active(now) {
+		client, _ := m.clients.get(addr)
+		names = append(names, sanitizeLine(client.GetName()))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatTyping describes who is typing for the status bar.
+func formatTyping(names []string) string {
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0] + " is typing…"
+	case 2, 3:
+		return strings.Join(names, ", ") + " are typing…"
+	default:
+		return "several people are typing…"
+	}
+}
+
+// receiveTyping shows that senderAddr is typing, until it stops or its message
+// arrives. Typing broadcasts are not stored anywhere else. Clients which keep
+// typing are redrawn by their next broadcast, so the status bar only needs
+// redrawing once the last of them stops.
+func (m *Messenger) receiveTyping(senderAddr NodeAddress) {
+	m.typing.Saw(senderAddr, time.Now())
+	printStatusBar()
+	m.typing.resetExpiry(printStatusBar)
+}
+
+// typingEditor is the editor of the "enter-text" view. It edits like the
+// default editor, and tells the other clients that we are typing a message.
+func typingEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	gocui.DefaultEditor.Edit(v, key, ch, mod)
+	noteInput()
+
+	text := strings.TrimSpace(v.Buffer())
+	if !sendTyping || text == "" || strings.HasPrefix(text, "/") {
+		// Commands, such as /msg, are not announced.
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(lastTypingSent) < typingInterval {
+		return
+	}
+	lastTypingSent = now
+
+	msg := message{Type: messageTypeTyping, Version: clientVersion}
+	if err := broadcast(&msg); err != nil {
+		logError("Failed to broadcast that we are typing", "err", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTypingTracker(t *testing.T) {
+	alice := NodeAddress("192.168.0.10:9999")
+	bob := NodeAddress("192.168.0.11:9999")
+	start := time.Unix(1000, 0)
+
+	var tracker typingTracker
+	tracker.Saw(bob, start)
+	tracker.Saw(alice, start.Add(2*time.Second))
+	if active := tracker.Active(start.Add(3 * time.Second)); !reflect.DeepEqual(active, []NodeAddress{alice, bob}) {
+		t.Fatalf("Expected alice and bob to be typing but got %v", active)
+	}
+
+	// bob stops updating and expires, alice sends her message.
+	if active := tracker.Active(start.Add(typingTimeout + time.Second)); !reflect.DeepEqual(active, []NodeAddress{alice}) {
+		t.Fatalf("Expected only alice to be typing but got %v", active)
+	}
+	tracker.Stop(alice)
+	if active := tracker.Active(start.Add(3 * time.Second)); len(active) != 0 {
+		t.Fatalf("Expected nobody to be typing but got %v", active)
+	}
+}
+
+func TestFormatTyping(t *testing.T) {
+	var cases = []struct {
+		names          []string
+		expectedResult string
+	}{
+		{nil, ""},
+		{[]string{"alice"}, "alice is typing…"},
+		{[]string{"alice", "bob"}, "alice, bob are typing…"},
+		{[]string{"alice", "bob", "carol", "dave"}, "several people are typing…"},
+	}
+
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("Test case %d", i), func(t *testing.T) {
+			if result := formatTyping(c.names); result != c.expectedResult {
+				t.Fatalf("Expected %q but got %q", c.expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestReceiveTypingFlood(t *testing.T) {
+	bob := NodeAddress("192.168.0.11:9999")
+	m := Messenger{
+		clients:     ClientList{bob: ChatClient{}},
+		flood:       newFloodGuard(1, 2, time.Now),
+		signalFlood: newFloodGuard(1, 2, time.Now),
+	}
+
+	msg := message{Type: messageTypeTyping, Version: clientVersion}
+	for i := 0; i < 50; i++ {
+		m.receive(bob, msg.Encode())
+	}
+	if n := m.signalFlood.TakeSuppressed()[bob]; n != 48 {
+		t.Fatalf("Expected 48 typing broadcasts to be held back but got %d", n)
+	}
+	if n := m.flood.TakeSuppressed()[bob]; n != 0 {
+		t.Fatalf("Expected no chat messages to be held back but got %d", n)
+	}
+	if active := m.typing.Active(time.Now()); !reflect.DeepEqual(active, []NodeAddress{bob}) {
+		t.Fatalf("Expected bob to be typing but got %v", active)
+	}
+	m.typing.expiry.Stop()
+}